@@ -0,0 +1,254 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultAccessLogTemplate is the format of text access log lines, unless the config sets another
+const DefaultAccessLogTemplate = "[{{.time}}] {{.uuid}} {{.client_addr}} {{.method}} {{.url}} {{.response_code}} {{ms .response_time}}ms {{.target_ip}} {{.protocol}} {{.source_ip}} {{.tenant}}"
+
+// accessLogFields are the fields of every access log record. The JSON format writes them under these names,
+// so they must not change; add new ones instead.
+var accessLogFields = []string{"uuid", "client_addr", "method", "url", "user_agent", "target_ip", "source_ip", "protocol", "tenant",
+	"response_code", "reason_code", "request_bytes", "response_bytes", "tls_version", "tls_cipher", "client_cert",
+	"dns_time", "connect_time", "tls_time", "ttfb", "server_time", "transfer_time", "response_time", "socks_reply"}
+
+// accessLogEntry is what the access log records about a request. Fields that don't apply, like the TLS ones
+// for a plain HTTP target, are left empty.
+type accessLogEntry struct {
+	uuid          uuid.UUID
+	clientAddr    string
+	method        string
+	url           string
+	userAgent     string
+	targetIP      string
+	sourceIP      string
+	protocol      string
+	tenant        string
+	responseCode  int
+	reasonCode    string
+	requestBytes  int64
+	responseBytes int64
+	tlsVersion    string
+	tlsCipher     string
+	clientCert    string
+	dnsTime       time.Duration
+	connectTime   time.Duration
+	tlsTime       time.Duration
+	ttfb          time.Duration
+	serverTime    time.Duration
+	transferTime  time.Duration
+	responseTime  time.Duration
+	// socksReply is the SOCKS5 reply code, for SOCKS5 sessions; responseCode is the closest HTTP status
+	socksReply string
+}
+
+func newAccessLogEntry(r *http.Request, requestUUID uuid.UUID) *accessLogEntry {
+	return &accessLogEntry{
+		uuid:       requestUUID,
+		clientAddr: r.RemoteAddr,
+		method:     r.Method,
+		url:        requestURL(r),
+		userAgent:  r.UserAgent(),
+	}
+}
+
+// setResponse records the protocol and TLS parameters of the target's response
+func (e *accessLogEntry) setResponse(resp *http.Response) {
+	e.protocol = resp.Proto
+	if resp.TLS != nil {
+		e.tlsVersion = tlsVersionName(resp.TLS.Version)
+		e.tlsCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+}
+
+func (e *accessLogEntry) setTimings(t *phaseTimings) {
+	e.dnsTime, e.connectTime, e.tlsTime, e.ttfb = t.get(dnsPhase), t.get(connectPhase), t.get(tlsPhase), t.get(ttfbPhase)
+	e.serverTime, e.transferTime = t.get(serverPhase), t.get(transferPhase)
+}
+
+func (e *accessLogEntry) fields() logrus.Fields {
+	return logrus.Fields{"uuid": e.uuid.String(), "client_addr": e.clientAddr, "method": e.method, "url": e.url, "user_agent": e.userAgent,
+		"target_ip": e.targetIP, "source_ip": e.sourceIP, "protocol": e.protocol, "tenant": e.tenant,
+		"response_code": e.responseCode, "reason_code": e.reasonCode, "request_bytes": e.requestBytes, "response_bytes": e.responseBytes,
+		"tls_version": e.tlsVersion, "tls_cipher": e.tlsCipher, "client_cert": e.clientCert,
+		"dns_time": e.dnsTime, "connect_time": e.connectTime, "tls_time": e.tlsTime, "ttfb": e.ttfb,
+		"server_time": e.serverTime, "transfer_time": e.transferTime, "response_time": e.responseTime,
+		"socks_reply": e.socksReply}
+}
+
+func logRequest(e *accessLogEntry) {
+	accessLog.WithFields(e.fields()).Info()
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+const phaseTimingsKey key = 3
+
+type phase int
+
+const (
+	dnsPhase phase = iota
+	connectPhase
+	tlsPhase
+	// ttfbPhase is from the start of the request to the first byte of the response, so it includes the ones
+	// before it
+	ttfbPhase
+	// serverPhase is from when the whole request was sent to the first byte of the response: the target's
+	// think time
+	serverPhase
+	// transferPhase is the time spent reading the response body from the target and sending it to the client
+	transferPhase
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"dns", "connect", "tls", "ttfb", "server", "transfer"}
+
+// phaseTimings records how long the phases of getting a response from the target took. The dialer records
+// the connection phases, so they stay zero when a pooled connection is reused.
+type phaseTimings struct {
+	mu        sync.Mutex
+	durations [numPhases]time.Duration
+}
+
+func withPhaseTimings(ctx context.Context) (context.Context, *phaseTimings) {
+	t := &phaseTimings{}
+	return context.WithValue(ctx, phaseTimingsKey, t), t
+}
+
+// recordPhase adds the time since start to a phase of the request's timings, if it's keeping any
+func recordPhase(ctx context.Context, p phase, start time.Time) {
+	if t, ok := ctx.Value(phaseTimingsKey).(*phaseTimings); ok {
+		t.mu.Lock()
+		t.durations[p] += time.Since(start)
+		t.mu.Unlock()
+	}
+}
+
+func (t *phaseTimings) get(p phase) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.durations[p]
+}
+
+// observe records the phases in the phase histogram. Phases that didn't happen, like connecting on a
+// reused connection, are left out rather than counted as taking no time.
+func (t *phaseTimings) observe(tenant string) {
+	for p := phase(0); p < numPhases; p++ {
+		if d := t.get(p); d > 0 {
+			phaseHistogram.With(prometheus.Labels{"phase": phaseNames[p], "tenant": tenant}).Observe(float64(d) / float64(time.Millisecond))
+		}
+	}
+}
+
+// countingReader counts the bytes read through it. A request body is read on the transport's goroutine, which
+// may still be reading when the handler logs the count, so it's updated atomically.
+type countingReader struct {
+	// n comes first so that it's 64-bit aligned for atomic access on 32-bit platforms
+	n int64
+	io.ReadCloser
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// AccessLogTextFormatter writes access log records as text, with a template whose data are the record's
+// fields. Empty fields show up as "-", and the record's time is available as .time.
+type AccessLogTextFormatter struct {
+	template *template.Template
+}
+
+func newAccessLogTextFormatter(text string) (*AccessLogTextFormatter, error) {
+	if text == "" {
+		return &AccessLogTextFormatter{}, nil
+	}
+	t, err := parseAccessLogTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogTextFormatter{template: t}, nil
+}
+
+var defaultAccessLogTemplate = template.Must(parseAccessLogTemplate(DefaultAccessLogTemplate))
+
+func parseAccessLogTemplate(text string) (*template.Template, error) {
+	return template.New("accessLog").Funcs(template.FuncMap{
+		// ms formats a duration as whole milliseconds
+		"ms": func(d interface{}) int64 {
+			if duration, ok := d.(time.Duration); ok {
+				return duration.Milliseconds()
+			}
+			return 0
+		},
+	}).Parse(text)
+}
+
+func (f *AccessLogTextFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	t := f.template
+	if t == nil {
+		t = defaultAccessLogTemplate
+	}
+	data := make(map[string]interface{}, len(accessLogFields)+1)
+	for _, name := range accessLogFields {
+		data[name] = "-"
+	}
+	for name, value := range entry.Data {
+		if value != "" && value != nil {
+			data[name] = value
+		}
+	}
+	data["time"] = entry.Time.Format(time.RFC3339)
+	var line bytes.Buffer
+	if err := t.Execute(&line, data); err != nil {
+		return nil, err
+	}
+	line.WriteByte('\n')
+	return line.Bytes(), nil
+}
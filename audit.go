@@ -0,0 +1,273 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditRecord is one line of the audit log. Hash is the SHA-256 of the record's JSON encoding without Hash
+// and HMAC, and PrevHash is the Hash of the record before it, so editing, removing or reordering records
+// breaks the chain. HMAC, if a key is configured, is computed over the same bytes as Hash, so the chain
+// can't be recomputed by someone who doesn't have the key. Hash and HMAC are appended to those bytes as the
+// last fields of the line, so the verifier checks exactly what was written rather than a re-encoding.
+type auditRecord struct {
+	Seq      uint64                 `json:"seq"`
+	Time     string                 `json:"time"`
+	Fields   map[string]interface{} `json:"fields"`
+	PrevHash string                 `json:"prev_hash"`
+	Hash     string                 `json:"hash,omitempty"`
+	HMAC     string                 `json:"hmac,omitempty"`
+}
+
+// sign encodes the record without Hash and HMAC, sets them from those bytes, and returns the line to write
+func (r *auditRecord) sign(hmacKey []byte) ([]byte, error) {
+	r.Hash, r.HMAC = "", ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	r.Hash = hex.EncodeToString(sum[:])
+	if len(hmacKey) > 0 {
+		r.HMAC = auditHMAC(hmacKey, data)
+	}
+	return signedAuditLine(data, r.Hash, r.HMAC), nil
+}
+
+// signedAuditLine appends the hash and HMAC fields to the encoding of an unsigned record
+func signedAuditLine(data []byte, hash string, hmac string) []byte {
+	line := append([]byte{}, data[:len(data)-1]...)
+	line = append(line, `,"hash":"`+hash+`"`...)
+	if hmac != "" {
+		line = append(line, `,"hmac":"`+hmac+`"`...)
+	}
+	return append(line, '}')
+}
+
+// unsignedAuditLine returns the bytes a line's hash and HMAC were computed over. The hash field is the last
+// one that isn't nested, so it's the last occurrence of its key: quotes inside strings are escaped.
+func unsignedAuditLine(line []byte) ([]byte, bool) {
+	i := bytes.LastIndex(line, []byte(`,"hash":"`))
+	if i < 0 {
+		return nil, false
+	}
+	return append(line[:i:i], '}'), true
+}
+
+func auditHMAC(key []byte, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditHook is a logrus hook that writes every access log entry to the hash-chained audit log
+type auditHook struct {
+	mu       sync.Mutex
+	out      io.Writer
+	hmacKey  []byte
+	seq      uint64
+	prevHash string
+}
+
+// newAuditHook opens the audit log for appending. If it already has records, the chain continues from the
+// last one.
+func newAuditHook(config AuditLogConfig) (*auditHook, error) {
+	last, err := lastAuditRecord(config.File)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	hmacKey := config.HMACKey
+	if hmacKey == "" {
+		if hmacKey, err = readAuditHMACKey(config.HMACKeyFile); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	hook := &auditHook{out: f, hmacKey: []byte(hmacKey)}
+	if last != nil {
+		hook.seq = last.Seq
+		hook.prevHash = last.Hash
+	}
+	return hook, nil
+}
+
+func lastAuditRecord(file string) (*auditRecord, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last []byte
+	scanner := newAuditScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+	record := &auditRecord{}
+	if err := json.Unmarshal(last, record); err != nil {
+		return nil, fmt.Errorf("Cannot continue audit log %s, its last record is invalid: %s", file, err)
+	}
+	return record, nil
+}
+
+func newAuditScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+func (h *auditHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *auditHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	record := &auditRecord{
+		Seq:      h.seq + 1,
+		Time:     entry.Time.UTC().Format(time.RFC3339Nano),
+		Fields:   map[string]interface{}(entry.Data),
+		PrevHash: h.prevHash,
+	}
+	line, err := record.sign(h.hmacKey)
+	if err != nil {
+		return err
+	}
+	if _, err := h.out.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	h.seq = record.Seq
+	h.prevHash = record.Hash
+	return nil
+}
+
+// verifyAuditLog checks the chain of an audit log, returning the number of records and a description of
+// each problem found. Checking carries on past a problem, so one edit doesn't hide the ones after it.
+// Records removed from the end of the log can't be detected.
+func verifyAuditLog(r io.Reader, hmacKey []byte) (uint64, []string) {
+	var problems []string
+	var count, expectedSeq uint64 = 0, 1
+	var prevHash string
+	scanner := newAuditScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		count++
+		record := &auditRecord{}
+		if err := json.Unmarshal(raw, record); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: invalid record: %s", line, err))
+			continue
+		}
+		if record.Seq != expectedSeq {
+			problems = append(problems, fmt.Sprintf("line %d: expected sequence number %d, found %d", line, expectedSeq, record.Seq))
+		}
+		if record.PrevHash != prevHash {
+			problems = append(problems, fmt.Sprintf("line %d: does not follow the previous record", line))
+		}
+		data, ok := unsignedAuditLine(raw)
+		sum := sha256.Sum256(data)
+		// Anything after the hash and HMAC, or a different encoding of them, isn't covered by the hash
+		if !ok || hex.EncodeToString(sum[:]) != record.Hash || !bytes.Equal(signedAuditLine(data, record.Hash, record.HMAC), raw) {
+			problems = append(problems, fmt.Sprintf("line %d: record was modified", line))
+		}
+		if len(hmacKey) > 0 && !hmac.Equal([]byte(auditHMAC(hmacKey, data)), []byte(record.HMAC)) {
+			problems = append(problems, fmt.Sprintf("line %d: HMAC does not match", line))
+		}
+		expectedSeq = record.Seq + 1
+		prevHash = record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		problems = append(problems, fmt.Sprintf("error reading audit log: %s", err))
+	}
+	return count, problems
+}
+
+// AuditHMACKeyEnv is the environment variable the audit log's HMAC key is read from, unless there's a key file.
+// "whsentry audit verify" doesn't take the key on the command line, where other users could see it.
+const AuditHMACKeyEnv = "WHSENTRY_AUDIT_HMAC_KEY"
+
+// readAuditHMACKey reads the HMAC key from a file, without its trailing newline, or from AuditHMACKeyEnv if
+// there's no file
+func readAuditHMACKey(keyFile string) (string, error) {
+	if keyFile == "" {
+		return os.Getenv(AuditHMACKeyEnv), nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read HMAC key file: %s", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+const auditUsage = "Usage: whsentry audit verify [-hmac-key-file file] <file>"
+
+// runAuditCommand implements "whsentry audit verify [-hmac-key-file file] <file>", returning the exit status
+func runAuditCommand(args []string, stdout io.Writer) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(stdout, auditUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	hmacKeyFile := flags.String("hmac-key-file", "", "File containing the HMAC key the audit log was written with, instead of $"+AuditHMACKeyEnv)
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stdout, auditUsage)
+		return 2
+	}
+	hmacKey, err := readAuditHMACKey(*hmacKeyFile)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 2
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stdout, "Cannot open audit log: %s\n", err)
+		return 2
+	}
+	defer f.Close()
+	count, problems := verifyAuditLog(f, []byte(hmacKey))
+	for _, problem := range problems {
+		fmt.Fprintln(stdout, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(stdout, "Audit log %s FAILED verification: %d problem(s) in %d records\n", flags.Arg(0), len(problems), count)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Audit log %s verified: %d records\n", flags.Arg(0), count)
+	return 0
+}
@@ -0,0 +1,155 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func writeAuditRecords(t *testing.T, config AuditLogConfig, n int) {
+	hook, err := newAuditHook(config)
+	checkNoError(t, err)
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(hook)
+	for i := 0; i < n; i++ {
+		logger.WithFields(logrus.Fields{"url": "http://example.com/", "response_code": 200, "response_time": 1500 * time.Microsecond}).Info()
+	}
+	hook.out.(*os.File).Close()
+}
+
+func verifyAuditLines(lines []string, hmacKey string) (uint64, []string) {
+	return verifyAuditLog(strings.NewReader(strings.Join(lines, "\n")+"\n"), []byte(hmacKey))
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	config := AuditLogConfig{File: filepath.Join(dir, "audit.log"), HMACKey: "s3cret"}
+	writeAuditRecords(t, config, 3)
+	// A restart continues the chain
+	writeAuditRecords(t, config, 2)
+	data, err := ioutil.ReadFile(config.File)
+	checkNoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assertEqual(t, 5, len(lines))
+
+	t.Run("Intact", func(t *testing.T) {
+		count, problems := verifyAuditLines(lines, "s3cret")
+		assertEqual(t, uint64(5), count)
+		assertEqual(t, 0, len(problems))
+	})
+
+	t.Run("Modified", func(t *testing.T) {
+		tampered := append([]string(nil), lines...)
+		tampered[2] = strings.Replace(tampered[2], `"response_code":200`, `"response_code":404`, 1)
+		_, problems := verifyAuditLines(tampered, "")
+		assertEqual(t, 1, len(problems))
+		assertEqual(t, "line 3: record was modified", problems[0])
+	})
+
+	t.Run("Gap", func(t *testing.T) {
+		_, problems := verifyAuditLines(append(append([]string(nil), lines[:1]...), lines[2:]...), "")
+		assertEqual(t, "line 2: expected sequence number 2, found 3", problems[0])
+		assertEqual(t, "line 2: does not follow the previous record", problems[1])
+	})
+
+	t.Run("Reordered", func(t *testing.T) {
+		_, problems := verifyAuditLines([]string{lines[0], lines[2], lines[1], lines[3], lines[4]}, "")
+		if len(problems) == 0 {
+			t.Fatal("Expected reordered records to fail verification")
+		}
+	})
+
+	t.Run("Chain recomputed without the key", func(t *testing.T) {
+		otherConfig := AuditLogConfig{File: filepath.Join(dir, "forged.log"), HMACKey: "guess"}
+		writeAuditRecords(t, otherConfig, 1)
+		forged, err := ioutil.ReadFile(otherConfig.File)
+		checkNoError(t, err)
+		_, problems := verifyAuditLines([]string{strings.TrimSpace(string(forged))}, "s3cret")
+		assertEqual(t, "line 1: HMAC does not match", problems[0])
+	})
+
+	t.Run("Invalid UTF-8", func(t *testing.T) {
+		invalidConfig := AuditLogConfig{File: filepath.Join(dir, "invalid-utf8.log"), HMACKey: "s3cret"}
+		hook, err := newAuditHook(invalidConfig)
+		checkNoError(t, err)
+		logger := logrus.New()
+		logger.Out = ioutil.Discard
+		logger.AddHook(hook)
+		logger.WithFields(logrus.Fields{"url": "http://example.com/\xff", "user_agent": "bot\xfe\xff"}).Info()
+		hook.out.(*os.File).Close()
+		data, err := ioutil.ReadFile(invalidConfig.File)
+		checkNoError(t, err)
+		count, problems := verifyAuditLines([]string{strings.TrimSpace(string(data))}, "s3cret")
+		assertEqual(t, uint64(1), count)
+		assertEqual(t, 0, len(problems))
+
+		// Older Go versions escape the replacement character, which decodes and encodes again differently
+		unsigned := []byte(`{"seq":1,"time":"2020-10-01T00:00:00Z","fields":{"user_agent":"bot\ufffd"},"prev_hash":""}`)
+		sum := sha256.Sum256(unsigned)
+		line := signedAuditLine(unsigned, hex.EncodeToString(sum[:]), auditHMAC([]byte("s3cret"), unsigned))
+		_, problems = verifyAuditLines([]string{string(line)}, "s3cret")
+		assertEqual(t, 0, len(problems))
+	})
+
+	t.Run("Content after the hash", func(t *testing.T) {
+		tampered := append([]string(nil), lines...)
+		tampered[1] = strings.TrimSuffix(tampered[1], "}") + `,"extra":1}`
+		_, problems := verifyAuditLines(tampered, "")
+		assertEqual(t, "line 2: record was modified", problems[0])
+	})
+
+	t.Run("Key from a file or the environment", func(t *testing.T) {
+		keyFile := filepath.Join(dir, "writer.key")
+		checkNoError(t, ioutil.WriteFile(keyFile, []byte("from-file\n"), 0600))
+		fileConfig := AuditLogConfig{File: filepath.Join(dir, "key-file.log"), HMACKeyFile: keyFile}
+		writeAuditRecords(t, fileConfig, 1)
+		data, err := ioutil.ReadFile(fileConfig.File)
+		checkNoError(t, err)
+		_, problems := verifyAuditLines([]string{strings.TrimSpace(string(data))}, "from-file")
+		assertEqual(t, 0, len(problems))
+
+		os.Setenv(AuditHMACKeyEnv, "from-env")
+		defer os.Unsetenv(AuditHMACKeyEnv)
+		envConfig := AuditLogConfig{File: filepath.Join(dir, "key-env.log")}
+		writeAuditRecords(t, envConfig, 1)
+		data, err = ioutil.ReadFile(envConfig.File)
+		checkNoError(t, err)
+		_, problems = verifyAuditLines([]string{strings.TrimSpace(string(data))}, "from-env")
+		assertEqual(t, 0, len(problems))
+
+		_, err = newAuditHook(AuditLogConfig{File: filepath.Join(dir, "no-key.log"), HMACKeyFile: filepath.Join(dir, "missing.key")})
+		assertError(t, "Cannot read HMAC key file", err)
+		_, err = unmarshalAndValidate([]byte("auditLog:\n  file: audit.log\n  hmacKey: s3cret\n  hmacKeyFile: /etc/whsentry/audit.key\n"))
+		assertError(t, "hmacKey or an hmacKeyFile, not both", err)
+	})
+
+	t.Run("Verify command", func(t *testing.T) {
+		out := new(bytes.Buffer)
+		os.Setenv(AuditHMACKeyEnv, "s3cret")
+		defer os.Unsetenv(AuditHMACKeyEnv)
+		assertEqual(t, 0, runAuditCommand([]string{"verify", config.File}, out))
+		assertEqual(t, "Audit log "+config.File+" verified: 5 records\n", out.String())
+
+		// A key file takes precedence over the environment
+		keyFile := filepath.Join(filepath.Dir(config.File), "hmac.key")
+		checkNoError(t, ioutil.WriteFile(keyFile, []byte("wrong\n"), 0600))
+		assertEqual(t, 1, runAuditCommand([]string{"verify", "-hmac-key-file", keyFile, config.File}, new(bytes.Buffer)))
+		checkNoError(t, ioutil.WriteFile(keyFile, []byte("s3cret\n"), 0600))
+		assertEqual(t, 0, runAuditCommand([]string{"verify", "-hmac-key-file", keyFile, config.File}, new(bytes.Buffer)))
+		assertEqual(t, 2, runAuditCommand([]string{"check", config.File}, new(bytes.Buffer)))
+	})
+}
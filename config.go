@@ -12,11 +12,14 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"gopkg.in/yaml.v2"
 )
 
@@ -33,6 +36,8 @@ cidrDenyList: [
 	"224.0.0.0/4",
 	"240.0.0.0/4"
 	]
+rejectMixedDnsAnswers: false
+allowedPorts: [80, 443, 8080, 8443]
 listeners:
   - type: http
     address: ":9090"
@@ -42,12 +47,49 @@ readTimeout: 10s
 insecureSkipCertVerification: false
 insecureSkipCidrDenyList: false
 maxResponseBodySize: 1048576
+responseOverflowMode: truncate
+maxRequestBodySize: 0
+outboundHttp2: false
+outboundKeepAlive:
+  enabled: false
+  maxIdleConns: 100
+  maxIdleConnsPerHost: 2
+  idleConnTimeout: 20s
 mozillaCaCerts: mozilla-cacerts/cacerts.pem
+dns:
+  timeout: 5s
+  cache:
+    enabled: false
+    minTTL: 5s
+    maxTTL: 5m
+    negativeTTL: 30s
+    maxEntries: 10000
+deliveryReceipts:
+  enabled: false
+  maxBodyBytes: 1024
+  timeout: 5s
+  queueSize: 1000
+tracing:
+  enabled: false
+  exporter: otlp
+  endpoint: http://localhost:4318/v1/traces
+  serviceName: webhook-sentry
+  sampleRatio: 1.0
+  propagation: forward
+  timeout: 5s
+  batchSize: 512
+  flushInterval: 5s
+  queueSize: 2048
 accessLog:
   type: text
 proxyLog:
   type: text
 metricsAddress: 127.0.0.1:2112
+metrics:
+  destinations:
+    enabled: false
+    maxHosts: 100
+    rankInterval: 10m
 `
 
 type Cidr net.IPNet
@@ -59,8 +101,23 @@ type ProxyConfig struct {
 	ConnectionLifetime           time.Duration              `yaml:"connectionLifetime"`
 	ReadTimeout                  time.Duration              `yaml:"readTimeout"`
 	MaxResponseBodySize          uint32                     `yaml:"maxResponseBodySize"`
+	ResponseOverflowMode         OverflowMode               `yaml:"responseOverflowMode"`
+	MaxRequestBodySize           uint32                     `yaml:"maxRequestBodySize"`
+	OutboundKeepAlive            KeepAliveConfig            `yaml:"outboundKeepAlive"`
+	OutboundHTTP2                bool                       `yaml:"outboundHttp2"`
 	InsecureSkipCertVerification bool                       `yaml:"insecureSkipCertVerification"`
 	InsecureSkipCidrDenyList     bool                       `yaml:"insecureSkipCidrDenyList"`
+	CidrAllowList                []Cidr                     `yaml:"cidrAllowList"`
+	HostDenyList                 []HostPattern              `yaml:"hostDenyList"`
+	HostAllowList                []HostPattern              `yaml:"hostAllowList"`
+	RejectMixedDNSAnswers        bool                       `yaml:"rejectMixedDnsAnswers"`
+	AllowedPorts                 []uint16                   `yaml:"allowedPorts"`
+	PortExceptions               []PortException            `yaml:"portExceptions"`
+	UpstreamProxies              []UpstreamProxyConfig      `yaml:"upstreamProxies"`
+	EgressPools                  []EgressPoolConfig         `yaml:"egressPools"`
+	DefaultEgressPool            string                     `yaml:"defaultEgressPool"`
+	RequestIDHeader              string                     `yaml:"requestIdHeader"`
+	Tenants                      []TenantConfig             `yaml:"tenants"`
 	ClientCertFile               string                     `yaml:"clientCertFile"`
 	ClientKeyFile                string                     `yaml:"clientKeyFile"`
 	ClientCerts                  map[string]tls.Certificate `yaml:"-"`
@@ -69,16 +126,22 @@ type ProxyConfig struct {
 	MitmIssuerKeyFile            string                     `yaml:"mitmIssuerKeyFile"`
 	MitmIssuerCert               *tls.Certificate           `yaml:"-"`
 	MozillaCaCerts               string                     `yaml:"mozillaCaCerts"`
+	DNS                          DNSConfig                  `yaml:"dns"`
+	DeliveryReceipts             DeliveryReceiptsConfig     `yaml:"deliveryReceipts"`
+	Tracing                      TracingConfig              `yaml:"tracing"`
 	AccessLog                    LogConfig                  `yaml:"accessLog"`
+	AuditLog                     AuditLogConfig             `yaml:"auditLog"`
 	ProxyLog                     LogConfig                  `yaml:"proxyLog"`
 	MetricsAddress               string                     `yaml:"metricsAddress"`
+	Metrics                      MetricsConfig              `yaml:"metrics"`
 }
 
 type Protocol string
 
 const (
-	HTTP  Protocol = "http"
-	HTTPS Protocol = "https"
+	HTTP   Protocol = "http"
+	HTTPS  Protocol = "https"
+	SOCKS5 Protocol = "socks5"
 )
 
 type ListenerConfig struct {
@@ -86,6 +149,239 @@ type ListenerConfig struct {
 	Type     Protocol
 	CertFile string `yaml:"certFile"`
 	KeyFile  string `yaml:"keyFile"`
+	// HTTP2 allows clients to negotiate HTTP/2 with ALPN on HTTPS listeners
+	HTTP2 bool `yaml:"http2"`
+	// H2C allows clients to speak cleartext HTTP/2 with prior knowledge on HTTP listeners
+	H2C    bool         `yaml:"h2c"`
+	Socks5 Socks5Config `yaml:"socks5"`
+	// SocketMode and SocketOwner set the permissions and "user[:group]" owner of a Unix socket listener
+	SocketMode    string              `yaml:"socketMode"`
+	SocketOwner   string              `yaml:"socketOwner"`
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxyProtocol"`
+	// AllowedClientCidrs, if set, are the only client addresses the listener serves
+	AllowedClientCidrs []Cidr `yaml:"allowedClientCidrs"`
+	// Tenant is the tenant profile for every request on the listener
+	Tenant string `yaml:"tenant"`
+	// AllowedTenants are the tenants that requests on the listener may pick with the tenant header
+	AllowedTenants []string `yaml:"allowedTenants"`
+	// Users maps usernames to passwords that clients of an HTTP or HTTPS listener send in Proxy-Authorization.
+	// If empty, clients don't need to authenticate.
+	Users map[string]string `yaml:"users"`
+}
+
+// ProxyProtocolConfig enables the HAProxy PROXY protocol (v1 or v2) on a listener, for when it's behind a
+// TCP load balancer. Only connections from TrustedCidrs may send the header, and they must send it.
+type ProxyProtocolConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	TrustedCidrs []Cidr `yaml:"trustedCidrs"`
+}
+
+const unixAddressPrefix = "unix:"
+
+// isUnixAddress returns whether a listener address is a Unix domain socket, in the form "unix:/path/to/socket"
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, unixAddressPrefix)
+}
+
+func unixSocketPath(address string) string {
+	return strings.TrimPrefix(address, unixAddressPrefix)
+}
+
+// UpstreamProxyConfig sends outbound connections to the matching hosts through another proxy. URL is an
+// http, https (HTTP CONNECT) or socks5 URL, optionally with a username and password. CAFile is a PEM file
+// of the CAs an https upstream's certificate is checked against, instead of the Mozilla bundle.
+type UpstreamProxyConfig struct {
+	Hosts  []HostPattern `yaml:"hosts"`
+	URL    string        `yaml:"url"`
+	CAFile string        `yaml:"caFile"`
+}
+
+// EgressPoolConfig is a named pool of local source addresses for outbound connections, used round-robin.
+// Connections to targets matching Hosts use the pool, unless the request selects another one by name.
+// A pool without hosts is only used when it's selected by name, or is the default pool.
+type EgressPoolConfig struct {
+	Name      string        `yaml:"name"`
+	Addresses []string      `yaml:"addresses"`
+	Hosts     []HostPattern `yaml:"hosts"`
+}
+
+// TenantConfig is a named profile whose settings override the global ones for the requests it's selected for.
+// Unset fields keep the global value. The global host and port rules always apply too, so a tenant can only
+// narrow them: HostDenyList adds to the global deny list, and a host or port must be allowed by both the
+// tenant's and the global HostAllowList and AllowedPorts. Identities are the usernames, from an HTTP or HTTPS
+// listener's users or a SOCKS5 listener's, whose requests belong to the tenant.
+type TenantConfig struct {
+	Name                 string        `yaml:"name"`
+	Identities           []string      `yaml:"identities"`
+	ConnectTimeout       time.Duration `yaml:"connectTimeout"`
+	ConnectionLifetime   time.Duration `yaml:"connectionLifetime"`
+	ReadTimeout          time.Duration `yaml:"readTimeout"`
+	MaxResponseBodySize  uint32        `yaml:"maxResponseBodySize"`
+	ResponseOverflowMode OverflowMode  `yaml:"responseOverflowMode"`
+	MaxRequestBodySize   uint32        `yaml:"maxRequestBodySize"`
+	HostAllowList        []HostPattern `yaml:"hostAllowList"`
+	HostDenyList         []HostPattern `yaml:"hostDenyList"`
+	AllowedPorts         []uint16      `yaml:"allowedPorts"`
+	ClientCertFile       string        `yaml:"clientCertFile"`
+	ClientKeyFile        string        `yaml:"clientKeyFile"`
+	EgressPool           string        `yaml:"egressPool"`
+	SigningKey           string        `yaml:"signingKey"`
+}
+
+// Socks5Config holds the options for SOCKS5 listeners
+type Socks5Config struct {
+	// Users maps usernames to passwords. If empty, clients don't need to authenticate.
+	Users             map[string]string `yaml:"users"`
+	AllowBind         bool              `yaml:"allowBind"`
+	AllowUDPAssociate bool              `yaml:"allowUdpAssociate"`
+}
+
+// HostPattern matches hostnames. It is one of:
+//   - an exact hostname, like "example.com"
+//   - a wildcard like "*.example.com", which matches any subdomain of example.com but not example.com itself
+//   - a suffix like ".example.com", which matches example.com and any of its subdomains
+//   - a regular expression prefixed with "~", like "~^hooks-[0-9]+\.example\.com$"
+type HostPattern struct {
+	pattern string
+	regex   *regexp.Regexp
+}
+
+type PortException struct {
+	Host  HostPattern `yaml:"host"`
+	Ports []uint16    `yaml:"ports"`
+}
+
+// KeepAliveConfig controls pooling of outbound connections to targets. Pools are kept per target
+// host and client certificate.
+type KeepAliveConfig struct {
+	Enabled             bool          `yaml:"enabled"`
+	MaxIdleConns        int           `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
+}
+
+type DNSConfig struct {
+	// Servers are tried in order. Each is either a bare address (UDP) or a URL with one of the schemes
+	// udp, tcp, tls (DNS-over-TLS) or https (DNS-over-HTTPS). If empty, the system resolver is used.
+	Servers []string      `yaml:"servers"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Hosts statically maps hostnames to IP addresses, taking precedence over the servers
+	Hosts map[string]string `yaml:"hosts"`
+	Cache DNSCacheConfig    `yaml:"cache"`
+}
+
+type DNSCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Record TTLs are clamped to be within MinTTL and MaxTTL. Answers from the system resolver, which
+	// doesn't expose TTLs, are cached for MinTTL.
+	MinTTL      time.Duration `yaml:"minTTL"`
+	MaxTTL      time.Duration `yaml:"maxTTL"`
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+	MaxEntries  int           `yaml:"maxEntries"`
+}
+
+// OverflowMode is what happens when a response body without a Content-Length turns out to be larger than
+// maxResponseBodySize
+type OverflowMode string
+
+const (
+	// Truncate stops forwarding the body at the limit and ends the response normally
+	Truncate OverflowMode = "truncate"
+	// Buffer holds back the response until the whole body has been read, so an oversized one becomes a 502
+	Buffer OverflowMode = "buffer"
+	// Reset aborts the response mid-body, so the client sees a broken connection or stream
+	Reset OverflowMode = "reset"
+	// Discard stops forwarding the body at the limit, but reads the rest so the target connection can be reused
+	Discard OverflowMode = "discard"
+)
+
+func validateOverflowMode(mode OverflowMode) error {
+	if mode != Truncate && mode != Buffer && mode != Reset && mode != Discard {
+		return fmt.Errorf("Invalid response overflow mode %s; must be one of 'truncate', 'buffer', 'reset' or 'discard'", mode)
+	}
+	return nil
+}
+
+// DeliveryReceiptsConfig enables a receipt for every proxied request, recording what the target returned.
+// Receipts are posted to CallbackURL, signed with SigningKey or that of their tenant, and/or appended to File as JSON lines.
+type DeliveryReceiptsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxBodyBytes is how much of the response body is captured
+	MaxBodyBytes int           `yaml:"maxBodyBytes"`
+	CallbackURL  string        `yaml:"callbackUrl"`
+	SigningKey   string        `yaml:"signingKey"`
+	Timeout      time.Duration `yaml:"timeout"`
+	File         string        `yaml:"file"`
+	// QueueSize is how many receipts can wait to be sent before new ones are dropped
+	QueueSize int `yaml:"queueSize"`
+}
+
+// TracingConfig enables OpenTelemetry spans for requests through the HTTP listeners, exported in batches
+// over OTLP/HTTP to Endpoint, or written as JSON lines to stdout or File
+type TracingConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Exporter TraceExporter `yaml:"exporter"`
+	Endpoint string        `yaml:"endpoint"`
+	// Headers are added to export requests, typically for the collector's authentication
+	Headers     map[string]string `yaml:"headers"`
+	File        string            `yaml:"file"`
+	ServiceName string            `yaml:"serviceName"`
+	// SampleRatio is the fraction of new traces that are sampled; traces continued from a caller follow the
+	// caller's sampling decision
+	SampleRatio   float64          `yaml:"sampleRatio"`
+	Propagation   TracePropagation `yaml:"propagation"`
+	Timeout       time.Duration    `yaml:"timeout"`
+	BatchSize     int              `yaml:"batchSize"`
+	FlushInterval time.Duration    `yaml:"flushInterval"`
+	// QueueSize is how many spans can wait to be exported before new ones are dropped
+	QueueSize int `yaml:"queueSize"`
+}
+
+// TraceExporter is where spans are sent
+type TraceExporter string
+
+const (
+	OTLPExporter   TraceExporter = "otlp"
+	StdoutExporter TraceExporter = "stdout"
+	FileExporter   TraceExporter = "file"
+)
+
+// TracePropagation is what happens to the trace context headers of a request on its way to the target
+type TracePropagation string
+
+const (
+	// ForwardTraceContext sends the target a traceparent header naming the proxy's span as the parent
+	ForwardTraceContext TracePropagation = "forward"
+	// StripTraceContext removes the traceparent and tracestate headers
+	StripTraceContext TracePropagation = "strip"
+)
+
+// AuditLogConfig enables the hash-chained audit log, which records the same requests as the access log. Each
+// record is also signed with an HMAC key, if there is one: HMACKey, the contents of HMACKeyFile, or the
+// WHSENTRY_AUDIT_HMAC_KEY environment variable, in that order.
+type AuditLogConfig struct {
+	File        string `yaml:"file"`
+	HMACKey     string `yaml:"hmacKey"`
+	HMACKeyFile string `yaml:"hmacKeyFile"`
+}
+
+// MetricsConfig customizes the Prometheus metrics. Namespace is prefixed to every metric name, and the
+// buckets of the histograms default to the built-in ones if empty.
+type MetricsConfig struct {
+	Namespace       string                   `yaml:"namespace"`
+	ResponseBuckets []float64                `yaml:"responseBuckets"`
+	PhaseBuckets    []float64                `yaml:"phaseBuckets"`
+	DNSBuckets      []float64                `yaml:"dnsBuckets"`
+	Destinations    DestinationMetricsConfig `yaml:"destinations"`
+}
+
+// DestinationMetricsConfig enables a destination label with the target host on the request metrics. At most
+// MaxHosts hosts get their own label, to keep the number of series bounded: the busiest ones, ranked every
+// RankInterval.
+type DestinationMetricsConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	MaxHosts     int           `yaml:"maxHosts"`
+	RankInterval time.Duration `yaml:"rankInterval"`
 }
 
 type LogType string
@@ -95,9 +391,18 @@ const (
 	Text LogType = "text"
 )
 
+// LogConfig is where a log goes and in what format. Template, a text/template, sets the format of text access
+// log lines. A log file is appended to, unless Truncate is set. It's rotated once it's bigger than MaxSize
+// bytes or older than MaxAge, keeping MaxBackups old files, gzipped if Compress is set.
 type LogConfig struct {
-	File string
-	Type LogType
+	File       string
+	Type       LogType
+	Template   string        `yaml:"template"`
+	Truncate   bool          `yaml:"truncate"`
+	MaxSize    int64         `yaml:"maxSize"`
+	MaxAge     time.Duration `yaml:"maxAge"`
+	MaxBackups int           `yaml:"maxBackups"`
+	Compress   bool          `yaml:"compress"`
 }
 
 func (cidr *Cidr) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -113,29 +418,371 @@ func (cidr *Cidr) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+func ParseHostPattern(pattern string) (HostPattern, error) {
+	if pattern == "" {
+		return HostPattern{}, errors.New("Host pattern must not be empty")
+	}
+	if strings.HasPrefix(pattern, "~") {
+		regex, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return HostPattern{}, fmt.Errorf("Invalid host pattern %s: %s", pattern, err)
+		}
+		return HostPattern{pattern: pattern, regex: regex}, nil
+	}
+	return HostPattern{pattern: strings.ToLower(pattern)}, nil
+}
+
+func (h *HostPattern) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var patternStr string
+	if err := unmarshal(&patternStr); err != nil {
+		return err
+	}
+	pattern, err := ParseHostPattern(patternStr)
+	if err != nil {
+		return err
+	}
+	*h = pattern
+	return nil
+}
+
+func (h HostPattern) String() string {
+	return h.pattern
+}
+
 func (config *ProxyConfig) validate() error {
 	if err := validateListeners(config.Listeners); err != nil {
 		return err
 	}
+	if err := validatePortExceptions(config.PortExceptions); err != nil {
+		return err
+	}
+	if err := validateDNS(config.DNS); err != nil {
+		return err
+	}
+	if err := validateOverflowMode(config.ResponseOverflowMode); err != nil {
+		return err
+	}
+	if err := validateDeliveryReceipts(config.DeliveryReceipts); err != nil {
+		return err
+	}
+	if err := validateTracing(config.Tracing); err != nil {
+		return err
+	}
+	if config.AuditLog.HMACKey != "" && config.AuditLog.HMACKeyFile != "" {
+		return errors.New("The audit log can have an hmacKey or an hmacKeyFile, not both")
+	}
+	if err := validateMetrics(config.Metrics); err != nil {
+		return err
+	}
+	if err := validateLogConfig("access", config.AccessLog); err != nil {
+		return err
+	}
+	if err := validateLogConfig("proxy", config.ProxyLog); err != nil {
+		return err
+	}
+	if err := validateUpstreamProxies(config.UpstreamProxies); err != nil {
+		return err
+	}
+	if err := validateEgressPools(config.EgressPools, config.DefaultEgressPool); err != nil {
+		return err
+	}
+	if config.RequestIDHeader != "" && !httpguts.ValidHeaderFieldName(config.RequestIDHeader) {
+		return fmt.Errorf("Invalid request ID header name %s", config.RequestIDHeader)
+	}
+	if err := config.validateTenants(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validateUpstreamProxies(upstreams []UpstreamProxyConfig) error {
+	for _, upstream := range upstreams {
+		u, err := parseUpstreamProxyURL(upstream.URL)
+		if err != nil {
+			return err
+		}
+		if upstream.CAFile == "" {
+			continue
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("Invalid upstream proxy %s: caFile is only used with an https URL", u.Host)
+		}
+		if _, err := loadCAFile(upstream.CAFile); err != nil {
+			return fmt.Errorf("Invalid upstream proxy %s: %s", u.Host, err)
+		}
+	}
+	return nil
+}
+
+func (config *ProxyConfig) validateTenants() error {
+	pools := make(map[string]bool)
+	for _, pool := range config.EgressPools {
+		pools[pool.Name] = true
+	}
+	names := make(map[string]bool)
+	identities := make(map[string]string)
+	for _, tenant := range config.Tenants {
+		if tenant.Name == "" {
+			return errors.New("Tenant must have a name")
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("Duplicate tenant %s", tenant.Name)
+		}
+		names[tenant.Name] = true
+		for _, identity := range tenant.Identities {
+			if other, ok := identities[identity]; ok {
+				return fmt.Errorf("Identity %s belongs to both tenant %s and tenant %s", identity, other, tenant.Name)
+			}
+			identities[identity] = tenant.Name
+		}
+		if tenant.ResponseOverflowMode != "" {
+			if err := validateOverflowMode(tenant.ResponseOverflowMode); err != nil {
+				return err
+			}
+		}
+		if tenant.EgressPool != "" && !pools[tenant.EgressPool] {
+			return fmt.Errorf("Egress pool %s of tenant %s is not defined", tenant.EgressPool, tenant.Name)
+		}
+	}
+	for _, l := range config.Listeners {
+		if l.Tenant != "" && !names[l.Tenant] {
+			return fmt.Errorf("Tenant %s of listener %s is not defined", l.Tenant, l.Address)
+		}
+		for _, name := range l.AllowedTenants {
+			if !names[name] {
+				return fmt.Errorf("Allowed tenant %s of listener %s is not defined", name, l.Address)
+			}
+		}
+	}
+	return nil
+}
+
+func validateDeliveryReceipts(receipts DeliveryReceiptsConfig) error {
+	if !receipts.Enabled {
+		return nil
+	}
+	if receipts.CallbackURL == "" && receipts.File == "" {
+		return errors.New("Delivery receipts need a callback URL or a file")
+	}
+	if receipts.CallbackURL != "" {
+		u, err := url.Parse(receipts.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid delivery receipt callback URL %s", receipts.CallbackURL)
+		}
+		if receipts.SigningKey == "" {
+			return errors.New("Delivery receipts posted to a callback URL need a signing key")
+		}
+	}
+	if receipts.MaxBodyBytes < 0 || receipts.QueueSize <= 0 {
+		return errors.New("Delivery receipt maxBodyBytes must not be negative, and queueSize must be positive")
+	}
+	return nil
+}
+
+func validateTracing(tracing TracingConfig) error {
+	if !tracing.Enabled {
+		return nil
+	}
+	switch tracing.Exporter {
+	case OTLPExporter:
+		u, err := url.Parse(tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid tracing endpoint %s", tracing.Endpoint)
+		}
+	case FileExporter:
+		if tracing.File == "" {
+			return errors.New("The file trace exporter needs a file")
+		}
+	case StdoutExporter:
+	default:
+		return fmt.Errorf("Invalid trace exporter %s; must be one of 'otlp', 'stdout' or 'file'", tracing.Exporter)
+	}
+	if tracing.Propagation != ForwardTraceContext && tracing.Propagation != StripTraceContext {
+		return fmt.Errorf("Invalid trace propagation %s; must be 'forward' or 'strip'", tracing.Propagation)
+	}
+	if tracing.SampleRatio < 0 || tracing.SampleRatio > 1 {
+		return errors.New("Tracing sampleRatio must be between 0 and 1")
+	}
+	if tracing.BatchSize <= 0 || tracing.QueueSize <= 0 || tracing.FlushInterval <= 0 {
+		return errors.New("Tracing batchSize, queueSize and flushInterval must be positive")
+	}
+	return nil
+}
+
+func validateMetrics(metrics MetricsConfig) error {
+	if metrics.Namespace != "" && !metricNamespacePattern.MatchString(metrics.Namespace) {
+		return fmt.Errorf("Invalid metrics namespace %s", metrics.Namespace)
+	}
+	for _, buckets := range [][]float64{metrics.ResponseBuckets, metrics.PhaseBuckets, metrics.DNSBuckets} {
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return fmt.Errorf("Histogram buckets %v must be in increasing order", buckets)
+			}
+		}
+	}
+	if metrics.Destinations.Enabled && metrics.Destinations.MaxHosts <= 0 {
+		return errors.New("Destination metrics need a positive maxHosts")
+	}
+	if metrics.Destinations.Enabled && metrics.Destinations.RankInterval <= 0 {
+		return errors.New("Destination metrics need a positive rankInterval")
+	}
+	return nil
+}
+
+var metricNamespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validateLogConfig(name string, logConfig LogConfig) error {
+	if logConfig.MaxSize < 0 || logConfig.MaxAge < 0 || logConfig.MaxBackups < 0 {
+		return fmt.Errorf("Rotation settings of the %s log must not be negative", name)
+	}
+	if logConfig.File == "" && (logConfig.MaxSize > 0 || logConfig.MaxAge > 0) {
+		return fmt.Errorf("The %s log can only be rotated when it goes to a file", name)
+	}
+	if logConfig.Template != "" {
+		if name != "access" {
+			return fmt.Errorf("Only the access log has a template, not the %s log", name)
+		}
+		if _, err := parseAccessLogTemplate(logConfig.Template); err != nil {
+			return fmt.Errorf("Invalid access log template: %s", err)
+		}
+	}
+	return nil
+}
+
+func validateEgressPools(pools []EgressPoolConfig, defaultPool string) error {
+	names := make(map[string]bool)
+	for _, pool := range pools {
+		if pool.Name == "" {
+			return errors.New("Egress pool must have a name")
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("Duplicate egress pool %s", pool.Name)
+		}
+		names[pool.Name] = true
+		if len(pool.Addresses) == 0 {
+			return fmt.Errorf("Egress pool %s must have at least one address", pool.Name)
+		}
+		for _, address := range pool.Addresses {
+			if ip := net.ParseIP(address); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("Invalid IPv4 address %s in egress pool %s", address, pool.Name)
+			}
+		}
+	}
+	if defaultPool != "" && !names[defaultPool] {
+		return fmt.Errorf("Default egress pool %s is not defined", defaultPool)
+	}
+	return nil
+}
+
+func validateDNS(dns DNSConfig) error {
+	for _, server := range dns.Servers {
+		if _, err := newDNSTransport(server, dns.Timeout, nil); err != nil {
+			return err
+		}
+	}
+	if dns.Cache.MaxTTL > 0 && dns.Cache.MinTTL > dns.Cache.MaxTTL {
+		return fmt.Errorf("DNS cache minTTL %s must not be greater than maxTTL %s", dns.Cache.MinTTL, dns.Cache.MaxTTL)
+	}
+	for host, ip := range dns.Hosts {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("Invalid IP address %s for DNS host %s", ip, host)
+		}
+	}
+	return nil
+}
+
+func validatePortExceptions(exceptions []PortException) error {
+	for _, e := range exceptions {
+		if e.Host.String() == "" {
+			return errors.New("Port exception must specify a host")
+		}
+		if len(e.Ports) == 0 {
+			return fmt.Errorf("Port exception for host %s must specify at least one port", e.Host)
+		}
+	}
 	return nil
 }
 
 func validateListeners(listeners []ListenerConfig) error {
 	for _, l := range listeners {
-		if l.Type != HTTP && l.Type != HTTPS {
-			return fmt.Errorf("Invalid listener type %s; must be one of 'http' or 'https'", l.Type)
+		if l.Type != HTTP && l.Type != HTTPS && l.Type != SOCKS5 {
+			return fmt.Errorf("Invalid listener type %s; must be one of 'http', 'https' or 'socks5'", l.Type)
 		}
 		if err := validateAddress(l.Address); err != nil {
 			return err
 		}
+		if err := validateSocketOptions(l); err != nil {
+			return err
+		}
+		if l.ProxyProtocol.Enabled && len(l.ProxyProtocol.TrustedCidrs) == 0 && !isUnixAddress(l.Address) {
+			return fmt.Errorf("PROXY protocol on listener %s needs at least one trusted CIDR", l.Address)
+		}
 		if l.Type == HTTPS && (l.CertFile == "" || l.KeyFile == "") {
 			return fmt.Errorf("Both certificate file and private key file must be specified for listener %s", l.Address)
 		}
+		if l.Type == HTTP && l.HTTP2 {
+			return fmt.Errorf("http2 is only supported on https listeners; use h2c for listener %s", l.Address)
+		}
+		if l.Type == HTTPS && l.H2C {
+			return fmt.Errorf("h2c is only supported on http listeners; use http2 for listener %s", l.Address)
+		}
+		if l.Type == SOCKS5 {
+			if err := validateSocks5(l); err != nil {
+				return err
+			}
+		}
+		if l.Type == SOCKS5 && len(l.Users) > 0 {
+			return fmt.Errorf("users are set in the socks5 section of socks5 listener %s", l.Address)
+		}
+		for username := range l.Users {
+			if username == "" || strings.Contains(username, ":") {
+				return fmt.Errorf("Invalid user %q for listener %s; usernames must not be empty or contain ':'", username, l.Address)
+			}
+		}
+	}
+	return nil
+}
+
+func validateSocks5(l ListenerConfig) error {
+	if l.HTTP2 || l.H2C {
+		return fmt.Errorf("http2 and h2c are not supported on socks5 listener %s", l.Address)
+	}
+	// RFC 1929 encodes the username and password lengths in a single byte
+	for username, password := range l.Socks5.Users {
+		if username == "" || len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("Invalid user %q for socks5 listener %s; usernames must be 1-255 bytes and passwords at most 255 bytes", username, l.Address)
+		}
+	}
+	return nil
+}
+
+func validateSocketOptions(l ListenerConfig) error {
+	if !isUnixAddress(l.Address) {
+		if l.SocketMode != "" || l.SocketOwner != "" {
+			return fmt.Errorf("socketMode and socketOwner are only supported on Unix socket listeners, not %s", l.Address)
+		}
+		return nil
+	}
+	if l.SocketMode != "" {
+		if _, err := parseSocketMode(l.SocketMode); err != nil {
+			return fmt.Errorf("Invalid socketMode %s for listener %s; it should be an octal file mode like 0660", l.SocketMode, l.Address)
+		}
+	}
+	if l.SocketOwner != "" {
+		if _, _, err := lookupSocketOwner(l.SocketOwner); err != nil {
+			return fmt.Errorf("Invalid socketOwner for listener %s: %s", l.Address, err)
+		}
 	}
 	return nil
 }
 
 func validateAddress(address string) error {
+	if isUnixAddress(address) {
+		if !filepath.IsAbs(unixSocketPath(address)) {
+			return fmt.Errorf("Invalid listener address %s; Unix sockets should be in the format unix:/absolute/path", address)
+		}
+		return nil
+	}
 	host, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return fmt.Errorf("Invalid listener address %s; %s", address, err)
@@ -161,6 +808,15 @@ func (p *ProxyConfig) loadClientCert() error {
 	if cert != nil {
 		p.ClientCerts["default"] = *cert
 	}
+	for _, tenant := range p.Tenants {
+		cert, err := loadCert(tenant.ClientCertFile, tenant.ClientKeyFile, "client")
+		if err != nil {
+			return fmt.Errorf("Tenant %s: %s", tenant.Name, err)
+		}
+		if cert != nil {
+			p.ClientCerts[tenantCertAlias(tenant.Name)] = *cert
+		}
+	}
 	return nil
 }
 
@@ -253,6 +909,19 @@ func loadRootCABundleFromFile(cacerts string) (*x509.CertPool, error) {
 	return rootCerts, nil
 }
 
+// loadCAFile loads a PEM file of CA certificates into a pool of its own
+func loadCAFile(caFile string) (*x509.CertPool, error) {
+	pemBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("No PEM certificates found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
 func UnmarshalConfigFromFile(configFile string) (*ProxyConfig, error) {
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -7,6 +7,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 func checkNoError(t *testing.T, e error) {
@@ -33,6 +35,18 @@ func assertNotNil(t *testing.T, a interface{}, name string) {
 	}
 }
 
+// unmarshalAndValidate is like UnmarshalConfig, but skips loading certificates and the CA bundle
+func unmarshalAndValidate(data []byte) (*ProxyConfig, error) {
+	config := NewDefaultConfig()
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
 func TestListenerValidation(t *testing.T) {
 
 	t.Run("Port only is valid", func(t *testing.T) {
@@ -60,6 +74,54 @@ func TestListenerValidation(t *testing.T) {
 		err := validateListeners([]ListenerConfig{listener})
 		assertError(t, "Both certificate file and private key file", err)
 	})
+
+	t.Run("h2c is only for HTTP listeners", func(t *testing.T) {
+		listener := ListenerConfig{
+			Type:     HTTPS,
+			Address:  ":9091",
+			CertFile: "/etc/pki/cert",
+			KeyFile:  "/etc/pki/key",
+			H2C:      true,
+		}
+		err := validateListeners([]ListenerConfig{listener})
+		assertError(t, "h2c is only supported on http listeners", err)
+	})
+
+	t.Run("http2 is only for HTTPS listeners", func(t *testing.T) {
+		listener := ListenerConfig{
+			Type:    HTTP,
+			Address: ":9090",
+			HTTP2:   true,
+		}
+		err := validateListeners([]ListenerConfig{listener})
+		assertError(t, "http2 is only supported on https listeners", err)
+	})
+
+	t.Run("SOCKS5 usernames must not be empty", func(t *testing.T) {
+		listener := ListenerConfig{
+			Type:    SOCKS5,
+			Address: ":1080",
+			Socks5:  Socks5Config{Users: map[string]string{"": "password"}},
+		}
+		err := validateListeners([]ListenerConfig{listener})
+		assertError(t, "usernames must be 1-255 bytes", err)
+	})
+
+	t.Run("HTTP usernames must not contain a colon", func(t *testing.T) {
+		listener := ListenerConfig{Type: HTTP, Address: ":9090", Users: map[string]string{"billing:svc": "password"}}
+		err := validateListeners([]ListenerConfig{listener})
+		assertError(t, "usernames must not be empty or contain ':'", err)
+	})
+
+	t.Run("PROXY protocol needs trusted CIDRs", func(t *testing.T) {
+		listener := ListenerConfig{
+			Type:          HTTP,
+			Address:       ":9090",
+			ProxyProtocol: ProxyProtocolConfig{Enabled: true},
+		}
+		err := validateListeners([]ListenerConfig{listener})
+		assertError(t, "needs at least one trusted CIDR", err)
+	})
 }
 
 func TestYaml(t *testing.T) {
@@ -73,6 +135,180 @@ func TestYaml(t *testing.T) {
 		assertEqual(t, time.Duration(10)*time.Second, config.ConnectTimeout)
 		assertEqual(t, false, config.InsecureSkipCertVerification)
 		assertEqual(t, false, config.InsecureSkipCidrDenyList)
+		assertEqual(t, 4, len(config.AllowedPorts))
+		assertEqual(t, Truncate, config.ResponseOverflowMode)
+	})
+
+	t.Run("Port exceptions", func(t *testing.T) {
+		var data = `
+allowedPorts: [443]
+portExceptions:
+  - host: "*.example.com"
+    ports: [8000, 9000]
+`
+		config, err := unmarshalAndValidate([]byte(data))
+		checkNoError(t, err)
+		assertEqual(t, 1, len(config.AllowedPorts))
+		assertEqual(t, 1, len(config.PortExceptions))
+		assertEqual(t, "*.example.com", config.PortExceptions[0].Host.String())
+		assertEqual(t, 2, len(config.PortExceptions[0].Ports))
+	})
+
+	t.Run("Host lists", func(t *testing.T) {
+		var data = `
+cidrAllowList: ["203.0.113.0/24"]
+hostDenyList: ["metadata.google.internal", "~^.*\\.internal$"]
+hostAllowList: [".customer.com"]
+`
+		config, err := unmarshalAndValidate([]byte(data))
+		checkNoError(t, err)
+		assertEqual(t, 1, len(config.CidrAllowList))
+		assertEqual(t, 2, len(config.HostDenyList))
+		assertEqual(t, true, config.HostDenyList[1].Matches("foo.internal"))
+		assertEqual(t, 1, len(config.HostAllowList))
+	})
+
+	t.Run("Port exception without ports is invalid", func(t *testing.T) {
+		var data = `
+portExceptions:
+  - host: "*.example.com"
+`
+		_, err := unmarshalAndValidate([]byte(data))
+		assertError(t, "must specify at least one port", err)
+	})
+
+	t.Run("Egress pools", func(t *testing.T) {
+		var data = `
+egressPools:
+  - name: customer-a
+    addresses: [203.0.113.10, 203.0.113.11]
+    hosts: [".customer-a.com"]
+  - name: shared
+    addresses: [203.0.113.20]
+defaultEgressPool: shared
+`
+		config, err := unmarshalAndValidate([]byte(data))
+		checkNoError(t, err)
+		assertEqual(t, 2, len(config.EgressPools))
+		assertEqual(t, 2, len(config.EgressPools[0].Addresses))
+		assertEqual(t, "shared", config.DefaultEgressPool)
+	})
+
+	t.Run("Egress pool addresses must be IPv4", func(t *testing.T) {
+		var data = `
+egressPools:
+  - name: customer-a
+    addresses: ["2001:db8::1"]
+`
+		_, err := unmarshalAndValidate([]byte(data))
+		assertError(t, "Invalid IPv4 address 2001:db8::1 in egress pool customer-a", err)
+	})
+
+	t.Run("Default egress pool must be defined", func(t *testing.T) {
+		_, err := unmarshalAndValidate([]byte("defaultEgressPool: missing\n"))
+		assertError(t, "Default egress pool missing is not defined", err)
+	})
+
+	t.Run("Tenants", func(t *testing.T) {
+		var data = `
+egressPools:
+  - name: billing
+    addresses: [203.0.113.10]
+tenants:
+  - name: billing
+    identities: [billing-svc]
+    connectTimeout: 5s
+    maxResponseBodySize: 65536
+    hostAllowList: [".stripe.com"]
+    egressPool: billing
+listeners:
+  - type: http
+    address: ":9090"
+    tenant: billing
+`
+		config, err := unmarshalAndValidate([]byte(data))
+		checkNoError(t, err)
+		assertEqual(t, 1, len(config.Tenants))
+		assertEqual(t, 5*time.Second, config.Tenants[0].ConnectTimeout)
+		assertEqual(t, "billing", config.Listeners[0].Tenant)
+	})
+
+	t.Run("Listener tenant must be defined", func(t *testing.T) {
+		var data = `
+listeners:
+  - type: http
+    address: ":9090"
+    tenant: missing
+`
+		_, err := unmarshalAndValidate([]byte(data))
+		assertError(t, "Tenant missing of listener :9090 is not defined", err)
+	})
+
+	t.Run("Listener allowed tenants must be defined", func(t *testing.T) {
+		var data = `
+listeners:
+  - type: http
+    address: ":9090"
+    allowedTenants: [missing]
+`
+		_, err := unmarshalAndValidate([]byte(data))
+		assertError(t, "Allowed tenant missing of listener :9090 is not defined", err)
+	})
+
+	t.Run("Identities belong to one tenant", func(t *testing.T) {
+		var data = `
+tenants:
+  - name: billing
+    identities: [shared-svc]
+  - name: crm
+    identities: [shared-svc]
+`
+		_, err := unmarshalAndValidate([]byte(data))
+		assertError(t, "Identity shared-svc belongs to both tenant billing and tenant crm", err)
+	})
+
+	t.Run("Response overflow mode", func(t *testing.T) {
+		config, err := unmarshalAndValidate([]byte("responseOverflowMode: buffer\n"))
+		checkNoError(t, err)
+		assertEqual(t, Buffer, config.ResponseOverflowMode)
+		_, err = unmarshalAndValidate([]byte("responseOverflowMode: drop\n"))
+		assertError(t, "Invalid response overflow mode drop", err)
+		_, err = unmarshalAndValidate([]byte("tenants:\n  - name: billing\n    responseOverflowMode: drop\n"))
+		assertError(t, "Invalid response overflow mode drop", err)
+	})
+
+	t.Run("Delivery receipts", func(t *testing.T) {
+		_, err := unmarshalAndValidate([]byte("deliveryReceipts:\n  enabled: true\n"))
+		assertError(t, "Delivery receipts need a callback URL or a file", err)
+		_, err = unmarshalAndValidate([]byte("deliveryReceipts:\n  enabled: true\n  callbackUrl: http://receipts.internal/\n"))
+		assertError(t, "need a signing key", err)
+		config, err := unmarshalAndValidate([]byte("deliveryReceipts:\n  enabled: true\n  file: /var/log/receipts.jsonl\n"))
+		checkNoError(t, err)
+		assertEqual(t, 1024, config.DeliveryReceipts.MaxBodyBytes)
+	})
+
+	t.Run("Request ID header", func(t *testing.T) {
+		config, err := unmarshalAndValidate([]byte("requestIdHeader: X-Correlation-Id\n"))
+		checkNoError(t, err)
+		assertEqual(t, "X-Correlation-Id", config.RequestIDHeader)
+		_, err = unmarshalAndValidate([]byte("requestIdHeader: \"X Correlation\"\n"))
+		assertError(t, "Invalid request ID header name X Correlation", err)
+	})
+
+	t.Run("Tracing", func(t *testing.T) {
+		config, err := unmarshalAndValidate([]byte("tracing:\n  enabled: true\n"))
+		checkNoError(t, err)
+		assertEqual(t, OTLPExporter, config.Tracing.Exporter)
+		assertEqual(t, ForwardTraceContext, config.Tracing.Propagation)
+		assertEqual(t, "webhook-sentry", config.Tracing.ServiceName)
+		_, err = unmarshalAndValidate([]byte("tracing:\n  enabled: true\n  exporter: file\n"))
+		assertError(t, "The file trace exporter needs a file", err)
+		_, err = unmarshalAndValidate([]byte("tracing:\n  enabled: true\n  exporter: jaeger\n"))
+		assertError(t, "Invalid trace exporter jaeger", err)
+		_, err = unmarshalAndValidate([]byte("tracing:\n  enabled: true\n  propagation: drop\n"))
+		assertError(t, "Invalid trace propagation drop", err)
+		_, err = unmarshalAndValidate([]byte("tracing:\n  enabled: true\n  sampleRatio: 2\n"))
+		assertError(t, "sampleRatio must be between 0 and 1", err)
 	})
 
 	t.Run("Override config", func(t *testing.T) {
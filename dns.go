@@ -0,0 +1,386 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ipResolver resolves a hostname to its IP addresses. *net.Resolver satisfies this interface.
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func newResolver(config DNSConfig, rootCAs *x509.CertPool) (ipResolver, error) {
+	var resolver ipResolver = net.DefaultResolver
+	if len(config.Servers) > 0 {
+		var transports []dnsTransport
+		for _, server := range config.Servers {
+			transport, err := newDNSTransport(server, config.Timeout, rootCAs)
+			if err != nil {
+				return nil, err
+			}
+			transports = append(transports, transport)
+		}
+		resolver = &dnsClient{transports: transports}
+	}
+	if config.Cache.Enabled {
+		resolver = newCachingResolver(resolver, config.Cache)
+	}
+	if len(config.Hosts) > 0 {
+		hosts := make(map[string][]net.IPAddr)
+		for host, ipStr := range config.Hosts {
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %s for host %s", ipStr, host)
+			}
+			name := strings.ToLower(strings.TrimSuffix(host, "."))
+			hosts[name] = append(hosts[name], net.IPAddr{IP: ip})
+		}
+		resolver = &hostsResolver{hosts: hosts, next: resolver}
+	}
+	return resolver, nil
+}
+
+// hostsResolver answers lookups from a static map of hosts, and falls back to the next resolver
+// for hosts not in the map
+type hostsResolver struct {
+	hosts map[string][]net.IPAddr
+	next  ipResolver
+}
+
+func (h *hostsResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := h.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		return ips, nil
+	}
+	return h.next.LookupIPAddr(ctx, host)
+}
+
+// dnsTransport sends a DNS query in wire format to an upstream server and returns the raw response
+type dnsTransport interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// newDNSTransport parses a server specification, which is either a bare address (UDP) or a URL with
+// one of the schemes udp, tcp, tls (DNS-over-TLS) or https (DNS-over-HTTPS).
+func newDNSTransport(server string, timeout time.Duration, rootCAs *x509.CertPool) (dnsTransport, error) {
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DNS server %s: %s", server, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid DNS server %s: missing host", server)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &streamOrPacketTransport{network: u.Scheme, address: withDefaultPort(u.Host, "53"), timeout: timeout}, nil
+	case "tls":
+		tlsConfig := &tls.Config{ServerName: u.Hostname(), RootCAs: rootCAs}
+		return &streamOrPacketTransport{network: "tcp", address: withDefaultPort(u.Host, "853"), timeout: timeout, tlsConfig: tlsConfig}, nil
+	case "https":
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+				ForceAttemptHTTP2: true,
+			},
+		}
+		return &httpsTransport{url: u.String(), client: client}, nil
+	}
+	return nil, fmt.Errorf("Invalid DNS server %s: scheme must be one of udp, tcp, tls or https", server)
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// streamOrPacketTransport speaks plain DNS over UDP, or over a TCP stream (optionally wrapped in TLS)
+// with each message prefixed by its two byte length
+type streamOrPacketTransport struct {
+	network   string
+	address   string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+func (t *streamOrPacketTransport) String() string {
+	if t.tlsConfig != nil {
+		return "tls://" + t.address
+	}
+	return t.network + "://" + t.address
+}
+
+func (t *streamOrPacketTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, t.network, t.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(t.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	// The deadline alone doesn't stop a read in progress if the lookup is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}(conn)
+	if t.tlsConfig != nil {
+		tlsConn := tls.Client(conn, t.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if t.network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		// Anyone can send us a datagram, so skip those that don't answer our query instead of failing the
+		// lookup on the first one; the deadline still bounds how long we wait
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if isReplyTo(query, buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, length)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// httpsTransport speaks DNS-over-HTTPS (RFC 8484) using POST requests
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpsTransport) String() string {
+	return t.url
+}
+
+func (t *httpsTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned status code %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// dnsClient resolves hostnames by querying the configured upstream servers directly, instead of
+// going through the system resolver. Servers are tried in order until one of them answers.
+type dnsClient struct {
+	transports []dnsTransport
+}
+
+func (c *dnsClient) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, _, err := c.lookupIPAddrTTL(ctx, host)
+	return ips, err
+}
+
+// lookupIPAddrTTL only asks for A records, since outbound connections are IPv4 only. The returned TTL
+// is how long the answer (or for a non-existent host, the negative answer) may be cached for; it is
+// zero if the server didn't say.
+func (c *dnsClient) lookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, 0, nil
+	}
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid hostname", Name: host, IsNotFound: true}
+	}
+	var lastErr error
+	for _, transport := range c.transports {
+		ips, ttl, err := c.query(ctx, transport, name)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, ttl, err
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+func dnsName(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+func matchesQuestion(questions []dnsmessage.Question, question dnsmessage.Question) bool {
+	if len(questions) != 1 {
+		return false
+	}
+	q := questions[0]
+	return q.Type == question.Type && q.Class == question.Class && strings.EqualFold(q.Name.String(), question.Name.String())
+}
+
+// isReplyTo reports whether reply is a response to query, with the same ID and question
+func isReplyTo(query []byte, reply []byte) bool {
+	var q, r dnsmessage.Message
+	if q.Unpack(query) != nil || r.Unpack(reply) != nil || len(q.Questions) != 1 {
+		return false
+	}
+	return r.ID == q.ID && r.Response && matchesQuestion(r.Questions, q.Questions[0])
+}
+
+func (c *dnsClient) query(ctx context.Context, transport dnsTransport, name dnsmessage.Name) ([]net.IPAddr, time.Duration, error) {
+	// The ID is all that stops an off-path attacker from spoofing a UDP reply, so it must be unpredictable
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	question := dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	host := strings.TrimSuffix(name.String(), ".")
+	respBytes, err := transport.exchange(ctx, packed)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: transport.String(), IsTemporary: true}
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(respBytes); err != nil {
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("malformed response: %s", err), Name: host, Server: transport.String()}
+	}
+	if resp.ID != id || !resp.Response || !matchesQuestion(resp.Questions, question) {
+		return nil, 0, &net.DNSError{Err: "response does not match query", Name: host, Server: transport.String()}
+	}
+	if resp.Truncated {
+		// Retry over TCP if the UDP response didn't fit
+		if udp, ok := transport.(*streamOrPacketTransport); ok && udp.network == "udp" {
+			tcp := &streamOrPacketTransport{network: "tcp", address: udp.address, timeout: udp.timeout}
+			return c.query(ctx, tcp, name)
+		}
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL(resp), &net.DNSError{Err: "no such host", Name: host, Server: transport.String(), IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("server returned %s", resp.RCode), Name: host, Server: transport.String(), IsTemporary: true}
+	}
+	var ips []net.IPAddr
+	var minTTL uint32
+	owners := answerOwners(resp.Answers, name)
+	for _, answer := range resp.Answers {
+		if a, ok := answer.Body.(*dnsmessage.AResource); ok && owners[strings.ToLower(answer.Header.Name.String())] {
+			ips = append(ips, net.IPAddr{IP: net.IP(append([]byte(nil), a.A[:]...))})
+			if len(ips) == 1 || answer.Header.TTL < minTTL {
+				minTTL = answer.Header.TTL
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, negativeTTL(resp), &net.DNSError{Err: "no such host", Name: host, Server: transport.String(), IsNotFound: true}
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+// answerOwners returns the names, in lower case, whose A records answer a query for name: name itself, and
+// the names the CNAME records in the answer lead to from it. Records for any other name are ignored, so that
+// a server can't slip in addresses for names we didn't ask about.
+func answerOwners(answers []dnsmessage.Resource, name dnsmessage.Name) map[string]bool {
+	owners := map[string]bool{strings.ToLower(name.String()): true}
+	// Each pass follows the chain at least one more step, so it ends after at most one pass per answer
+	for i := 0; i < len(answers); i++ {
+		added := false
+		for _, answer := range answers {
+			cname, ok := answer.Body.(*dnsmessage.CNAMEResource)
+			if !ok || !owners[strings.ToLower(answer.Header.Name.String())] {
+				continue
+			}
+			if target := strings.ToLower(cname.CNAME.String()); !owners[target] {
+				owners[target] = true
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	return owners
+}
+
+// negativeTTL returns how long a negative answer may be cached for, which is the smaller of the
+// SOA record's TTL and its MINIMUM field (RFC 2308)
+func negativeTTL(resp dnsmessage.Message) time.Duration {
+	for _, authority := range resp.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			ttl := authority.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 0
+}
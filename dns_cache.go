@@ -0,0 +1,140 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ttlResolver is implemented by resolvers that know how long their answers are valid for
+type ttlResolver interface {
+	lookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// cachingResolver caches answers from the next resolver for their TTL, clamped between minTTL and maxTTL.
+// Non-existent hosts are cached for negativeTTL. Note that cached IPs are still checked against the CIDR
+// deny list on every dial, so caching doesn't open the door to DNS rebinding.
+type cachingResolver struct {
+	next        ipResolver
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	mu          sync.Mutex
+	entries     map[string]dnsCacheEntry
+	now         func() time.Time
+}
+
+func newCachingResolver(next ipResolver, config DNSCacheConfig) *cachingResolver {
+	return &cachingResolver{
+		next:        next,
+		minTTL:      config.MinTTL,
+		maxTTL:      config.MaxTTL,
+		negativeTTL: config.NegativeTTL,
+		maxEntries:  config.MaxEntries,
+		entries:     make(map[string]dnsCacheEntry),
+		now:         time.Now,
+	}
+}
+
+func (c *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	if entry, ok := c.get(key); ok {
+		if entry.err != nil {
+			dnsCacheCounter.With(prometheus.Labels{"result": "negative_hit"}).Inc()
+		} else {
+			dnsCacheCounter.With(prometheus.Labels{"result": "hit"}).Inc()
+		}
+		return entry.ips, entry.err
+	}
+	dnsCacheCounter.With(prometheus.Labels{"result": "miss"}).Inc()
+
+	var ips []net.IPAddr
+	var ttl time.Duration
+	var err error
+	if r, ok := c.next.(ttlResolver); ok {
+		ips, ttl, err = r.lookupIPAddrTTL(ctx, host)
+	} else {
+		ips, err = c.next.LookupIPAddr(ctx, host)
+	}
+
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound && c.negativeTTL > 0 {
+			if ttl <= 0 || ttl > c.negativeTTL {
+				ttl = c.negativeTTL
+			}
+			c.put(key, dnsCacheEntry{err: err, expires: c.now().Add(ttl)})
+		}
+		return nil, err
+	}
+	c.put(key, dnsCacheEntry{ips: ips, expires: c.now().Add(c.clamp(ttl))})
+	return ips, nil
+}
+
+func (c *cachingResolver) clamp(ttl time.Duration) time.Duration {
+	if ttl < c.minTTL {
+		return c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		return c.maxTTL
+	}
+	return ttl
+}
+
+func (c *cachingResolver) get(key string) (dnsCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return entry, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return entry, false
+	}
+	return entry, true
+}
+
+func (c *cachingResolver) put(key string, entry dnsCacheEntry) {
+	if !entry.expires.After(c.now()) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = entry
+}
+
+// evict removes expired entries, or if there aren't any, an arbitrary entry to make room for a new one.
+// Must be called with the lock held.
+func (c *cachingResolver) evict() {
+	now := c.now()
+	evicted := false
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			evicted = true
+		}
+	}
+	if !evicted {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+}
@@ -0,0 +1,314 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	fakeDNSServerAddress  = "127.0.0.1:15353"
+	defaultTestDNSTimeout = 2 * time.Second
+)
+
+// fakeDNSServer is an in-process DNS server answering A queries from a fixed set of records
+type fakeDNSServer struct {
+	conn    net.PacketConn
+	records map[string]string
+	ttl     uint32
+	queries int32
+	// spoof makes the server send a reply with the wrong ID ahead of each real one
+	spoof int32
+}
+
+func newFakeDNSServer(records map[string]string) *fakeDNSServer {
+	return &fakeDNSServer{records: records, ttl: 60}
+}
+
+func startFakeDNSServer(t *testing.T, records map[string]string) *fakeDNSServer {
+	return startFakeDNSServerWithTTL(t, records, 60)
+}
+
+// startFakeDNSServerWithTTL sets the TTL of the records it answers with before it starts serving
+func startFakeDNSServerWithTTL(t *testing.T, records map[string]string, ttl uint32) *fakeDNSServer {
+	f := newFakeDNSServer(records)
+	f.ttl = ttl
+	conn, err := net.ListenPacket("udp4", fakeDNSServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to start fake DNS server: %s\n", err)
+	}
+	f.conn = conn
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := f.answer(buf[:n]); resp != nil {
+				if atomic.LoadInt32(&f.spoof) == 1 {
+					spoofed := append([]byte{resp[0] ^ 0xff, resp[1]}, resp[2:]...)
+					conn.WriteTo(spoofed, addr)
+				}
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return f
+}
+
+func (f *fakeDNSServer) answer(query []byte) []byte {
+	atomic.AddInt32(&f.queries, 1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	question := msg.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true},
+		Questions: msg.Questions,
+	}
+	ipStr, ok := f.records[strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")]
+	if !ok {
+		resp.RCode = dnsmessage.RCodeNameError
+	} else if question.Type == dnsmessage.TypeA {
+		for _, s := range strings.Split(ipStr, ",") {
+			var a [4]byte
+			copy(a[:], net.ParseIP(s).To4())
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: f.ttl},
+				Body:   &dnsmessage.AResource{A: a},
+			})
+		}
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+func (f *fakeDNSServer) queryCount() int {
+	return int(atomic.LoadInt32(&f.queries))
+}
+
+func (f *fakeDNSServer) Close() {
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func TestDNSClient(t *testing.T) {
+	dnsServer := startFakeDNSServer(t, map[string]string{"webhook.test": "203.0.113.10,203.0.113.11"})
+	defer dnsServer.Close()
+
+	resolver, err := newResolver(DNSConfig{Servers: []string{fakeDNSServerAddress}, Timeout: defaultTestDNSTimeout}, nil)
+	checkNoError(t, err)
+
+	t.Run("Resolves A records", func(t *testing.T) {
+		ips, err := resolver.LookupIPAddr(context.Background(), "webhook.test")
+		checkNoError(t, err)
+		assertEqual(t, 2, len(ips))
+		assertEqual(t, "203.0.113.10", ips[0].IP.String())
+		assertEqual(t, "203.0.113.11", ips[1].IP.String())
+	})
+
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		_, err := resolver.LookupIPAddr(context.Background(), "missing.test")
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok {
+			t.Fatalf("Expected a *net.DNSError, got %v", err)
+		}
+		assertEqual(t, true, dnsErr.IsNotFound)
+	})
+
+	t.Run("Falls back to the next server", func(t *testing.T) {
+		resolver, err := newResolver(DNSConfig{Servers: []string{"tcp://127.0.0.1:1", fakeDNSServerAddress}, Timeout: defaultTestDNSTimeout}, nil)
+		checkNoError(t, err)
+		ips, err := resolver.LookupIPAddr(context.Background(), "webhook.test")
+		checkNoError(t, err)
+		assertEqual(t, 2, len(ips))
+	})
+}
+
+func TestDNSClientIgnoresMismatchedReplies(t *testing.T) {
+	dnsServer := startFakeDNSServer(t, map[string]string{"webhook.test": "203.0.113.10"})
+	defer dnsServer.Close()
+	atomic.StoreInt32(&dnsServer.spoof, 1)
+
+	resolver, err := newResolver(DNSConfig{Servers: []string{fakeDNSServerAddress}, Timeout: defaultTestDNSTimeout}, nil)
+	checkNoError(t, err)
+	ips, err := resolver.LookupIPAddr(context.Background(), "webhook.test")
+	checkNoError(t, err)
+	assertEqual(t, 1, len(ips))
+	assertEqual(t, "203.0.113.10", ips[0].IP.String())
+}
+
+// replyingTransport answers every query with the given answer records
+type replyingTransport struct {
+	answers []dnsmessage.Resource
+}
+
+func (r *replyingTransport) String() string {
+	return "replying"
+}
+
+func (r *replyingTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true},
+		Questions: msg.Questions,
+		Answers:   r.answers,
+	}
+	return resp.Pack()
+}
+
+func TestDNSClientOnlyAcceptsAnswersForTheQueriedName(t *testing.T) {
+	record := func(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+		header := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: 60}
+		return dnsmessage.Resource{Header: header, Body: body}
+	}
+	transport := &replyingTransport{answers: []dnsmessage.Resource{
+		record("elsewhere.test.", &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+		record("cdn.test.", &dnsmessage.AResource{A: [4]byte{203, 0, 113, 10}}),
+		record("Webhook.test.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("CDN.test.")}),
+		record("other.test.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("webhook.test.")}),
+		record("other.test.", &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}}),
+	}}
+	client := &dnsClient{transports: []dnsTransport{transport}}
+
+	ips, err := client.LookupIPAddr(context.Background(), "webhook.test")
+	checkNoError(t, err)
+	assertEqual(t, 1, len(ips))
+	assertEqual(t, "203.0.113.10", ips[0].IP.String())
+
+	transport.answers = transport.answers[:1]
+	_, err = client.LookupIPAddr(context.Background(), "webhook.test")
+	assertError(t, "no such host", err)
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	dnsServer := newFakeDNSServer(map[string]string{"webhook.test": "203.0.113.10"})
+	dohServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsServer.answer(query))
+	}))
+	defer dohServer.Close()
+
+	rootCAs := dohServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	resolver, err := newResolver(DNSConfig{Servers: []string{dohServer.URL + "/dns-query"}, Timeout: defaultTestDNSTimeout}, rootCAs)
+	checkNoError(t, err)
+	ips, err := resolver.LookupIPAddr(context.Background(), "webhook.test")
+	checkNoError(t, err)
+	assertEqual(t, 1, len(ips))
+	assertEqual(t, "203.0.113.10", ips[0].IP.String())
+}
+
+func TestStaticHosts(t *testing.T) {
+	resolver, err := newResolver(DNSConfig{Hosts: map[string]string{"Webhook.Test": "203.0.113.10"}}, nil)
+	checkNoError(t, err)
+	ips, err := resolver.LookupIPAddr(context.Background(), "webhook.test.")
+	checkNoError(t, err)
+	assertEqual(t, "203.0.113.10", ips[0].IP.String())
+}
+
+func TestInvalidDNSServer(t *testing.T) {
+	_, err := newDNSTransport("ftp://1.1.1.1", defaultTestDNSTimeout, nil)
+	assertError(t, "scheme must be one of", err)
+}
+
+func TestCachingResolver(t *testing.T) {
+	dnsServer := startFakeDNSServerWithTTL(t, map[string]string{"webhook.test": "203.0.113.10"}, 60)
+	defer dnsServer.Close()
+
+	transport, err := newDNSTransport(fakeDNSServerAddress, defaultTestDNSTimeout, nil)
+	checkNoError(t, err)
+	now := time.Now()
+	cache := newCachingResolver(&dnsClient{transports: []dnsTransport{transport}}, DNSCacheConfig{
+		Enabled:     true,
+		MinTTL:      5 * time.Second,
+		MaxTTL:      30 * time.Second,
+		NegativeTTL: 10 * time.Second,
+		MaxEntries:  100,
+	})
+	cache.now = func() time.Time { return now }
+
+	t.Run("Caches answers up to the max TTL", func(t *testing.T) {
+		before := dnsServer.queryCount()
+		_, err := cache.LookupIPAddr(context.Background(), "webhook.test")
+		checkNoError(t, err)
+		ips, err := cache.LookupIPAddr(context.Background(), "WEBHOOK.test.")
+		checkNoError(t, err)
+		assertEqual(t, "203.0.113.10", ips[0].IP.String())
+		assertEqual(t, before+1, dnsServer.queryCount())
+
+		// The record TTL is 60s, but it's clamped to 30s
+		now = now.Add(31 * time.Second)
+		_, err = cache.LookupIPAddr(context.Background(), "webhook.test")
+		checkNoError(t, err)
+		assertEqual(t, before+2, dnsServer.queryCount())
+	})
+
+	t.Run("Caches non-existent hosts", func(t *testing.T) {
+		before := dnsServer.queryCount()
+		_, err := cache.LookupIPAddr(context.Background(), "missing.test")
+		assertError(t, "no such host", err)
+		_, err = cache.LookupIPAddr(context.Background(), "missing.test")
+		assertError(t, "no such host", err)
+		assertEqual(t, before+1, dnsServer.queryCount())
+
+		now = now.Add(11 * time.Second)
+		_, err = cache.LookupIPAddr(context.Background(), "missing.test")
+		assertError(t, "no such host", err)
+		assertEqual(t, before+2, dnsServer.queryCount())
+	})
+
+	t.Run("Evicts entries when full", func(t *testing.T) {
+		cache.maxEntries = 1
+		now = now.Add(time.Minute)
+		_, err := cache.LookupIPAddr(context.Background(), "webhook.test")
+		checkNoError(t, err)
+		_, err = cache.LookupIPAddr(context.Background(), "missing.test")
+		assertError(t, "no such host", err)
+		assertEqual(t, 1, len(cache.entries))
+	})
+}
+
+func TestDNSQueryCancelled(t *testing.T) {
+	// A server that never answers
+	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	checkNoError(t, err)
+	defer blackhole.Close()
+
+	resolver, err := newResolver(DNSConfig{Servers: []string{blackhole.LocalAddr().String()}, Timeout: 10 * time.Second}, nil)
+	checkNoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = resolver.LookupIPAddr(ctx, "webhook.test")
+	if err == nil {
+		t.Fatal("Expected the cancelled lookup to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the lookup to give up once cancelled, but it took %s", elapsed)
+	}
+}
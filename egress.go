@@ -0,0 +1,122 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// EgressPoolHeader selects an egress pool by name for a request, overriding the pool picked by destination
+const EgressPoolHeader = "X-WhSentry-EgressPool"
+
+const egressPoolKey key = 1
+
+// egressPool is a set of local addresses that outbound connections are bound to, used round-robin
+type egressPool struct {
+	name  string
+	addrs []*net.TCPAddr
+	hosts []HostPattern
+	next  uint32
+}
+
+func (p *egressPool) nextAddr() *net.TCPAddr {
+	n := atomic.AddUint32(&p.next, 1)
+	return p.addrs[(n-1)%uint32(len(p.addrs))]
+}
+
+type egressPools struct {
+	pools       []*egressPool
+	byName      map[string]*egressPool
+	defaultPool *egressPool
+}
+
+// newEgressPools sets up the configured pools. It fails if an address isn't assigned to this host, so a
+// typo shows up at startup rather than as failed requests.
+func newEgressPools(configs []EgressPoolConfig, defaultPool string) (*egressPools, error) {
+	e := &egressPools{byName: make(map[string]*egressPool)}
+	for _, config := range configs {
+		pool := &egressPool{name: config.Name, hosts: config.Hosts}
+		for _, address := range config.Addresses {
+			listener, err := net.Listen("tcp4", net.JoinHostPort(address, "0"))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot use address %s in egress pool %s: %s", address, config.Name, err)
+			}
+			listener.Close()
+			pool.addrs = append(pool.addrs, &net.TCPAddr{IP: net.ParseIP(address)})
+		}
+		e.pools = append(e.pools, pool)
+		e.byName[pool.name] = pool
+	}
+	if defaultPool != "" {
+		e.defaultPool = e.byName[defaultPool]
+	}
+	return e, nil
+}
+
+// poolFor returns the egress pool for a connection to host: the tenant's pool if it has one, otherwise the pool
+// named in the context if there is one, otherwise the first pool whose hosts match, otherwise the default pool. A
+// tenant's pool can't be overridden by the request. It returns nil if connections aren't bound to any particular
+// address.
+func (e *egressPools) poolFor(ctx context.Context, host string) (*egressPool, error) {
+	name, ok := "", false
+	if t, hasTenant := ctx.Value(tenantKey).(*tenant); hasTenant && t.egressPool != "" {
+		name, ok = t.egressPool, true
+	} else {
+		name, ok = ctx.Value(egressPoolKey).(string)
+	}
+	if ok {
+		pool, found := e.byName[name]
+		if !found {
+			return nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Egress pool %s not found", name), errorCode: EgressPoolNotFound}
+		}
+		return pool, nil
+	}
+	for _, pool := range e.pools {
+		if _, ok := matchAny(pool.hosts, host); ok {
+			return pool, nil
+		}
+	}
+	return e.defaultPool, nil
+}
+
+func (e *egressPools) has(name string) bool {
+	_, ok := e.byName[name]
+	return ok
+}
+
+// withEgressPool records the egress pool a request selected with the EgressPoolHeader, if any
+func withEgressPool(ctx context.Context, h http.Header) context.Context {
+	if name := h.Get(EgressPoolHeader); name != "" {
+		return context.WithValue(ctx, egressPoolKey, name)
+	}
+	return ctx
+}
+
+// dialerFor returns the dialer for a connection to host, with the tenant's connect timeout and bound to the
+// next address of its egress pool
+func (s *safeDialer) dialerFor(ctx context.Context, host string) (*net.Dialer, error) {
+	pool, err := s.egressPools.poolFor(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := *s.dialer
+	dialer.Timeout = s.tenantFor(ctx).connectTimeout
+	if pool != nil {
+		dialer.LocalAddr = pool.nextAddr()
+	}
+	return &dialer, nil
+}
+
+// outboundSourceIP returns the local IP of an outbound connection, which is the IP the target sees unless it goes
+// through an upstream proxy
+func outboundSourceIP(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
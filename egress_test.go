@@ -0,0 +1,158 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEgressPoolSelection(t *testing.T) {
+	configs := []EgressPoolConfig{
+		{Name: "customer-a", Addresses: []string{"127.0.0.2", "127.0.0.3"}, Hosts: []HostPattern{mustParseHostPattern(t, ".customer-a.com")}},
+		{Name: "shared", Addresses: []string{"127.0.0.4"}},
+	}
+	pools, err := newEgressPools(configs, "shared")
+	checkNoError(t, err)
+
+	t.Run("Round-robin within a pool", func(t *testing.T) {
+		pool := pools.byName["customer-a"]
+		first, second, third := pool.nextAddr(), pool.nextAddr(), pool.nextAddr()
+		if first.IP.Equal(second.IP) {
+			t.Errorf("Expected consecutive connections to use different addresses, both used %s", first.IP)
+		}
+		assertEqual(t, first.IP.String(), third.IP.String())
+	})
+
+	t.Run("By destination", func(t *testing.T) {
+		pool, err := pools.poolFor(context.Background(), "hooks.customer-a.com")
+		checkNoError(t, err)
+		assertEqual(t, "customer-a", pool.name)
+	})
+
+	t.Run("Default pool", func(t *testing.T) {
+		pool, err := pools.poolFor(context.Background(), "example.com")
+		checkNoError(t, err)
+		assertEqual(t, "shared", pool.name)
+	})
+
+	t.Run("By name overrides destination", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), egressPoolKey, "shared")
+		pool, err := pools.poolFor(ctx, "hooks.customer-a.com")
+		checkNoError(t, err)
+		assertEqual(t, "shared", pool.name)
+	})
+
+	t.Run("Name can't override the tenant's pool", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), tenantKey, &tenant{name: "customer-a", egressPool: "customer-a"})
+		ctx = context.WithValue(ctx, egressPoolKey, "shared")
+		pool, err := pools.poolFor(ctx, "example.com")
+		checkNoError(t, err)
+		assertEqual(t, "customer-a", pool.name)
+	})
+
+	t.Run("Unknown name", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), egressPoolKey, "missing")
+		_, err := pools.poolFor(ctx, "example.com")
+		assertError(t, "Egress pool missing not found", err)
+	})
+
+	t.Run("No pools", func(t *testing.T) {
+		empty, err := newEgressPools(nil, "")
+		checkNoError(t, err)
+		pool, err := empty.poolFor(context.Background(), "example.com")
+		checkNoError(t, err)
+		if pool != nil {
+			t.Errorf("Expected no egress pool, got %s", pool.name)
+		}
+	})
+
+	t.Run("Address not on this host", func(t *testing.T) {
+		_, err := newEgressPools([]EgressPoolConfig{{Name: "remote", Addresses: []string{"192.0.2.1"}}}, "")
+		assertError(t, "Cannot use address 192.0.2.1 in egress pool remote", err)
+	})
+}
+
+// startSourceIPTargetServer responds with the IP the request came from
+func startSourceIPTargetServer(t *testing.T) *http.Server {
+	server := &http.Server{
+		Addr: "127.0.0.1:12082",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			fmt.Fprint(w, host)
+		}),
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			t.Errorf("Failed to start target HTTP server: %s\n", err)
+		}
+	}()
+	return server
+}
+
+func TestEgressPools(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.EgressPools = []EgressPoolConfig{
+				{Name: "customer-a", Addresses: []string{"127.0.0.2", "127.0.0.3"}},
+				{Name: "shared", Addresses: []string{"127.0.0.4"}},
+			}
+			config.DefaultEgressPool = "shared"
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startSourceIPTargetServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+	accessLogBuffer := new(bytes.Buffer)
+	accessLog.Out = accessLogBuffer
+	defer func() { accessLog.Out = os.Stdout }()
+
+	sourceIPFor := func(egressPool string) string {
+		req, _ := http.NewRequest("GET", "http://localhost:12082/", nil)
+		if egressPool != "" {
+			req.Header.Set(EgressPoolHeader, egressPool)
+		}
+		resp, err := client.Do(req)
+		checkNoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s\n", resp.StatusCode, body)
+		}
+		return string(body)
+	}
+
+	t.Run("Default pool", func(t *testing.T) {
+		assertEqual(t, "127.0.0.4", sourceIPFor(""))
+		if !strings.Contains(accessLogBuffer.String(), " HTTP/1.1 127.0.0.4") {
+			t.Errorf("Expected source IP in access log, got %s", accessLogBuffer.String())
+		}
+	})
+
+	t.Run("Selected by header", func(t *testing.T) {
+		first, second := sourceIPFor("customer-a"), sourceIPFor("customer-a")
+		customerA := map[string]bool{"127.0.0.2": true, "127.0.0.3": true}
+		if first == second || !customerA[first] || !customerA[second] {
+			t.Errorf("Expected requests to alternate between the customer-a addresses, got %s and %s", first, second)
+		}
+	})
+
+	t.Run("Unknown pool", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "http://localhost:12082/", nil)
+		req.Header.Set(EgressPoolHeader, "missing")
+		resp, err := client.Do(req)
+		checkNoError(t, err)
+		assertReasonCode(t, resp, http.StatusBadRequest, EgressPoolNotFound)
+	})
+}
@@ -6,5 +6,6 @@ require (
 	github.com/google/uuid v1.1.2
 	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
 	gopkg.in/yaml.v2 v2.3.0
 )
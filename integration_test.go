@@ -5,19 +5,28 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -28,6 +37,9 @@ const (
 	httpsTargetServerWithClientCertCheckPort = "12089"
 )
 
+// Ports used by target servers in these tests, which aren't in the default allowed ports
+var testTargetPorts = []uint16{12080, 12081, 12082, 12089, 12099, 14400, 14402}
+
 type certificateFixtures struct {
 	rootCAs                   *x509.CertPool
 	rootCAPrivateKey          crypto.PrivateKey
@@ -88,6 +100,7 @@ type testFixture struct {
 	transportSetup func(*http.Transport, *certificateFixtures)
 	proxy          *http.Server
 	proxyType      Protocol
+	http2          bool
 	servers        []*http.Server
 }
 
@@ -96,16 +109,19 @@ func (f *testFixture) setUp(t *testing.T) *http.Client {
 		f.certificates = newCertificateFixtures(t)
 	}
 	proxyConfig := NewDefaultConfig()
+	proxyConfig.AllowedPorts = append(proxyConfig.AllowedPorts, testTargetPorts...)
 	if f.configSetup != nil {
 		f.configSetup(proxyConfig, f.certificates)
 	}
 	if f.proxyType == "" {
 		f.proxyType = HTTP
 	}
-	switch f.proxyType {
-	case HTTP:
+	switch {
+	case f.http2:
+		f.proxy = startHTTP2Proxy(t, proxyConfig, f.proxyType, f.certificates.proxyCert)
+	case f.proxyType == HTTP:
 		f.proxy = startProxy(t, proxyConfig)
-	case HTTPS:
+	case f.proxyType == HTTPS:
 		f.proxy = startTLSProxyWithCert(t, proxyConfig, f.certificates.proxyCert)
 	}
 
@@ -116,6 +132,10 @@ func (f *testFixture) setUp(t *testing.T) *http.Client {
 	f.servers = f.serversSetup(f.certificates)
 	waitForStartup(t, f.proxy.Addr)
 
+	if f.http2 {
+		return &http.Client{Transport: newHTTP2ProxyTransport(f.proxyType, f.certificates)}
+	}
+
 	tr := &http.Transport{
 		Proxy: func(r *http.Request) (*url.URL, error) {
 			if f.proxyType == HTTP {
@@ -179,6 +199,534 @@ func TestPrivateNetworkForbidden(t *testing.T) {
 	fixture.tearDown(t)
 }
 
+func TestHostDenyList(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			denied, _ := ParseHostPattern("localhost")
+			config.HostDenyList = []HostPattern{denied}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			server := startTargetServer(t)
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+	if err != nil {
+		t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+	}
+	if resp.StatusCode != 403 {
+		t.Errorf("Expected status code 403, got %d\n", resp.StatusCode)
+	}
+	errorCode := resp.Header.Get(ReasonCodeHeader)
+	if errorCode != BlockedHostname {
+		t.Errorf("Expected errorCode %s, but found %s", BlockedHostname, errorCode)
+	}
+
+	fixture.tearDown(t)
+}
+
+func TestCidrAllowListOverridesDenyList(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			_, loopback, _ := net.ParseCIDR("127.0.0.1/32")
+			config.CidrAllowList = []Cidr{Cidr(*loopback)}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			server := startTargetServer(t)
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+	if err != nil {
+		t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+	}
+
+	fixture.tearDown(t)
+}
+
+func TestCustomDNSServer(t *testing.T) {
+	var dnsServer *fakeDNSServer
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.DNS.Servers = []string{"udp://" + fakeDNSServerAddress}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			dnsServer = startFakeDNSServer(t, map[string]string{"webhook.test": "127.0.0.1"})
+			server := startTargetServer(t)
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+	defer dnsServer.Close()
+
+	t.Run("Resolves using configured DNS server", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://webhook.test:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("Unknown host", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://missing.test:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 502 {
+			t.Errorf("Expected status code 502, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(ReasonCodeHeader)
+		if errorCode != UnableToResolveIP {
+			t.Errorf("Expected errorCode %s, but found %s", UnableToResolveIP, errorCode)
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
+func TestFallbackToNextResolvedAddress(t *testing.T) {
+	var dnsServer *fakeDNSServer
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+			config.CidrAllowList = []Cidr{Cidr(*loopback)}
+			config.DNS.Servers = []string{"udp://" + fakeDNSServerAddress}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			dnsServer = startFakeDNSServer(t, map[string]string{
+				// Nothing listens on 127.0.0.2, so connecting to it is refused
+				"dead-node.test":    "127.0.0.2,127.0.0.1",
+				"blocked-node.test": "10.1.1.1,127.0.0.1",
+				"all-blocked.test":  "10.1.1.1,172.16.1.1",
+			})
+			server := startTargetServer(t)
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+	defer dnsServer.Close()
+
+	t.Run("Unreachable address is skipped", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://dead-node.test:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("Blocked address is skipped", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://blocked-node.test:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("All addresses blocked", func(t *testing.T) {
+		assertForbiddenIP(client, "all-blocked.test", t)
+	})
+
+	fixture.tearDown(t)
+}
+
+func TestZeroConnectTimeout(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.ConnectTimeout = 0
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+
+	t.Run("Plain HTTP target", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("No deadline at all", func(t *testing.T) {
+		sd := &safeDialer{dialer: &net.Dialer{}}
+		conn, err := sd.dialFirstReachable(context.Background(), sd.dialer, []string{"127.0.0.1:" + httpTargetServerPort})
+		checkNoError(t, err)
+		conn.Close()
+	})
+}
+
+func TestSocks5ZeroConnectTimeout(t *testing.T) {
+	target := startTargetServer(t)
+	defer target.Close()
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:"+udpTargetPort)
+	checkNoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		config.ConnectTimeout = 0
+		l.Socks5.AllowBind = true
+		l.Socks5.AllowUDPAssociate = true
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	t.Run("Connect", func(t *testing.T) {
+		resp, err := socks5HTTPClient(t, nil).Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		checkNoError(t, err)
+		assertEqual(t, 200, resp.StatusCode)
+	})
+
+	t.Run("Bind", func(t *testing.T) {
+		conn, reader, reply, bound := socks5Handshake(t, socks5CmdBind, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 14400})
+		defer conn.Close()
+		assertEqual(t, byte(socks5Succeeded), reply)
+		peer, err := net.Dial("tcp4", bound.String())
+		checkNoError(t, err)
+		defer peer.Close()
+		reply, _ = readSocks5Reply(t, reader)
+		assertEqual(t, byte(socks5Succeeded), reply)
+	})
+
+	t.Run("UDP associate with a lookup", func(t *testing.T) {
+		conn, _, reply, relayAddr := socks5Handshake(t, socks5CmdUDPAssoc, &net.TCPAddr{IP: net.IPv4zero})
+		defer conn.Close()
+		assertEqual(t, byte(socks5Succeeded), reply)
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		checkNoError(t, err)
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		datagram := append([]byte{0, 0, 0, socks5AddrDomain, byte(len("localhost"))}, "localhost"...)
+		datagram = append(datagram, 0x38, 0x40) // port 14400
+		client.WriteTo(append(datagram, "ping"...), &net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port})
+		buf := make([]byte, 1024)
+		n, _, err := client.ReadFrom(buf)
+		checkNoError(t, err)
+		assertEqual(t, "ping", string(buf[10:n]))
+	})
+}
+
+func TestRejectMixedDNSAnswers(t *testing.T) {
+	var dnsServer *fakeDNSServer
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+			config.CidrAllowList = []Cidr{Cidr(*loopback)}
+			config.RejectMixedDNSAnswers = true
+			config.DNS.Servers = []string{"udp://" + fakeDNSServerAddress}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			dnsServer = startFakeDNSServer(t, map[string]string{
+				"public.test": "127.0.0.1",
+				"mixed.test":  "127.0.0.1,10.1.1.1",
+			})
+			server := startTargetServer(t)
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+	defer dnsServer.Close()
+
+	t.Run("Only allowed addresses", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://public.test:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("Mixed answer is rejected", func(t *testing.T) {
+		assertForbiddenIP(client, "mixed.test", t)
+	})
+
+	t.Run("Decimal IPv4 host is rejected", func(t *testing.T) {
+		resp, err := client.Get(fmt.Sprintf("http://2130706433:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		if resp.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d\n", resp.StatusCode)
+		}
+		errorCode := resp.Header.Get(ReasonCodeHeader)
+		if errorCode != InvalidHostname {
+			t.Errorf("Expected errorCode %s, but found %s", InvalidHostname, errorCode)
+		}
+	})
+
+	fixture.tearDown(t)
+}
+
+func TestOutboundKeepAlive(t *testing.T) {
+	var newConns int32
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.OutboundKeepAlive.Enabled = true
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			server := startTargetServerWithConnState(t, func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&newConns, 1)
+				}
+			})
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+		}
+	}
+	if n := atomic.LoadInt32(&newConns); n != 1 {
+		t.Errorf("Expected 1 connection to the target to be reused, but %d were opened", n)
+	}
+
+	fixture.tearDown(t)
+}
+
+func TestAccessLogFields(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.RootCACerts = c.rootCAs
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startTargetHTTPSServerWithInMemoryCert(t, c.serverCert), startLargeContentLengthServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+	accessLogBuffer := new(bytes.Buffer)
+	accessLog.Out = accessLogBuffer
+	accessLog.SetFormatter(&logrus.JSONFormatter{})
+	defer func() {
+		accessLog.Out = os.Stdout
+		accessLog.SetFormatter(&AccessLogTextFormatter{})
+	}()
+	lastRecord := func() map[string]interface{} {
+		lines := strings.Split(strings.TrimSpace(accessLogBuffer.String()), "\n")
+		record := make(map[string]interface{})
+		checkNoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &record))
+		return record
+	}
+
+	t.Run("HTTPS target", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpsTargetServerPort), nil)
+		req.Header.Set("X-WHSentry-TLS", "true")
+		req.Header.Set("User-Agent", "webhooks/1.0")
+		resp, err := client.Do(req)
+		checkNoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		record := lastRecord()
+		assertEqual(t, "webhooks/1.0", record["user_agent"])
+		assertEqual(t, "TLS1.3", record["tls_version"])
+		assertEqual(t, "TLS_AES_128_GCM_SHA256", record["tls_cipher"])
+		assertEqual(t, float64(len("Hello from target HTTPS")), record["response_bytes"])
+		for _, phase := range []string{"dns_time", "connect_time", "tls_time", "ttfb", "server_time", "transfer_time"} {
+			if record[phase].(float64) <= 0 {
+				t.Errorf("Expected %s to be recorded, got %v", phase, record[phase])
+			}
+		}
+		if record["ttfb"].(float64) < record["connect_time"].(float64)+record["tls_time"].(float64) {
+			t.Errorf("Expected TTFB to include connecting, got %v", record)
+		}
+	})
+
+	t.Run("Phase histograms", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(phaseHistogram)
+		families, err := registry.Gather()
+		checkNoError(t, err)
+		assertEqual(t, 1, len(families))
+		phases := make(map[string]bool)
+		for _, metric := range families[0].GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "phase" {
+					phases[label.GetValue()] = true
+				}
+			}
+		}
+		// The HTTPS request went through every phase
+		assertEqual(t, 6, len(phases))
+	})
+
+	t.Run("Request bytes and reason code", func(t *testing.T) {
+		resp, err := client.Post("http://localhost:12099/request-length", "text/plain", strings.NewReader("twelve bytes"))
+		checkNoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		assertEqual(t, float64(12), lastRecord()["request_bytes"])
+
+		assertEqual(t, "", lastRecord()["reason_code"])
+		_, err = client.Get("http://localhost:1234/")
+		checkNoError(t, err)
+		assertEqual(t, PortNotAllowed, lastRecord()["reason_code"])
+	})
+}
+
+func TestOutboundHTTP2(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.RootCACerts = c.rootCAs
+			config.OutboundHTTP2 = true
+			config.OutboundKeepAlive.Enabled = true
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			server := startTargetHTTP2Server(t, c.serverCert)
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpsTargetServerPort), nil)
+	if err != nil {
+		t.Fatalf("Failed to create new request: %s\n", err)
+	}
+	req.Header.Add("X-WHSentry-TLS", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200, got %d\n", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error while reading body: %s\n", err)
+	}
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Expected target to be spoken to over HTTP/2, but protocol was %s", body)
+	}
+
+	fixture.tearDown(t)
+}
+
+func TestPortNotAllowed(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.AllowedPorts = []uint16{80, 443}
+			exceptionHost, _ := ParseHostPattern("*.example.com")
+			config.PortExceptions = []PortException{{Host: exceptionHost, Ports: testTargetPorts}}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			server := startTargetServer(t)
+			return []*http.Server{server}
+		},
+	}
+
+	client := fixture.setUp(t)
+
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+	if err != nil {
+		t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+	}
+	if resp.StatusCode != 403 {
+		t.Errorf("Expected status code 403, got %d\n", resp.StatusCode)
+	}
+	errorCode := resp.Header.Get(ReasonCodeHeader)
+	if errorCode != PortNotAllowed {
+		t.Errorf("Expected errorCode %s, but found %s", PortNotAllowed, errorCode)
+	}
+
+	fixture.tearDown(t)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.RequestIDHeader = "X-Correlation-Id"
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+
+	get := func(url string, requestID string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		checkNoError(t, err)
+		if requestID != "" {
+			req.Header.Set(RequestIDHeader, requestID)
+		}
+		resp, err := client.Do(req)
+		checkNoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		checkNoError(t, err)
+		return resp, string(body)
+	}
+	targetURL := "http://localhost:" + httpTargetServerPort + "/correlation-id"
+
+	resp, forwarded := get(targetURL, "")
+	generated, err := uuid.Parse(resp.Header.Get(RequestIDHeader))
+	checkNoError(t, err)
+	assertEqual(t, generated.String(), forwarded)
+
+	const supplied = "8b3f7c4e-2d6a-4e1b-9a55-0f2c6d8e7a10"
+	resp, forwarded = get(targetURL, supplied)
+	assertEqual(t, supplied, resp.Header.Get(RequestIDHeader))
+	assertEqual(t, supplied, forwarded)
+
+	// An ID that isn't a UUID is replaced, so the logs stay consistent
+	resp, forwarded = get(targetURL, "not-a-uuid")
+	_, err = uuid.Parse(resp.Header.Get(RequestIDHeader))
+	checkNoError(t, err)
+	assertEqual(t, resp.Header.Get(RequestIDHeader), forwarded)
+
+	// Requests the proxy rejects get one too
+	resp, _ = get("http://localhost:22/", supplied)
+	assertEqual(t, PortNotAllowed, resp.Header.Get(ReasonCodeHeader))
+	assertEqual(t, supplied, resp.Header.Get(RequestIDHeader))
+}
+
 func TestProxy(t *testing.T) {
 	fixture := &testFixture{
 		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
@@ -570,6 +1118,184 @@ func TestHTTPSProxyListener(t *testing.T) {
 	fixture.tearDown(t)
 }
 
+func TestHTTP2ProxyListener(t *testing.T) {
+	for _, proxyType := range []Protocol{HTTP, HTTPS} {
+		t.Run(fmt.Sprintf("Test HTTP/2 over %s proxy listener", proxyType), func(t *testing.T) {
+			fixture := &testFixture{
+				configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+					config.InsecureSkipCidrDenyList = true
+					config.RootCACerts = c.rootCAs
+				},
+				serversSetup: func(c *certificateFixtures) []*http.Server {
+					httpServer := startTargetServer(t)
+					httpsServer := startTargetHTTPSServerWithInMemoryCert(t, c.serverCert)
+					return []*http.Server{httpServer, httpsServer}
+				},
+				proxyType: proxyType,
+				http2:     true,
+			}
+
+			client := fixture.setUp(t)
+
+			resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+			if err != nil {
+				t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+			}
+			if resp.ProtoMajor != 2 {
+				t.Errorf("Expected proxy to respond over HTTP/2, but protocol was %s\n", resp.Proto)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error while reading body: %s\n", err)
+			}
+			if string(body) != "Hello from target" {
+				t.Errorf("Expected string 'Hello from target' in response, but was %s\n", body)
+			}
+
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpsTargetServerPort), nil)
+			if err != nil {
+				t.Fatalf("Failed to create new request: %s\n", err)
+			}
+			req.Header.Add("X-WHSentry-TLS", "true")
+			resp, err = client.Do(req)
+			if err != nil {
+				t.Fatalf("Error in GET request to HTTPS target server via proxy: %s\n", err)
+			}
+			body, err = ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error while reading body: %s\n", err)
+			}
+			if string(body) != "Hello from target HTTPS" {
+				t.Errorf("Expected string 'Hello from target HTTPS' in response, but was %s\n", body)
+			}
+
+			fixture.tearDown(t)
+		})
+	}
+}
+
+func TestHTTP2DisabledOnHTTPSListenerByDefault(t *testing.T) {
+	config := NewDefaultConfig()
+	listenerConfig := ListenerConfig{Address: proxyHttpsAddress, Type: HTTPS, CertFile: "cert.pem", KeyFile: "key.pem"}
+	server := newProxyServer(listenerConfig, config, newSafeDialer(config), http.DefaultTransport, nil, nil, nil, connsGauge.With(prometheus.Labels{"listener": listenerConfig.Address}))
+	if server.TLSNextProto == nil {
+		t.Fatalf("Expected HTTP/2 to be disabled on HTTPS listener")
+	}
+	if _, ok := server.TLSNextProto["h2"]; ok {
+		t.Errorf("Expected h2 not to be offered over ALPN")
+	}
+}
+
+// countingGauge keeps its own count of Inc and Dec, so a test can read it without a registry
+type countingGauge struct {
+	prometheus.Gauge
+	n int64
+}
+
+func (g *countingGauge) Inc() { atomic.AddInt64(&g.n, 1) }
+func (g *countingGauge) Dec() { atomic.AddInt64(&g.n, -1) }
+
+func TestH2CInboundConnsGauge(t *testing.T) {
+	config := NewDefaultConfig()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	checkNoError(t, err)
+	listenerConfig := ListenerConfig{Address: listener.Addr().String(), Type: HTTP, H2C: true}
+	gauge := &countingGauge{}
+	server := newProxyServer(listenerConfig, config, newSafeDialer(config), http.DefaultTransport, nil, nil, nil, gauge)
+	go server.Serve(listener)
+	defer server.Shutdown(context.TODO())
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, listener.Addr().String())
+		},
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://localhost:1/target")
+	checkNoError(t, err)
+	resp.Body.Close()
+	assertEqual(t, 2, resp.ProtoMajor)
+	assertEqual(t, int64(1), atomic.LoadInt64(&gauge.n))
+
+	transport.CloseIdleConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&gauge.n) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEqual(t, int64(0), atomic.LoadInt64(&gauge.n))
+}
+
+func TestMitmHttp2Connect(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.InsecureSkipCertVerification = true
+			config.MitmIssuerCert = c.rootCACert
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			server := startTargetHTTPSServerWithInMemoryCert(t, c.serverCert)
+			return []*http.Server{server}
+		},
+		proxyType: HTTPS,
+		http2:     true,
+	}
+
+	client := fixture.setUp(t)
+
+	target := "localhost:" + httpsTargetServerPort
+	bodyReader, bodyWriter := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: target},
+		Host:   target,
+		Header: make(http.Header),
+		Body:   bodyReader,
+	}
+	resp, err := client.Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Got error requesting HTTP/2 CONNECT to HTTPS target: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got status code %d", resp.StatusCode)
+	}
+
+	tlsConn := tls.Client(&clientStreamConn{r: resp.Body, w: bodyWriter}, &tls.Config{ServerName: "localhost", RootCAs: fixture.certificates.rootCAs})
+	fmt.Fprintf(tlsConn, "GET /target HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+	tunnelResp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response through HTTP/2 tunnel: %s", err)
+	}
+	body, err := ioutil.ReadAll(tunnelResp.Body)
+	if err != nil {
+		t.Fatalf("Error while reading body: %s\n", err)
+	}
+	if string(body) != "Hello from target HTTPS" {
+		t.Errorf("Expected string 'Hello from target HTTPS' in response, but was %s\n", body)
+	}
+	// The tunnel stays open until the client ends its stream
+	tlsConn.Close()
+
+	fixture.tearDown(t)
+}
+
+// clientStreamConn is the client side of an HTTP/2 CONNECT tunnel
+type clientStreamConn struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+func (c *clientStreamConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *clientStreamConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *clientStreamConn) Close() error {
+	c.w.Close()
+	return c.r.Close()
+}
+func (c *clientStreamConn) LocalAddr() net.Addr                { return streamAddr("") }
+func (c *clientStreamConn) RemoteAddr() net.Addr               { return streamAddr(proxyHttpsAddress) }
+func (c *clientStreamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *clientStreamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *clientStreamConn) SetWriteDeadline(t time.Time) error { return nil }
+
 func TestContentLengthLimit(t *testing.T) {
 	maxContentLength := 8
 	fixture := &testFixture{
@@ -662,6 +1388,142 @@ func TestChunkedResponseContentLengthLimit(t *testing.T) {
 	fixture.tearDown(t)
 }
 
+func TestResponseOverflowModes(t *testing.T) {
+	maxContentLength := 8 * 1024
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.MaxResponseBodySize = uint32(maxContentLength)
+			config.Tenants = []TenantConfig{
+				{Name: "buffer", ResponseOverflowMode: Buffer},
+				{Name: "reset", ResponseOverflowMode: Reset},
+				{Name: "discard", ResponseOverflowMode: Discard},
+			}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startLargeContentLengthServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+
+	get := func(path string, mode string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://localhost:12099"+path, nil)
+		if mode != "" {
+			req.Header.Set(TenantHeader, mode)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+		}
+		return resp
+	}
+	assertTruncated := func(t *testing.T, resp *http.Response) {
+		responseData, err := ioutil.ReadAll(resp.Body)
+		checkNoError(t, err)
+		assertEqual(t, maxContentLength, len(responseData))
+		assertEqual(t, "true", resp.Trailer.Get(TruncatedTrailer))
+	}
+
+	t.Run("Truncate", func(t *testing.T) {
+		assertTruncated(t, get("/oversize", ""))
+	})
+
+	t.Run("Not truncated", func(t *testing.T) {
+		resp := get("/8k", "")
+		ioutil.ReadAll(resp.Body)
+		assertEqual(t, "", resp.Trailer.Get(TruncatedTrailer))
+	})
+
+	t.Run("Buffer", func(t *testing.T) {
+		assertReasonCode(t, get("/oversize", "buffer"), http.StatusBadGateway, ResponseTooLarge)
+		resp := get("/8k", "buffer")
+		assertEqual(t, 200, resp.StatusCode)
+		assertEqual(t, int64(maxContentLength), resp.ContentLength)
+		assertEqual(t, "oversize", resp.Header.Get("X-Custom-Header"))
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		resp := get("/oversize", "reset")
+		assertEqual(t, 200, resp.StatusCode)
+		if _, err := ioutil.ReadAll(resp.Body); err == nil {
+			t.Errorf("Expected an error reading a reset response")
+		}
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+		assertTruncated(t, get("/oversize", "discard"))
+	})
+}
+
+func TestRequestBodySizeLimit(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.MaxRequestBodySize = 8 * 1024
+			config.Tenants = []TenantConfig{{Name: "bulk", MaxRequestBodySize: 64 * 1024}}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startLargeContentLengthServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+
+	post := func(body io.Reader, tenant string) *http.Response {
+		req, _ := http.NewRequest("POST", "http://localhost:12099/request-length", body)
+		if tenant != "" {
+			req.Header.Set(TenantHeader, tenant)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error in POST request to target server via proxy: %s\n", err)
+		}
+		return resp
+	}
+	// chunked hides the length of a body, so the client has to send it with chunked encoding
+	chunked := func(size int) io.Reader {
+		return ioutil.NopCloser(strings.NewReader(strings.Repeat("a", size)))
+	}
+
+	t.Run("Within limit", func(t *testing.T) {
+		resp := post(strings.NewReader(strings.Repeat("a", 8*1024)), "")
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "8192", string(body))
+	})
+
+	t.Run("Oversized Content-Length", func(t *testing.T) {
+		assertReasonCode(t, post(strings.NewReader(strings.Repeat("a", 8*1024+1)), ""), http.StatusRequestEntityTooLarge, RequestTooLarge)
+	})
+
+	t.Run("Chunked within limit", func(t *testing.T) {
+		resp := post(chunked(8*1024), "")
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "8192", string(body))
+	})
+
+	t.Run("Oversized chunked body", func(t *testing.T) {
+		accessLogBuffer := new(bytes.Buffer)
+		accessLog.Out = accessLogBuffer
+		accessLog.SetFormatter(&logrus.JSONFormatter{})
+		defer func() {
+			accessLog.Out = os.Stdout
+			accessLog.SetFormatter(&AccessLogTextFormatter{})
+		}()
+		assertReasonCode(t, post(chunked(1024*1024), ""), http.StatusRequestEntityTooLarge, RequestTooLarge)
+		// The body is read up to one byte past the limit before it's cut off
+		record := make(map[string]interface{})
+		checkNoError(t, json.Unmarshal(accessLogBuffer.Bytes(), &record))
+		assertEqual(t, float64(8*1024+1), record["request_bytes"])
+	})
+
+	t.Run("Tenant limit", func(t *testing.T) {
+		resp := post(chunked(32*1024), "bulk")
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "32768", string(body))
+	})
+}
+
 func waitForStartup(t *testing.T, address string) {
 	i := 0
 	for {
@@ -681,18 +1543,41 @@ func waitForStartup(t *testing.T, address string) {
 	}
 }
 
+// tenantNames lets requests to the test proxies pick any tenant with the tenant header
+func tenantNames(p *ProxyConfig) []string {
+	var names []string
+	for _, tenant := range p.Tenants {
+		names = append(names, tenant.Name)
+	}
+	return names
+}
+
+// createTestProxyServer returns the server for the first listener, and closes what it shares with the other
+// servers, like the tracer, once the test has finished, so nothing it runs outlives the test
+func createTestProxyServer(t *testing.T, p *ProxyConfig) *http.Server {
+	proxyServers, closers := CreateProxyServers(p)
+	t.Cleanup(func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	})
+	return proxyServers[0]
+}
+
 func startProxy(t *testing.T, p *ProxyConfig) *http.Server {
 	setupLogging(p)
 	p.Listeners = make([]ListenerConfig, 1, 1)
 	p.Listeners[0] = ListenerConfig{
-		Address: proxyHttpAddress,
-		Type:    HTTP,
+		Address:        proxyHttpAddress,
+		Type:           HTTP,
+		AllowedTenants: tenantNames(p),
 	}
-	proxy := CreateProxyServers(p)[0]
+	proxy := createTestProxyServer(t, p)
 	go func() {
 		listener, err := net.Listen("tcp4", p.Listeners[0].Address)
 		if err != nil {
-			t.Fatalf("Could not start proxy listener: %s\n", err)
+			t.Errorf("Could not start proxy listener: %s\n", err)
+			return
 		}
 		proxy.Serve(listener)
 	}()
@@ -703,16 +1588,18 @@ func startTLSProxy(t *testing.T, p *ProxyConfig) *http.Server {
 	setupLogging(p)
 	p.Listeners = make([]ListenerConfig, 1, 1)
 	p.Listeners[0] = ListenerConfig{
-		Address:  proxyHttpsAddress,
-		Type:     HTTP,
-		CertFile: "certs/cert.pem",
-		KeyFile:  "certs/key.pem",
+		Address:        proxyHttpsAddress,
+		Type:           HTTP,
+		CertFile:       "certs/cert.pem",
+		KeyFile:        "certs/key.pem",
+		AllowedTenants: tenantNames(p),
 	}
-	proxy := CreateProxyServers(p)[0]
+	proxy := createTestProxyServer(t, p)
 	go func() {
 		listener, err := net.Listen("tcp4", p.Listeners[0].Address)
 		if err != nil {
-			t.Fatalf("Could not start proxy listener: %s\n", err)
+			t.Errorf("Could not start proxy listener: %s\n", err)
+			return
 		}
 		proxy.ServeTLS(listener, p.Listeners[0].CertFile, p.Listeners[0].KeyFile)
 	}()
@@ -723,35 +1610,92 @@ func startTLSProxyWithCert(t *testing.T, p *ProxyConfig, proxyCert *tls.Certific
 	setupLogging(p)
 	p.Listeners = make([]ListenerConfig, 1, 1)
 	p.Listeners[0] = ListenerConfig{
-		Address: proxyHttpsAddress,
-		Type:    HTTP,
+		Address:        proxyHttpsAddress,
+		Type:           HTTP,
+		AllowedTenants: tenantNames(p),
 	}
-	proxy := CreateProxyServers(p)[0]
+	proxy := createTestProxyServer(t, p)
 	go func() {
 		config := &tls.Config{Certificates: []tls.Certificate{*proxyCert}}
 		listener, err := tls.Listen("tcp4", p.Listeners[0].Address, config)
 		if err != nil {
-			t.Fatalf("Could not start proxy listener: %s\n", err)
+			t.Errorf("Could not start proxy listener: %s\n", err)
+			return
 		}
 		proxy.Serve(listener)
 	}()
 	return proxy
 }
 
+// startHTTP2Proxy starts a proxy listener with HTTP/2 enabled: h2c for HTTP listeners, and ALPN
+// negotiated h2 for HTTPS listeners
+func startHTTP2Proxy(t *testing.T, p *ProxyConfig, proxyType Protocol, proxyCert *tls.Certificate) *http.Server {
+	setupLogging(p)
+	listenerConfig := ListenerConfig{Address: proxyHttpAddress, Type: HTTP, H2C: true}
+	if proxyType == HTTPS {
+		listenerConfig = ListenerConfig{Address: proxyHttpsAddress, Type: HTTPS, HTTP2: true}
+	}
+	listenerConfig.AllowedTenants = tenantNames(p)
+	p.Listeners = []ListenerConfig{listenerConfig}
+	proxy := createTestProxyServer(t, p)
+	proxy.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*proxyCert}}
+	go func() {
+		listener, err := net.Listen("tcp4", listenerConfig.Address)
+		if err != nil {
+			t.Errorf("Could not start proxy listener: %s\n", err)
+			return
+		}
+		if proxyType == HTTPS {
+			proxy.ServeTLS(listener, "", "")
+		} else {
+			proxy.Serve(listener)
+		}
+	}()
+	return proxy
+}
+
+// newHTTP2ProxyTransport speaks HTTP/2 to the proxy for every request, whatever the request URL,
+// the way an HTTP/2 client configured with the proxy as its only upstream would
+func newHTTP2ProxyTransport(proxyType Protocol, c *certificateFixtures) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			if proxyType == HTTPS {
+				return tls.Dial(network, proxyHttpsAddress, &tls.Config{RootCAs: c.rootCAs, NextProtos: []string{"h2"}})
+			}
+			return net.Dial(network, proxyHttpAddress)
+		},
+	}
+}
+
 func startTargetServer(t *testing.T) *http.Server {
+	return startTargetServerWithConnState(t, nil)
+}
+
+// startTargetServerWithConnState sets the server's ConnState hook before it starts serving
+func startTargetServerWithConnState(t *testing.T, connState func(net.Conn, http.ConnState)) *http.Server {
 	serveMux := http.NewServeMux()
 	serveMux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Custom-Header", "custom")
 		fmt.Fprint(w, "Hello from target")
 	})
+	serveMux.HandleFunc("/traceparent", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get(TraceparentHeader))
+	})
+	serveMux.HandleFunc("/correlation-id", func(w http.ResponseWriter, r *http.Request) {
+		// A target must not be able to change the request ID the client sees
+		w.Header().Set(RequestIDHeader, "set-by-target")
+		fmt.Fprint(w, r.Header.Get("X-Correlation-Id"))
+	})
 
 	server := &http.Server{
-		Addr:    "127.0.0.1:" + httpTargetServerPort,
-		Handler: serveMux,
+		Addr:      "127.0.0.1:" + httpTargetServerPort,
+		Handler:   serveMux,
+		ConnState: connState,
 	}
 	go func() {
 		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			t.Fatalf("Failed to start target HTTP server: %s\n", err)
+			t.Errorf("Failed to start target HTTP server: %s\n", err)
 		}
 	}()
 	return server
@@ -773,7 +1717,7 @@ func startTargetHTTPSServerWithCert(t *testing.T, certFile string, keyFile strin
 	}
 	go func() {
 		if err := server.ListenAndServeTLS(certFile, keyFile); err != http.ErrServerClosed {
-			t.Fatalf("HTTPS server failed to start: %s\n", err)
+			t.Errorf("HTTPS server failed to start: %s\n", err)
 		}
 	}()
 	return server
@@ -793,10 +1737,31 @@ func startTargetHTTPSServerWithInMemoryCert(t *testing.T, serverCert *tls.Certif
 		config := &tls.Config{Certificates: []tls.Certificate{*serverCert}}
 		listener, err := tls.Listen("tcp4", server.Addr, config)
 		if err != nil {
-			t.Fatalf("Failed to listen on port %s: %s\n", httpsTargetServerPort, err)
+			t.Errorf("Failed to listen on port %s: %s\n", httpsTargetServerPort, err)
+			return
 		}
 		if err := server.Serve(listener); err != http.ErrServerClosed {
-			t.Fatalf("HTTPS target server failed to start: %s\n", err)
+			t.Errorf("HTTPS target server failed to start: %s\n", err)
+		}
+	}()
+	return server
+}
+
+// startTargetHTTP2Server responds with the protocol the request was made with
+func startTargetHTTP2Server(t *testing.T, serverCert *tls.Certificate) *http.Server {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+
+	server := &http.Server{
+		Addr:      "127.0.0.1:" + httpsTargetServerPort,
+		Handler:   serveMux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{*serverCert}},
+	}
+	go func() {
+		if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			t.Errorf("HTTP/2 target server failed to start: %s\n", err)
 		}
 	}()
 	return server
@@ -805,13 +1770,20 @@ func startTargetHTTPSServerWithInMemoryCert(t *testing.T, serverCert *tls.Certif
 func startSlowToRespondServer(t *testing.T) {
 	listener, err := net.Listen("tcp4", ":14400")
 	if err != nil {
-		t.Fatalf("Failed to start slow server: %s\n", err)
+		t.Errorf("Failed to start slow server: %s\n", err)
+		return
 	}
 	conn, err := listener.Accept()
 	if err != nil {
-		t.Fatalf("Failed to accept connection in slow server: %s\n", err)
+		t.Errorf("Failed to accept connection in slow server: %s\n", err)
+		return
 	}
 	defer conn.Close()
+	// Respond only once the request is in, or the proxy's transport may see the response as unsolicited
+	if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+		t.Errorf("Failed to read request in slow server: %s\n", err)
+		return
+	}
 	time.Sleep(time.Second * 7)
 	bufw := bufio.NewWriter(conn)
 	bufw.WriteString("HTTP/1.1 200 OK\r\n")
@@ -823,13 +1795,20 @@ func startSlowToRespondServer(t *testing.T) {
 func startNeverSendsBodyServer(t *testing.T) {
 	listener, err := net.Listen("tcp4", ":14402")
 	if err != nil {
-		t.Fatalf("Failed to start never sends body server: %s\n", err)
+		t.Errorf("Failed to start never sends body server: %s\n", err)
+		return
 	}
 	conn, err := listener.Accept()
 	if err != nil {
-		t.Fatalf("Failed to accept connection in never sends body server: %s\n", err)
+		t.Errorf("Failed to accept connection in never sends body server: %s\n", err)
+		return
 	}
 	defer conn.Close()
+	// Respond only once the request is in, or the proxy's transport may see the response as unsolicited
+	if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+		t.Errorf("Failed to read request in never sends body server: %s\n", err)
+		return
+	}
 	bufw := bufio.NewWriter(conn)
 	bufw.WriteString("HTTP/1.1 200 OK\r\n")
 	bufw.WriteString("Connection: Close\r\n")
@@ -861,11 +1840,12 @@ func startTargetHTTPSServerWithClientCertCheck(t *testing.T, serverCert *tls.Cer
 	go func() {
 		listener, err := tls.Listen("tcp4", "127.0.0.1:"+httpsTargetServerWithClientCertCheckPort, tlsConfig)
 		if err != nil {
-			t.Fatalf("Failed to listen on port %s: %s\n", httpsTargetServerWithClientCertCheckPort, err)
+			t.Errorf("Failed to listen on port %s: %s\n", httpsTargetServerWithClientCertCheckPort, err)
+			return
 		}
 
 		if err := server.Serve(listener); err != http.ErrServerClosed {
-			t.Fatalf("HTTPS server failed to start: %s\n", err)
+			t.Errorf("HTTPS server failed to start: %s\n", err)
 		}
 	}()
 	return server
@@ -891,6 +1871,14 @@ func startLargeContentLengthServer(t *testing.T) *http.Server {
 	serveMux.HandleFunc("/oversize", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, content+"a")
 	})
+	serveMux.HandleFunc("/request-length", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, len(body))
+	})
 
 	server := &http.Server{
 		Addr:    "127.0.0.1:12099",
@@ -0,0 +1,164 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listen opens the listener for a listener config, which is either a TCP (IPv4) address or a Unix socket,
+// optionally expecting the PROXY protocol
+func listen(listenerConfig ListenerConfig) (net.Listener, error) {
+	listener, err := listenSocket(listenerConfig)
+	if err != nil {
+		return nil, err
+	}
+	if listenerConfig.ProxyProtocol.Enabled {
+		listener = newProxyProtocolListener(listener, listenerConfig.ProxyProtocol)
+	}
+	return listener, nil
+}
+
+func listenSocket(listenerConfig ListenerConfig) (net.Listener, error) {
+	if !isUnixAddress(listenerConfig.Address) {
+		return net.Listen("tcp4", listenerConfig.Address)
+	}
+	path := unixSocketPath(listenerConfig.Address)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	if listenerConfig.SocketMode == "" && listenerConfig.SocketOwner == "" {
+		return net.Listen("unix", path)
+	}
+	return listenPrivateUnix(path, listenerConfig)
+}
+
+// listenPrivateUnix creates the socket in a private directory next to its final path, sets its owner and mode,
+// and only then moves it into place, so no one else can connect until it has its final permissions. Changing the
+// umask instead would also apply to files other goroutines create meanwhile, since it's process-wide.
+func listenPrivateUnix(path string, listenerConfig ListenerConfig) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".whsentry-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	privatePath := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", privatePath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed by its final name on Close instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = setSocketPermissions(privatePath, listenerConfig); err == nil {
+		err = os.Rename(privatePath, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixSocketListener{Listener: listener, path: path}, nil
+}
+
+// unixSocketListener removes its socket file when it's closed
+type unixSocketListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run that didn't shut down cleanly.
+// It refuses to remove anything that isn't a socket, or a socket that something is still listening on.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Cannot listen on %s; it exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("Cannot listen on %s; another process is listening on it", path)
+	}
+	return os.Remove(path)
+}
+
+// setSocketPermissions sets the owner before the mode, so the socket is only opened up once it has its final owner
+func setSocketPermissions(path string, listenerConfig ListenerConfig) error {
+	if listenerConfig.SocketOwner != "" {
+		uid, gid, err := lookupSocketOwner(listenerConfig.SocketOwner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if listenerConfig.SocketMode != "" {
+		mode, err := parseSocketMode(listenerConfig.SocketMode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid file mode %s", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// lookupSocketOwner resolves a "user[:group]" owner to a uid and gid. Either can be a name or a numeric ID.
+// Without a group, the gid is -1, which leaves the group unchanged.
+func lookupSocketOwner(owner string) (int, int, error) {
+	userName := owner
+	groupName := ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("unknown user %s", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %s", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whsentry")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+	listenerConfig := ListenerConfig{Address: "unix:" + path, Type: HTTP, SocketMode: "0660"}
+
+	t.Run("Sets the socket mode", func(t *testing.T) {
+		listener, err := listen(listenerConfig)
+		checkNoError(t, err)
+		defer listener.Close()
+		info, err := os.Stat(path)
+		checkNoError(t, err)
+		assertEqual(t, os.FileMode(0660), info.Mode().Perm())
+	})
+
+	t.Run("Creates the socket in a private directory", func(t *testing.T) {
+		listener, err := listen(listenerConfig)
+		checkNoError(t, err)
+		entries, err := ioutil.ReadDir(dir)
+		checkNoError(t, err)
+		assertEqual(t, 1, len(entries))
+		assertEqual(t, "proxy.sock", entries[0].Name())
+
+		conn, err := net.Dial("unix", path)
+		checkNoError(t, err)
+		conn.Close()
+		listener.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected the socket to be removed on close, got %v", err)
+		}
+	})
+
+	t.Run("Removes a stale socket", func(t *testing.T) {
+		stale, err := net.Listen("unix", path)
+		checkNoError(t, err)
+		// Leave the socket file behind, as a crashed process would
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		listener, err := listen(listenerConfig)
+		checkNoError(t, err)
+		listener.Close()
+	})
+
+	t.Run("Refuses a socket that's in use", func(t *testing.T) {
+		listener, err := listen(listenerConfig)
+		checkNoError(t, err)
+		defer listener.Close()
+		_, err = listen(listenerConfig)
+		assertError(t, "another process is listening on it", err)
+	})
+
+	t.Run("Refuses to remove a regular file", func(t *testing.T) {
+		filePath := filepath.Join(dir, "not-a-socket")
+		checkNoError(t, ioutil.WriteFile(filePath, []byte("data"), 0600))
+		_, err := listen(ListenerConfig{Address: "unix:" + filePath, Type: HTTP})
+		assertError(t, "it exists and is not a socket", err)
+	})
+}
+
+func TestSocketOptionsValidation(t *testing.T) {
+	t.Run("Unix socket path must be absolute", func(t *testing.T) {
+		assertError(t, "unix:/absolute/path", validateAddress("unix:proxy.sock"))
+	})
+
+	t.Run("Invalid socket mode", func(t *testing.T) {
+		err := validateListeners([]ListenerConfig{{Address: "unix:/run/whsentry.sock", Type: HTTP, SocketMode: "rw-rw----"}})
+		assertError(t, "it should be an octal file mode", err)
+	})
+
+	t.Run("Socket options need a Unix socket", func(t *testing.T) {
+		err := validateListeners([]ListenerConfig{{Address: ":9090", Type: HTTP, SocketMode: "0660"}})
+		assertError(t, "only supported on Unix socket listeners", err)
+	})
+
+	t.Run("Socket owner", func(t *testing.T) {
+		current, err := user.Current()
+		checkNoError(t, err)
+		uid, gid, err := lookupSocketOwner(current.Username + ":" + current.Gid)
+		checkNoError(t, err)
+		assertEqual(t, current.Uid, fmt.Sprint(uid))
+		assertEqual(t, current.Gid, fmt.Sprint(gid))
+		_, _, err = lookupSocketOwner("no-such-user-whsentry")
+		assertError(t, "unknown user", err)
+	})
+}
+
+func TestProxyOnUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whsentry")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.AllowedPorts = append(config.AllowedPorts, testTargetPorts...)
+	config.Listeners = []ListenerConfig{{Address: "unix:" + path, Type: HTTP}}
+	setupLogging(config)
+	proxy := createTestProxyServer(t, config)
+	listener, err := listen(config.Listeners[0])
+	checkNoError(t, err)
+	go proxy.Serve(listener)
+	defer proxy.Shutdown(context.TODO())
+	target := startTargetServer(t)
+	defer target.Shutdown(context.TODO())
+	waitForStartup(t, "127.0.0.1:"+httpTargetServerPort)
+
+	client := &http.Client{Transport: &http.Transport{
+		// The proxy host doesn't matter, since every connection goes to the socket
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "whsentry"}),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+	checkNoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	checkNoError(t, err)
+	assertEqual(t, "Hello from target", string(body))
+}
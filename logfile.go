@@ -0,0 +1,206 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// logFile is a log file that can be rotated by size or age, keeping a number of old files around, and
+// reopened so an external tool like logrotate can move it out of the way. Rotated files are named after the
+// log file with a number appended, newest first: access.log.1, access.log.2 and so on, with a .gz extension
+// if they're compressed. Rotated files are compressed in the background, so writes aren't held up.
+type logFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+	// compressing tracks the background compression of the newest backup
+	compressing sync.WaitGroup
+}
+
+// openLogFile opens the log file for appending, or truncates it first if the config asks for that
+func openLogFile(config LogConfig) (*logFile, error) {
+	l := &logFile{
+		path:       config.File,
+		maxSize:    config.MaxSize,
+		maxAge:     config.MaxAge,
+		maxBackups: config.MaxBackups,
+		compress:   config.Compress,
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if config.Truncate {
+		flags |= os.O_TRUNC
+	}
+	if err := l.open(flags); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file by name, and only then closes the file it replaces, so that if it fails, logging
+// carries on to the current file
+func (l *logFile) open(flags int) error {
+	f, err := os.OpenFile(l.path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	l.size = info.Size()
+	l.openedAt = time.Now()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && ((l.maxSize > 0 && l.size+int64(len(p)) > l.maxSize) || (l.maxAge > 0 && time.Since(l.openedAt) >= l.maxAge)) {
+		if err := l.rotate(); err != nil {
+			// rotate leaves a file open to keep logging to, rather than losing records
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %s\n", l.path, err)
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Reopen opens the log file again by name, for when it has been moved by an external tool. If that fails, the
+// moved file is kept open.
+func (l *logFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open(os.O_WRONLY | os.O_CREATE | os.O_APPEND)
+}
+
+// rotate moves the current file to the first backup, shifting older backups along and removing the oldest.
+// Without backups to keep, the current file is just truncated. If any step fails, the current file stays open,
+// under its old name or as the first backup.
+func (l *logFile) rotate() error {
+	if l.maxBackups <= 0 {
+		return l.open(os.O_WRONLY | os.O_CREATE | os.O_TRUNC)
+	}
+	// The previous backup can't be moved while it's being compressed. This only waits if rotations come faster
+	// than a file can be compressed.
+	l.compressing.Wait()
+	for _, name := range l.backupNames(l.maxBackups) {
+		os.Remove(name)
+	}
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		// Backups that failed to compress are kept uncompressed, and shifted along like the rest
+		next := l.backupNames(i + 1)
+		for j, name := range l.backupNames(i) {
+			if err := os.Rename(name, next[j]); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	first := fmt.Sprintf("%s.1", l.path)
+	if err := l.renameCurrent(first); err != nil {
+		return err
+	}
+	if err := l.open(os.O_WRONLY | os.O_CREATE | os.O_APPEND); err != nil {
+		return err
+	}
+	if l.compress {
+		l.compressing.Add(1)
+		go func() {
+			defer l.compressing.Done()
+			if err := compressFile(first, first+".gz"); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to compress log file %s: %s\n", first, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// renameCurrent moves the open log file to a new name, after which it's still written to until the next one is
+// opened. Windows can't rename an open file, so there it's closed first, and opened again by its old name if it
+// still can't be moved.
+func (l *logFile) renameCurrent(name string) error {
+	err := os.Rename(l.path, name)
+	if err == nil || runtime.GOOS != "windows" {
+		return err
+	}
+	l.file.Close()
+	if err = os.Rename(l.path, name); err != nil {
+		l.open(os.O_WRONLY | os.O_CREATE | os.O_APPEND)
+	}
+	return err
+}
+
+// backupNames returns the possible names of the i-th backup: uncompressed, and compressed if compression is on
+func (l *logFile) backupNames(i int) []string {
+	name := fmt.Sprintf("%s.%d", l.path, i)
+	if l.compress {
+		return []string{name, name + ".gz"}
+	}
+	return []string{name}
+}
+
+func compressFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Keep the uncompressed file rather than a partial compressed one
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// reopenOnSignal reopens the log files whenever the process gets SIGUSR1. It does nothing on platforms
+// without that signal.
+func reopenOnSignal(files []*logFile) {
+	if len(files) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	if !notifyReopen(signals) {
+		return
+	}
+	go func() {
+		for range signals {
+			for _, f := range files {
+				if err := f.Reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reopen log file %s: %s\n", f.path, err)
+				}
+			}
+		}
+	}()
+}
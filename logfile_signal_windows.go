@@ -0,0 +1,10 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import "os"
+
+func notifyReopen(c chan<- os.Signal) bool {
+	return false
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readLogFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	checkNoError(t, err)
+	return string(data)
+}
+
+func TestLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	t.Run("Appends by default", func(t *testing.T) {
+		checkNoError(t, ioutil.WriteFile(path, []byte("before restart\n"), 0644))
+		f, err := openLogFile(LogConfig{File: path})
+		checkNoError(t, err)
+		f.Write([]byte("after restart\n"))
+		assertEqual(t, "before restart\nafter restart\n", readLogFile(t, path))
+
+		f, err = openLogFile(LogConfig{File: path, Truncate: true})
+		checkNoError(t, err)
+		f.Write([]byte("truncated\n"))
+		assertEqual(t, "truncated\n", readLogFile(t, path))
+		os.Remove(path)
+	})
+
+	t.Run("Rotates by size", func(t *testing.T) {
+		f, err := openLogFile(LogConfig{File: path, MaxSize: 10, MaxBackups: 2})
+		checkNoError(t, err)
+		for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+			f.Write([]byte(line))
+		}
+		assertEqual(t, "fourth\n", readLogFile(t, path))
+		assertEqual(t, "third\n", readLogFile(t, path+".1"))
+		assertEqual(t, "second\n", readLogFile(t, path+".2"))
+		if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+			t.Errorf("Expected only 2 backups to be kept")
+		}
+	})
+
+	t.Run("Rotates by age with compression", func(t *testing.T) {
+		compressed := filepath.Join(dir, "proxy.log")
+		f, err := openLogFile(LogConfig{File: compressed, MaxAge: time.Hour, MaxBackups: 1, Compress: true})
+		checkNoError(t, err)
+		f.Write([]byte("old\n"))
+		f.openedAt = time.Now().Add(-2 * time.Hour)
+		f.Write([]byte("new\n"))
+		assertEqual(t, "new\n", readLogFile(t, compressed))
+		f.compressing.Wait()
+
+		gz, err := os.Open(compressed + ".1.gz")
+		checkNoError(t, err)
+		defer gz.Close()
+		r, err := gzip.NewReader(gz)
+		checkNoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		checkNoError(t, err)
+		assertEqual(t, "old\n", string(data))
+	})
+
+	t.Run("Keeps backups that failed to compress", func(t *testing.T) {
+		compressed := filepath.Join(dir, "uncompressed.log")
+		f, err := openLogFile(LogConfig{File: compressed, MaxSize: 10, MaxBackups: 3, Compress: true})
+		checkNoError(t, err)
+		// A leftover from a compression that failed, which must not be overwritten by the next rotation
+		checkNoError(t, ioutil.WriteFile(compressed+".1", []byte("leftover\n"), 0644))
+		f.Write([]byte("first\n"))
+		f.Write([]byte("second\n"))
+		f.compressing.Wait()
+		assertEqual(t, "leftover\n", readLogFile(t, compressed+".2"))
+		if _, err := os.Stat(compressed + ".1.gz"); err != nil {
+			t.Errorf("Expected the newest backup to be compressed: %s", err)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		reopened := filepath.Join(dir, "reopened.log")
+		f, err := openLogFile(LogConfig{File: reopened})
+		checkNoError(t, err)
+		f.Write([]byte("before\n"))
+		// What logrotate does before signalling
+		checkNoError(t, os.Rename(reopened, reopened+".moved"))
+		checkNoError(t, f.Reopen())
+		f.Write([]byte("after\n"))
+		assertEqual(t, "before\n", readLogFile(t, reopened+".moved"))
+		assertEqual(t, "after\n", readLogFile(t, reopened))
+	})
+
+	t.Run("Keeps logging when rotation fails", func(t *testing.T) {
+		failing := filepath.Join(dir, "failing.log")
+		// The first backup can't be replaced by a file, or removed to make room for one
+		checkNoError(t, os.MkdirAll(filepath.Join(failing+".1", "in-the-way"), 0755))
+		f, err := openLogFile(LogConfig{File: failing, MaxSize: 10, MaxBackups: 1})
+		checkNoError(t, err)
+		f.Write([]byte("first\n"))
+		_, err = f.Write([]byte("second\n"))
+		checkNoError(t, err)
+		assertEqual(t, "first\nsecond\n", readLogFile(t, failing))
+
+		// Once the way is clear, the next write rotates
+		checkNoError(t, os.RemoveAll(failing+".1"))
+		f.Write([]byte("third\n"))
+		assertEqual(t, "third\n", readLogFile(t, failing))
+		assertEqual(t, "first\nsecond\n", readLogFile(t, failing+".1"))
+	})
+
+	t.Run("Keeps the moved file when reopening fails", func(t *testing.T) {
+		reopened := filepath.Join(dir, "reopen-fails.log")
+		f, err := openLogFile(LogConfig{File: reopened})
+		checkNoError(t, err)
+		checkNoError(t, os.Rename(reopened, reopened+".moved"))
+		checkNoError(t, os.Mkdir(reopened, 0755))
+		if err := f.Reopen(); err == nil {
+			t.Error("Expected reopening over a directory to fail")
+		}
+		_, err = f.Write([]byte("still logged\n"))
+		checkNoError(t, err)
+		assertEqual(t, "still logged\n", readLogFile(t, reopened+".moved"))
+	})
+
+	t.Run("Rotation needs a file", func(t *testing.T) {
+		_, err := unmarshalAndValidate([]byte("accessLog:\n  maxSize: 1048576\n"))
+		assertError(t, "The access log can only be rotated when it goes to a file", err)
+	})
+}
@@ -0,0 +1,263 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	defaultResponseBuckets = []float64{10, 100, 500, 1000, 5000, 10000}
+	defaultPhaseBuckets    = []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+	defaultDNSBuckets      = []float64{1, 5, 10, 50, 100, 500, 1000, 5000}
+)
+
+// The metrics are created with the default settings, so they can be used without setupMetrics, and created
+// again by setupMetrics with the configured namespace and buckets before they're registered
+var (
+	connsGauge           *prometheus.GaugeVec
+	responseHistogram    *prometheus.HistogramVec
+	requestsCounter      *prometheus.CounterVec
+	requestBytesCounter  *prometheus.CounterVec
+	responseBytesCounter *prometheus.CounterVec
+	tlsHandshakeCounter  *prometheus.CounterVec
+	outboundConnsCounter *prometheus.CounterVec
+	phaseHistogram       *prometheus.HistogramVec
+	dnsCacheCounter      *prometheus.CounterVec
+	dnsLookupHistogram   prometheus.Histogram
+	destinations         *destinationLabeler
+)
+
+func init() {
+	createMetrics(MetricsConfig{})
+}
+
+func createMetrics(config MetricsConfig) {
+	namespace := config.Namespace
+	buckets := func(configured []float64, defaults []float64) []float64 {
+		if len(configured) > 0 {
+			return configured
+		}
+		return defaults
+	}
+	connsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "current_inbound_connections",
+		Help:      "The number of current inbound proxy connections",
+	}, []string{"listener"})
+	responseHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "responses",
+		Help:      "Response time histogram",
+		Buckets:   buckets(config.ResponseBuckets, defaultResponseBuckets),
+	}, []string{"error_code", "tenant"})
+	requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "The number of proxied HTTP requests, by status class of the response and reason code if the proxy rejected them",
+	}, []string{"listener", "tenant", "destination", "status_class", "reason_code"})
+	requestBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "request_bytes_total",
+		Help:      "The number of request body bytes sent to targets",
+	}, []string{"listener", "tenant", "destination"})
+	responseBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_bytes_total",
+		Help:      "The number of response body bytes sent to clients",
+	}, []string{"listener", "tenant", "destination"})
+	tlsHandshakeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbound_tls_handshakes_total",
+		Help:      "The number of TLS handshakes with targets, by result (success, certificate_error or error)",
+	}, []string{"result"})
+	outboundConnsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbound_connections_total",
+		Help:      "The number of outbound connections used for proxied requests, by whether they were reused from the pool",
+	}, []string{"reused", "tenant"})
+	phaseHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_phases",
+		Help:      "Time taken by each phase of proxied requests in milliseconds",
+		Buckets:   buckets(config.PhaseBuckets, defaultPhaseBuckets),
+	}, []string{"phase", "tenant"})
+	dnsCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dns_cache_lookups_total",
+		Help:      "The number of DNS cache lookups, by result (hit, negative_hit or miss)",
+	}, []string{"result"})
+	dnsLookupHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dns_lookups",
+		Help:      "DNS lookup time histogram in milliseconds, including lookups answered from the cache",
+		Buckets:   buckets(config.DNSBuckets, defaultDNSBuckets),
+	})
+	destinations = newDestinationLabeler(config.Destinations)
+}
+
+// OtherDestinations is the destination label of hosts that don't have a label of their own
+const OtherDestinations = "other"
+
+// defaultRankInterval is how often destinations are ranked if the config doesn't say
+const defaultRankInterval = 10 * time.Minute
+
+// trackedHostsFactor bounds the number of hosts whose requests are counted between rankings, as a multiple of
+// the number of hosts with their own label
+const trackedHostsFactor = 10
+
+// destinationLabeler picks the destination label of a target host. Every label value is a new set of series,
+// so only up to maxHosts hosts get a label of their own, and the rest share OtherDestinations. Hosts get a label
+// while there's room, and every rankInterval only the busiest hosts since the last ranking keep theirs; the
+// series of the others are deleted. Only requests that reached a target count, so requests for hosts that are
+// denied or don't resolve can't take up labels. The label is empty if destination labels aren't enabled.
+type destinationLabeler struct {
+	mu           sync.Mutex
+	enabled      bool
+	maxHosts     int
+	rankInterval time.Duration
+	rankedAt     time.Time
+	labeled      map[string]bool
+	// counts are the requests that reached each host since the last ranking
+	counts map[string]uint64
+	// series are the request metric labels used with each labeled host, so they can be deleted if it loses its label
+	series map[string]map[string]prometheus.Labels
+}
+
+func newDestinationLabeler(config DestinationMetricsConfig) *destinationLabeler {
+	rankInterval := config.RankInterval
+	if rankInterval <= 0 {
+		rankInterval = defaultRankInterval
+	}
+	return &destinationLabeler{
+		enabled:      config.Enabled,
+		maxHosts:     config.MaxHosts,
+		rankInterval: rankInterval,
+		rankedAt:     time.Now(),
+		labeled:      make(map[string]bool),
+		counts:       make(map[string]uint64),
+		series:       make(map[string]map[string]prometheus.Labels),
+	}
+}
+
+// label returns the destination label for a request to host. reachedTarget is whether the request got as far
+// as connecting to the target.
+func (d *destinationLabeler) label(host string, reachedTarget bool) string {
+	if !d.enabled {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.rankedAt) >= d.rankInterval {
+		d.rank()
+	}
+	if reachedTarget {
+		if _, tracked := d.counts[host]; tracked || len(d.counts) < d.maxHosts*trackedHostsFactor {
+			d.counts[host]++
+		}
+		if !d.labeled[host] && len(d.labeled) < d.maxHosts {
+			d.labeled[host] = true
+		}
+	}
+	if d.labeled[host] {
+		return host
+	}
+	return OtherDestinations
+}
+
+// rank keeps the labels of the hosts with the most requests since the last ranking, and deletes the series of
+// the rest
+func (d *destinationLabeler) rank() {
+	hosts := make([]string, 0, len(d.counts))
+	for host := range d.counts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if d.counts[hosts[i]] != d.counts[hosts[j]] {
+			return d.counts[hosts[i]] > d.counts[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+	if len(hosts) > d.maxHosts {
+		hosts = hosts[:d.maxHosts]
+	}
+	labeled := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		labeled[host] = true
+	}
+	for host := range d.labeled {
+		if !labeled[host] {
+			for _, labels := range d.series[host] {
+				deleteDestinationSeries(labels)
+			}
+			delete(d.series, host)
+		}
+	}
+	d.labeled = labeled
+	d.counts = make(map[string]uint64)
+	d.rankedAt = time.Now()
+}
+
+// track remembers the request metric labels used with a destination, so its series can be deleted if it loses
+// its label. If it lost its label since it was picked, they're deleted right away.
+func (d *destinationLabeler) track(destination string, labels prometheus.Labels) {
+	if destination == "" || destination == OtherDestinations {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.labeled[destination] {
+		deleteDestinationSeries(labels)
+		return
+	}
+	key := strings.Join([]string{labels["listener"], labels["tenant"], labels["status_class"], labels["reason_code"]}, "\x00")
+	if d.series[destination] == nil {
+		d.series[destination] = make(map[string]prometheus.Labels)
+	}
+	d.series[destination][key] = labels
+}
+
+// deleteDestinationSeries deletes the series of the request metrics with the given labels
+func deleteDestinationSeries(labels prometheus.Labels) {
+	requestsCounter.Delete(labels)
+	byteLabels := prometheus.Labels{"listener": labels["listener"], "tenant": labels["tenant"], "destination": labels["destination"]}
+	requestBytesCounter.Delete(byteLabels)
+	responseBytesCounter.Delete(byteLabels)
+}
+
+func tlsHandshakeResult(err error) string {
+	// Newer versions of crypto/tls wrap certificate errors
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &invalid) || errors.As(err, &hostname) || errors.As(err, &unknownAuthority) {
+		return "certificate_error"
+	}
+	return "error"
+}
+
+func statusClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// updateMetrics records a proxied request, as logged in the access log, in the request metrics
+func updateMetrics(listener string, host string, e *accessLogEntry) {
+	responseHistogram.With(prometheus.Labels{"error_code": e.reasonCode, "tenant": e.tenant}).Observe(float64(e.responseTime.Milliseconds()))
+	destination := destinations.label(host, e.targetIP != "")
+	requestLabels := prometheus.Labels{"listener": listener, "tenant": e.tenant, "destination": destination,
+		"status_class": statusClass(e.responseCode), "reason_code": e.reasonCode}
+	requestsCounter.With(requestLabels).Inc()
+	labels := prometheus.Labels{"listener": listener, "tenant": e.tenant, "destination": destination}
+	requestBytesCounter.With(labels).Add(float64(e.requestBytes))
+	responseBytesCounter.With(labels).Add(float64(e.responseBytes))
+	destinations.track(destination, requestLabels)
+}
@@ -0,0 +1,127 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue sums the series of a counter that have all of the given labels
+func counterValue(t *testing.T, counter prometheus.Collector, labels map[string]string) float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter)
+	families, err := registry.Gather()
+	checkNoError(t, err)
+	var sum float64
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				sum += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return sum
+}
+
+func TestDestinationLabels(t *testing.T) {
+	labeler := newDestinationLabeler(DestinationMetricsConfig{Enabled: true, MaxHosts: 2})
+	// Requests that never reached a target don't take up a label
+	assertEqual(t, OtherDestinations, labeler.label("denied.example.com", false))
+	assertEqual(t, "a.example.com", labeler.label("a.example.com", true))
+	assertEqual(t, "b.example.com", labeler.label("b.example.com", true))
+	assertEqual(t, OtherDestinations, labeler.label("c.example.com", true))
+	assertEqual(t, "a.example.com", labeler.label("a.example.com", true))
+	assertEqual(t, "a.example.com", labeler.label("a.example.com", false))
+
+	disabled := newDestinationLabeler(DestinationMetricsConfig{MaxHosts: 2})
+	assertEqual(t, "", disabled.label("a.example.com", true))
+}
+
+func TestDestinationRanking(t *testing.T) {
+	defer createMetrics(MetricsConfig{})
+	createMetrics(MetricsConfig{Destinations: DestinationMetricsConfig{Enabled: true, MaxHosts: 2, RankInterval: time.Hour}})
+	request := func(host string) {
+		updateMetrics("listener", host, &accessLogEntry{responseCode: http.StatusOK, targetIP: "192.0.2.1"})
+	}
+	request("a.example.com")
+	request("b.example.com")
+	for i := 0; i < 3; i++ {
+		request("c.example.com")
+	}
+	request("b.example.com")
+	assertEqual(t, float64(1), counterValue(t, requestsCounter, map[string]string{"destination": "a.example.com"}))
+	assertEqual(t, float64(3), counterValue(t, requestsCounter, map[string]string{"destination": OtherDestinations}))
+
+	// c.example.com is now one of the two busiest hosts, so it takes over a.example.com's label
+	destinations.rankedAt = time.Now().Add(-2 * time.Hour)
+	request("c.example.com")
+	assertEqual(t, float64(1), counterValue(t, requestsCounter, map[string]string{"destination": "c.example.com"}))
+	assertEqual(t, float64(2), counterValue(t, requestsCounter, map[string]string{"destination": "b.example.com"}))
+	assertEqual(t, float64(0), counterValue(t, requestsCounter, map[string]string{"destination": "a.example.com"}))
+	assertEqual(t, float64(0), counterValue(t, responseBytesCounter, map[string]string{"destination": "a.example.com"}))
+	request("a.example.com")
+	assertEqual(t, float64(4), counterValue(t, requestsCounter, map[string]string{"destination": OtherDestinations}))
+}
+
+func TestMetricsConfig(t *testing.T) {
+	defer createMetrics(MetricsConfig{})
+	createMetrics(MetricsConfig{Namespace: "whsentry", ResponseBuckets: []float64{50, 250}})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(responseHistogram)
+	responseHistogram.With(prometheus.Labels{"error_code": "", "tenant": ""}).Observe(100)
+	families, err := registry.Gather()
+	checkNoError(t, err)
+	assertEqual(t, "whsentry_responses", families[0].GetName())
+	assertEqual(t, 2, len(families[0].GetMetric()[0].GetHistogram().GetBucket()))
+
+	_, err = unmarshalAndValidate([]byte("metrics:\n  responseBuckets: [100, 10]\n"))
+	assertError(t, "must be in increasing order", err)
+	_, err = unmarshalAndValidate([]byte("metrics:\n  namespace: web-hooks\n"))
+	assertError(t, "Invalid metrics namespace web-hooks", err)
+	_, err = unmarshalAndValidate([]byte("metrics:\n  destinations:\n    enabled: true\n    rankInterval: 0s\n"))
+	assertError(t, "Destination metrics need a positive rankInterval", err)
+}
+
+func TestRequestMetrics(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t), startTargetHTTPSServerWithInMemoryCert(t, c.serverCert)}
+		},
+	}
+	defer createMetrics(MetricsConfig{})
+	createMetrics(MetricsConfig{Destinations: DestinationMetricsConfig{Enabled: true, MaxHosts: 10}})
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+	checkNoError(t, err)
+	resp.Body.Close()
+	_, err = client.Get("http://localhost:1234/")
+	checkNoError(t, err)
+	// The target's certificate isn't signed by a trusted CA
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/target", httpsTargetServerPort), nil)
+	req.Header.Set("X-WHSentry-TLS", "true")
+	_, err = client.Do(req)
+	checkNoError(t, err)
+
+	listener := proxyHttpAddress
+	assertEqual(t, float64(1), counterValue(t, requestsCounter, map[string]string{"listener": listener, "destination": "localhost", "status_class": "2xx", "reason_code": ""}))
+	assertEqual(t, float64(1), counterValue(t, requestsCounter, map[string]string{"status_class": "4xx", "reason_code": PortNotAllowed}))
+	assertEqual(t, float64(len("Hello from target")), counterValue(t, responseBytesCounter, map[string]string{"destination": "localhost"}))
+	assertEqual(t, float64(1), counterValue(t, tlsHandshakeCounter, map[string]string{"result": "certificate_error"}))
+}
@@ -40,15 +40,35 @@ func NewMitmer() (*Mitmer, error) {
 	return &Mitmer{generatedCertKeyPair: keyPair}, nil
 }
 
-func (m *Mitmer) HandleHttpConnect(requestUUID uuid.UUID, w http.ResponseWriter, r *http.Request) {
+func (m *Mitmer) HandleHttpConnect(requestUUID uuid.UUID, tenant *tenant, w http.ResponseWriter, r *http.Request) {
 	// TODO: think about what context deadlines to set etc
-	outboundConn, err := m.dialContext(context.Background(), "tcp4", r.RequestURI)
+	certAlias := clientCertFor(r, tenant)
+	if err := checkClientCertAlias(certAlias, tenant); err != nil {
+		responseCode, errorCode, errorMsg := mapError(requestUUID, err)
+		sendHTTPError(w, responseCode, errorCode, errorMsg)
+		return
+	}
+	ctx := withEgressPool(withTenant(context.Background(), tenant), r.Header)
+	outboundConn, err := m.dialContext(ctx, "tcp4", r.RequestURI)
 	if err != nil {
 		responseCode, errorCode, errorMsg := mapError(requestUUID, err)
 		sendHTTPError(w, responseCode, errorCode, errorMsg)
 		return
 	}
 	defer outboundConn.Close()
+	if r.ProtoMajor == 2 {
+		// An HTTP/2 CONNECT tunnels over a single stream (RFC 7540 section 8.3), so there is no
+		// connection to hijack; the stream itself carries the TLS bytes
+		w.WriteHeader(http.StatusOK)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Errorf("HTTP/2 response writer does not support flushing\n")
+			return
+		}
+		flusher.Flush()
+		m.doMitm(newH2StreamConn(w, flusher, r), outboundConn, r.URL.Hostname(), certAlias)
+		return
+	}
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Connection hijacking not supported", http.StatusInternalServerError)
@@ -65,10 +85,11 @@ func (m *Mitmer) HandleHttpConnect(requestUUID uuid.UUID, w http.ResponseWriter,
 	bufrw.WriteString("\r\n")
 	bufrw.Flush()
 
-	m.doMitm(inboundConn, outboundConn, r.URL.Hostname())
+	m.doMitm(inboundConn, outboundConn, r.URL.Hostname(), certAlias)
 }
 
-func (m *Mitmer) doMitm(inboundConn net.Conn, outboundConn net.Conn, hostnameInRequest string) {
+// doMitm presents the client certificate with the given alias to the target, or the default one if it's empty
+func (m *Mitmer) doMitm(inboundConn net.Conn, outboundConn net.Conn, hostnameInRequest string, certAlias string) {
 	var remoteHostname string
 	config := &tls.Config{
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
@@ -93,7 +114,7 @@ func (m *Mitmer) doMitm(inboundConn net.Conn, outboundConn net.Conn, hostnameInR
 	}
 	// NOTE: remoteHostname will only be set after the inbound handshake is done, so we can't do
 	// inbound and outbound handshakes in parallel
-	handshakeConn, err := m.doTLSHandshake(outboundConn, remoteHostname, "default")
+	handshakeConn, err := m.doTLSHandshake(outboundConn, remoteHostname, certAlias)
 	if err != nil {
 		log.Errorf("TLS Handshake failed on outbound connection: %s\n", err)
 		return
@@ -112,6 +133,52 @@ func (m *Mitmer) doMitm(inboundConn net.Conn, outboundConn net.Conn, hostnameInR
 	wg.Wait()
 }
 
+// h2StreamConn adapts an HTTP/2 CONNECT stream to a net.Conn: reads come from the request body and
+// writes go to the response, flushed immediately so the TLS handshake isn't stuck in a buffer.
+// Deadlines aren't supported on a stream, and are ignored.
+type h2StreamConn struct {
+	w          io.Writer
+	flusher    http.Flusher
+	body       io.ReadCloser
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func newH2StreamConn(w http.ResponseWriter, flusher http.Flusher, r *http.Request) *h2StreamConn {
+	conn := &h2StreamConn{w: w, flusher: flusher, body: r.Body, localAddr: streamAddr(""), remoteAddr: streamAddr(r.RemoteAddr)}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.localAddr = addr
+	}
+	return conn
+}
+
+func (c *h2StreamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *h2StreamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+func (c *h2StreamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr                { return c.localAddr }
+func (c *h2StreamConn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *h2StreamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
+
 // Heavily inspired by generate_cert.go
 func (m *Mitmer) generateCert(hostname string) (*tls.Certificate, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
@@ -0,0 +1,210 @@
+/**
+* Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type portPolicy struct {
+	allowedPorts map[uint16]bool
+	exceptions   []PortException
+	// within, if set, must also allow a port, e.g. the global policy that a tenant's policy narrows
+	within *portPolicy
+}
+
+func newPortPolicy(allowedPorts []uint16, exceptions []PortException) *portPolicy {
+	if len(allowedPorts) == 0 {
+		// An empty allow list means every port is allowed
+		return nil
+	}
+	allowed := make(map[uint16]bool)
+	for _, port := range allowedPorts {
+		allowed[port] = true
+	}
+	return &portPolicy{allowedPorts: allowed, exceptions: exceptions}
+}
+
+// checkPort returns a proxyError if connecting to the given host and port is not allowed
+func (p *portPolicy) checkPort(host string, portStr string) error {
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Invalid port %s", portStr), errorCode: InvalidRequestURI}
+	}
+	if p == nil || p.isAllowed(host, uint16(port)) {
+		return nil
+	}
+	return &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Port %d is not allowed", port), errorCode: PortNotAllowed}
+}
+
+func (p *portPolicy) isAllowed(host string, port uint16) bool {
+	if p.within != nil && !p.within.isAllowed(host, port) {
+		return false
+	}
+	if p.allowedPorts[port] {
+		return true
+	}
+	for _, exception := range p.exceptions {
+		if !exception.Host.Matches(host) {
+			continue
+		}
+		for _, exceptionPort := range exception.Ports {
+			if exceptionPort == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canonicalHost validates the host of a target address and returns it in canonical form, so that the
+// hostname rules and CIDR checks can't be sidestepped by spelling the same host differently. A single
+// trailing dot is removed, and IP literals other than IPv4 dotted decimal are rejected: decimal, octal and
+// hex IPv4 forms like 2130706433, 0177.0.0.1 or 0x7f.1, as well as IPv4-mapped IPv6 like ::ffff:127.0.0.1.
+// These are accepted by some resolvers (like inet_aton), but no legitimate webhook URL needs them.
+func canonicalHost(host string) (string, error) {
+	canonical := strings.ToLower(strings.TrimSuffix(host, "."))
+	if canonical == "" || strings.HasSuffix(canonical, ".") || strings.Contains(canonical, "..") {
+		return "", invalidHostError(host, "empty label")
+	}
+	if strings.Contains(canonical, ":") {
+		ip := net.ParseIP(canonical)
+		if ip == nil {
+			return "", invalidHostError(host, "malformed IPv6 address")
+		}
+		if ip.To4() != nil {
+			return "", invalidHostError(host, "IPv4-mapped IPv6 address")
+		}
+		return canonical, nil
+	}
+	labels := strings.Split(canonical, ".")
+	if isNumericLabel(labels[len(labels)-1]) {
+		// Hosts ending in a number are interpreted as IPv4 addresses by URL parsers, so only allow
+		// the canonical dotted decimal form. net.ParseIP rejects leading zeros, which could be octal.
+		ip := net.ParseIP(canonical)
+		if ip == nil || ip.To4() == nil || len(labels) != 4 {
+			return "", invalidHostError(host, "non-standard IPv4 address encoding")
+		}
+	}
+	return canonical, nil
+}
+
+// isNumericLabel reports whether a host label is a decimal, octal or hex number
+func isNumericLabel(label string) bool {
+	if strings.HasPrefix(label, "0x") {
+		label = label[2:]
+		for _, c := range label {
+			if !strings.ContainsRune("0123456789abcdef", c) {
+				return false
+			}
+		}
+		return true
+	}
+	if label == "" {
+		return false
+	}
+	for _, c := range label {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func invalidHostError(host string, reason string) error {
+	return &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Invalid host %s: %s", host, reason), errorCode: InvalidHostname}
+}
+
+// clientPolicy limits the clients a listener serves by address. The address is the connection's remote address,
+// which is the one from the PROXY protocol header on listeners that accept it.
+type clientPolicy struct {
+	allowed []net.IPNet
+}
+
+func newClientPolicy(allowedCidrs []Cidr) *clientPolicy {
+	if len(allowedCidrs) == 0 {
+		return nil
+	}
+	policy := &clientPolicy{}
+	for _, cidr := range allowedCidrs {
+		policy.allowed = append(policy.allowed, net.IPNet(cidr))
+	}
+	return policy
+}
+
+// checkClient returns a proxyError if the client isn't allowed. Clients on a Unix socket that didn't send a
+// PROXY protocol header have no IP address; they're on the same host, so they're always allowed.
+func (c *clientPolicy) checkClient(remoteAddr string) error {
+	if c == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, cidr := range c.allowed {
+		if cidr.Contains(ip) {
+			return nil
+		}
+	}
+	return &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Client %s is not allowed on this listener", host), errorCode: ClientNotAllowed}
+}
+
+type hostPolicy struct {
+	denyList  []HostPattern
+	allowList []HostPattern
+	// within, if set, must also allow a host, e.g. the global policy that a tenant's policy narrows
+	within *hostPolicy
+}
+
+// checkHost returns a proxyError if the hostname is denied, or if there is an allow list and the
+// hostname is not on it. This is evaluated on the name in the request before it is resolved.
+func (h *hostPolicy) checkHost(host string) error {
+	if h.within != nil {
+		if err := h.within.checkHost(host); err != nil {
+			return err
+		}
+	}
+	if pattern, ok := matchAny(h.denyList, host); ok {
+		return &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Host %s is blocked by rule %s", host, pattern), errorCode: BlockedHostname}
+	}
+	if len(h.allowList) > 0 {
+		if _, ok := matchAny(h.allowList, host); !ok {
+			return &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Host %s is not in the allow list", host), errorCode: HostnameNotAllowed}
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []HostPattern, host string) (HostPattern, bool) {
+	for _, pattern := range patterns {
+		if pattern.Matches(host) {
+			return pattern, true
+		}
+	}
+	return HostPattern{}, false
+}
+
+// Matches reports whether host matches the pattern
+func (h HostPattern) Matches(host string) bool {
+	host = strings.ToLower(host)
+	if h.regex != nil {
+		return h.regex.MatchString(host)
+	}
+	if strings.HasPrefix(h.pattern, "*.") {
+		return strings.HasSuffix(host, h.pattern[1:])
+	}
+	if strings.HasPrefix(h.pattern, ".") {
+		return host == h.pattern[1:] || strings.HasSuffix(host, h.pattern)
+	}
+	return host == h.pattern
+}
@@ -0,0 +1,142 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"testing"
+)
+
+func mustParseHostPattern(t *testing.T, pattern string) HostPattern {
+	h, err := ParseHostPattern(pattern)
+	checkNoError(t, err)
+	return h
+}
+
+func TestHostPatternMatches(t *testing.T) {
+	t.Run("Exact match", func(t *testing.T) {
+		pattern := mustParseHostPattern(t, "example.com")
+		assertEqual(t, true, pattern.Matches("example.com"))
+		assertEqual(t, true, pattern.Matches("EXAMPLE.com"))
+		assertEqual(t, false, pattern.Matches("www.example.com"))
+	})
+
+	t.Run("Wildcard match", func(t *testing.T) {
+		pattern := mustParseHostPattern(t, "*.example.com")
+		assertEqual(t, true, pattern.Matches("www.example.com"))
+		assertEqual(t, true, pattern.Matches("a.b.example.com"))
+		assertEqual(t, false, pattern.Matches("example.com"))
+		assertEqual(t, false, pattern.Matches("badexample.com"))
+	})
+
+	t.Run("Suffix match", func(t *testing.T) {
+		pattern := mustParseHostPattern(t, ".example.com")
+		assertEqual(t, true, pattern.Matches("example.com"))
+		assertEqual(t, true, pattern.Matches("www.example.com"))
+		assertEqual(t, false, pattern.Matches("badexample.com"))
+	})
+
+	t.Run("Regex match", func(t *testing.T) {
+		pattern := mustParseHostPattern(t, `~^hooks-[0-9]+\.example\.com$`)
+		assertEqual(t, true, pattern.Matches("hooks-12.example.com"))
+		assertEqual(t, false, pattern.Matches("hooks-a.example.com"))
+	})
+
+	t.Run("Invalid regex", func(t *testing.T) {
+		_, err := ParseHostPattern("~[a-")
+		assertError(t, "Invalid host pattern", err)
+	})
+}
+
+func TestHostPolicy(t *testing.T) {
+	t.Run("Deny list", func(t *testing.T) {
+		policy := &hostPolicy{denyList: []HostPattern{mustParseHostPattern(t, "metadata.google.internal")}}
+		err := policy.checkHost("metadata.google.internal")
+		assertError(t, "is blocked", err)
+		assertEqual(t, BlockedHostname, err.(*proxyError).errorCode)
+		checkNoError(t, policy.checkHost("example.com"))
+	})
+
+	t.Run("Allow list", func(t *testing.T) {
+		policy := &hostPolicy{allowList: []HostPattern{mustParseHostPattern(t, ".customer.com")}}
+		checkNoError(t, policy.checkHost("hooks.customer.com"))
+		err := policy.checkHost("example.com")
+		assertError(t, "not in the allow list", err)
+		assertEqual(t, HostnameNotAllowed, err.(*proxyError).errorCode)
+	})
+
+	t.Run("Deny list takes precedence over allow list", func(t *testing.T) {
+		policy := &hostPolicy{
+			denyList:  []HostPattern{mustParseHostPattern(t, "internal.customer.com")},
+			allowList: []HostPattern{mustParseHostPattern(t, ".customer.com")},
+		}
+		err := policy.checkHost("internal.customer.com")
+		assertEqual(t, BlockedHostname, err.(*proxyError).errorCode)
+	})
+}
+
+func TestPortPolicy(t *testing.T) {
+	policy := newPortPolicy([]uint16{80, 443}, []PortException{{Host: mustParseHostPattern(t, "*.example.com"), Ports: []uint16{8000}}})
+
+	t.Run("Allowed port", func(t *testing.T) {
+		checkNoError(t, policy.checkPort("foo.com", "443"))
+	})
+
+	t.Run("Disallowed port", func(t *testing.T) {
+		err := policy.checkPort("foo.com", "22")
+		assertError(t, "Port 22 is not allowed", err)
+		assertEqual(t, PortNotAllowed, err.(*proxyError).errorCode)
+	})
+
+	t.Run("Port allowed by exception", func(t *testing.T) {
+		checkNoError(t, policy.checkPort("api.example.com", "8000"))
+		assertError(t, "Port 8000 is not allowed", policy.checkPort("foo.com", "8000"))
+	})
+
+	t.Run("Empty allow list allows every port", func(t *testing.T) {
+		checkNoError(t, newPortPolicy(nil, nil).checkPort("foo.com", "6379"))
+	})
+}
+
+func TestCanonicalHost(t *testing.T) {
+	valid := map[string]string{
+		"example.com":        "example.com",
+		"Example.COM.":       "example.com",
+		"203.0.113.10":       "203.0.113.10",
+		"203.0.113.10.":      "203.0.113.10",
+		"2001:db8::1":        "2001:db8::1",
+		"hooks-1.example.io": "hooks-1.example.io",
+		"0x.example.com":     "0x.example.com",
+	}
+	for host, expected := range valid {
+		canonical, err := canonicalHost(host)
+		checkNoError(t, err)
+		assertEqual(t, expected, canonical)
+	}
+
+	invalid := map[string]string{
+		"2130706433":         "non-standard IPv4 address encoding",
+		"0177.0.0.1":         "non-standard IPv4 address encoding",
+		"0x7f.0.0.1":         "non-standard IPv4 address encoding",
+		"0x7f000001":         "non-standard IPv4 address encoding",
+		"127.1":              "non-standard IPv4 address encoding",
+		"127.0.1":            "non-standard IPv4 address encoding",
+		"127.0.0.01":         "non-standard IPv4 address encoding",
+		"1.2.3.4.5":          "non-standard IPv4 address encoding",
+		"example.0x10":       "non-standard IPv4 address encoding",
+		"::ffff:127.0.0.1":   "IPv4-mapped IPv6 address",
+		"::ffff:7f00:1":      "IPv4-mapped IPv6 address",
+		"localhost..":        "empty label",
+		"metadata..internal": "empty label",
+		".":                  "empty label",
+		"fe80::1::2":         "malformed IPv6 address",
+	}
+	for host, reason := range invalid {
+		_, err := canonicalHost(host)
+		if err == nil {
+			t.Fatalf("Expected host %s to be rejected", host)
+		}
+		assertError(t, reason, err)
+		assertEqual(t, InvalidHostname, err.(*proxyError).errorCode)
+	}
+}
@@ -0,0 +1,90 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+func newOutboundTransport(sd *safeDialer, config KeepAliveConfig, keepAlive bool) *http.Transport {
+	return &http.Transport{
+		Proxy:               nil,
+		IdleConnTimeout:     config.IdleConnTimeout,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		DisableKeepAlives:   !keepAlive,
+		DisableCompression:  true,
+		ForceAttemptHTTP2:   len(sd.nextProtos) > 0,
+		DialContext:         sd.DialContext,
+		DialTLSContext:      sd.DialTLSContext,
+	}
+}
+
+// certAwareTransport keeps a separate connection pool per client certificate alias, requested egress pool and
+// tenant. http.Transport pools connections by scheme and address only, so otherwise a connection set up with
+// one client certificate or source address, or checked against one tenant's policies, could be reused for a
+// request that asked for another.
+//
+// Pooled connections stay bound to the IP that the safeDialer validated when it dialed them.
+type certAwareTransport struct {
+	newTransport func(keepAlive bool) *http.Transport
+	clientCerts  map[string]bool
+	egressPools  *egressPools
+	// noKeepAlive is used for unknown aliases and egress pools, so every request dials and fails the lookup
+	// instead of picking up a pooled connection
+	noKeepAlive *http.Transport
+	mu          sync.Mutex
+	transports  map[transportKey]*http.Transport
+}
+
+type transportKey struct {
+	certAlias  string
+	egressPool string
+	tenant     string
+}
+
+func newCertAwareTransport(sd *safeDialer, config KeepAliveConfig) *certAwareTransport {
+	clientCerts := make(map[string]bool)
+	for alias := range sd.clientCerts {
+		clientCerts[alias] = true
+	}
+	newTransport := func(keepAlive bool) *http.Transport {
+		return newOutboundTransport(sd, config, keepAlive)
+	}
+	return &certAwareTransport{
+		newTransport: newTransport,
+		clientCerts:  clientCerts,
+		egressPools:  sd.egressPools,
+		noKeepAlive:  newTransport(false),
+		transports:   make(map[transportKey]*http.Transport),
+	}
+}
+
+func (c *certAwareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	certAlias, _ := req.Context().Value(clientCertKey).(string)
+	egressPool, _ := req.Context().Value(egressPoolKey).(string)
+	key := transportKey{certAlias: certAlias, egressPool: egressPool}
+	if t, ok := req.Context().Value(tenantKey).(*tenant); ok {
+		key.tenant = t.name
+	}
+	return c.transportFor(key).RoundTrip(req)
+}
+
+func (c *certAwareTransport) transportFor(key transportKey) *http.Transport {
+	if key.certAlias != "" && !c.clientCerts[key.certAlias] {
+		return c.noKeepAlive
+	}
+	if key.egressPool != "" && !c.egressPools.has(key.egressPool) {
+		return c.noKeepAlive
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	transport, ok := c.transports[key]
+	if !ok {
+		transport = c.newTransport(true)
+		c.transports[key] = transport
+	}
+	return transport
+}
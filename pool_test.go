@@ -0,0 +1,39 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestCertAwareTransport(t *testing.T) {
+	config := NewDefaultConfig()
+	config.ClientCerts = map[string]tls.Certificate{"default": {}, "customer-a": {}}
+	config.EgressPools = []EgressPoolConfig{{Name: "customer-a", Addresses: []string{"127.0.0.2"}}}
+	transport := newCertAwareTransport(newSafeDialer(config), config.OutboundKeepAlive)
+
+	t.Run("Same alias shares a pool", func(t *testing.T) {
+		assertEqual(t, transport.transportFor(transportKey{certAlias: "customer-a"}), transport.transportFor(transportKey{certAlias: "customer-a"}))
+		assertEqual(t, transport.transportFor(transportKey{}), transport.transportFor(transportKey{}))
+	})
+
+	t.Run("Different aliases get different pools", func(t *testing.T) {
+		if transport.transportFor(transportKey{certAlias: "customer-a"}) == transport.transportFor(transportKey{}) {
+			t.Error("Expected separate connection pools for different client cert aliases")
+		}
+	})
+
+	t.Run("Different egress pools get different pools", func(t *testing.T) {
+		if transport.transportFor(transportKey{egressPool: "customer-a"}) == transport.transportFor(transportKey{}) {
+			t.Error("Expected separate connection pools for different egress pools")
+		}
+	})
+
+	t.Run("Unknown alias or egress pool is never pooled", func(t *testing.T) {
+		assertEqual(t, true, transport.transportFor(transportKey{certAlias: "unknown"}).DisableKeepAlives)
+		assertEqual(t, true, transport.transportFor(transportKey{egressPool: "unknown"}).DisableKeepAlives)
+		assertEqual(t, 3, len(transport.transports))
+	})
+}
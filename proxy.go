@@ -4,47 +4,48 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-var skipHeaders = []string{"Connection", "Proxy-Connection", "User-Agent"}
+// Keep-Alive and Upgrade are hop-by-hop headers, and must not be sent to HTTP/2 targets
+var skipHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Upgrade", "User-Agent"}
 
 var accessLog = logrus.New()
 var log = logrus.New()
 
-var (
-	connsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "current_inbound_connections",
-		Help: "The number of current inbound proxy connections",
-	}, []string{"listener"})
-)
-
-var (
-	responseHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    "responses",
-		Help:    "Response time histogram",
-		Buckets: []float64{10, 100, 500, 1000, 5000, 10000},
-	}, []string{"error_code"})
-)
-
 const (
 	ReasonCodeHeader string = "X-WhSentry-ReasonCode"
 	ReasonHeader     string = "X-WhSentry-Reason"
+	// RequestIDHeader carries the request's UUID back to the client. A client can also send it to have the
+	// proxy use its own ID for the request.
+	RequestIDHeader string = "X-WhSentry-Request-Id"
+	// TruncatedTrailer is sent as a trailer when the response body was cut off at the maximum size
+	TruncatedTrailer string = "X-WhSentry-Truncated"
 
 	BlockedIPAddress           string = "1000"
 	UnableToResolveIP          string = "1001"
@@ -57,9 +58,25 @@ const (
 	ResponseTooLarge           string = "1008"
 	InternalServerError        string = "1009"
 	ClientCertNotFoundError    string = "1010"
+	PortNotAllowed             string = "1011"
+	BlockedHostname            string = "1012"
+	HostnameNotAllowed         string = "1013"
+	InvalidHostname            string = "1014"
+	UpstreamProxyConnectError  string = "1015"
+	UpstreamProxyAuthError     string = "1016"
+	UpstreamProxyRejected      string = "1017"
+	EgressPoolNotFound         string = "1018"
+	TenantNotFound             string = "1019"
+	TenantNotAllowed           string = "1020"
+	RequestTooLarge            string = "1021"
+	ProxyAuthRequired          string = "1022"
+	ClientNotAllowed           string = "1023"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCommand(os.Args[2:], os.Stdout))
+	}
 	var config *ProxyConfig
 	var err error
 	if len(os.Args) > 1 {
@@ -77,43 +94,102 @@ func main() {
 		log.Fatalf("Failed to configure logging: %s\n", err)
 	}
 
-	setupMetrics(config.MetricsAddress)
+	setupMetrics(config.MetricsAddress, config.Metrics)
 
 	fmt.Print(banner)
 
-	proxyServers := CreateProxyServers(config)
+	sd := newSafeDialer(config)
+	proxyServers, closers := createProxyServers(config, sd)
+	socks5Servers := CreateSocks5Servers(config, sd)
 	wg := &sync.WaitGroup{}
-	for i, proxyServer := range proxyServers {
+	httpServers, socksServers := proxyServers, socks5Servers
+	for _, listenerConfig := range config.Listeners {
 		wg.Add(1)
-		listenerConfig := config.Listeners[i]
-		if listenerConfig.Type == HTTP {
-			startHTTPServer(listenerConfig.Address, proxyServer, wg)
-		} else {
-			startTLSServer(listenerConfig.Address, listenerConfig.CertFile, listenerConfig.KeyFile, proxyServer, wg)
+		switch listenerConfig.Type {
+		case HTTP:
+			startHTTPServer(listenerConfig, httpServers[0], wg)
+			httpServers = httpServers[1:]
+		case HTTPS:
+			startTLSServer(listenerConfig, httpServers[0], wg)
+			httpServers = httpServers[1:]
+		case SOCKS5:
+			startSocks5Server(listenerConfig, socksServers[0], wg)
+			socksServers = socksServers[1:]
 		}
 	}
+	shutdownOnSignal(proxyServers, socks5Servers, closers)
 	wg.Wait()
 }
 
+// shutdownTimeout is how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then stops the servers and closes what they share, like the
+// delivery receipt queue, so that nothing already queued is lost
+func shutdownOnSignal(proxyServers []*http.Server, socks5Servers []*Socks5Server, closers []io.Closer) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	log.Infof("Shutting down\n")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range proxyServers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Failed to shut down proxy server %s: %s\n", server.Addr, err)
+		}
+	}
+	for _, server := range socks5Servers {
+		server.Close()
+	}
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			log.Warnf("Error during shutdown: %s\n", err)
+		}
+	}
+}
+
 func setupLogging(config *ProxyConfig) error {
-	if err := configureLog(accessLog, config.AccessLog, &AccessLogTextFormatter{}); err != nil {
+	var files []*logFile
+	accessLogFormatter, err := newAccessLogTextFormatter(config.AccessLog.Template)
+	if err != nil {
+		return err
+	}
+	accessLogFile, err := configureLog(accessLog, config.AccessLog, accessLogFormatter)
+	if err != nil {
 		return err
 	}
-	if err := configureLog(log, config.ProxyLog, &ProxyLogTextFormatter{}); err != nil {
+	proxyLogFile, err := configureLog(log, config.ProxyLog, &ProxyLogTextFormatter{})
+	if err != nil {
 		return err
 	}
+	for _, f := range []*logFile{accessLogFile, proxyLogFile} {
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+	reopenOnSignal(files)
+	if config.AuditLog.File != "" {
+		hook, err := newAuditHook(config.AuditLog)
+		if err != nil {
+			return err
+		}
+		accessLog.AddHook(hook)
+	}
 	return nil
 }
 
-func configureLog(logger *logrus.Logger, logConfig LogConfig, formatter logrus.Formatter) error {
+// configureLog points the logger at its log file, which it returns, or stdout if there's no file
+func configureLog(logger *logrus.Logger, logConfig LogConfig, formatter logrus.Formatter) (*logFile, error) {
+	var f *logFile
 	if logConfig.File != "" {
-		f, err := os.Create(logConfig.File)
+		var err error
+		f, err = openLogFile(logConfig)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		logger.Out = f
+		logger.SetOutput(f)
 	} else {
-		logger.Out = os.Stdout
+		logger.SetOutput(os.Stdout)
 	}
 
 	if logConfig.Type == JSON {
@@ -121,10 +197,11 @@ func configureLog(logger *logrus.Logger, logConfig LogConfig, formatter logrus.F
 	} else {
 		logger.SetFormatter(formatter)
 	}
-	return nil
+	return f, nil
 }
 
-func setupMetrics(metricsAddress string) {
+func setupMetrics(metricsAddress string, config MetricsConfig) {
+	createMetrics(config)
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
 		if err := http.ListenAndServe(metricsAddress, nil); err != http.ErrServerClosed {
@@ -133,10 +210,18 @@ func setupMetrics(metricsAddress string) {
 	}()
 	prometheus.MustRegister(connsGauge)
 	prometheus.MustRegister(responseHistogram)
+	prometheus.MustRegister(dnsCacheCounter)
+	prometheus.MustRegister(dnsLookupHistogram)
+	prometheus.MustRegister(outboundConnsCounter)
+	prometheus.MustRegister(phaseHistogram)
+	prometheus.MustRegister(requestsCounter)
+	prometheus.MustRegister(requestBytesCounter)
+	prometheus.MustRegister(responseBytesCounter)
+	prometheus.MustRegister(tlsHandshakeCounter)
 }
 
-func startHTTPServer(listenAddress string, server *http.Server, wg *sync.WaitGroup) {
-	listener, err := net.Listen("tcp4", listenAddress)
+func startHTTPServer(listenerConfig ListenerConfig, server *http.Server, wg *sync.WaitGroup) {
+	listener, err := listen(listenerConfig)
 	if err != nil {
 		log.Fatalf("Could not start egress proxy HTTP listener: %s\n", err)
 	}
@@ -148,29 +233,44 @@ func startHTTPServer(listenAddress string, server *http.Server, wg *sync.WaitGro
 	}()
 }
 
-func startTLSServer(listenAddress, certFile, keyFile string, server *http.Server, wg *sync.WaitGroup) {
-	listener, err := net.Listen("tcp4", listenAddress)
+func startSocks5Server(listenerConfig ListenerConfig, server *Socks5Server, wg *sync.WaitGroup) {
+	listener, err := listen(listenerConfig)
+	if err != nil {
+		log.Fatalf("Could not start egress proxy SOCKS5 listener: %s\n", err)
+	}
+	go func() {
+		if err := server.Serve(listener); err != ErrSocks5ServerClosed {
+			log.Fatalf("Failed to start proxy SOCKS5 server: %s\n", err)
+		}
+		wg.Done()
+	}()
+}
+
+func startTLSServer(listenerConfig ListenerConfig, server *http.Server, wg *sync.WaitGroup) {
+	listener, err := listen(listenerConfig)
 	if err != nil {
 		log.Fatalf("Could not start egress proxy HTTPS listener: %s\n", err)
 	}
 	go func() {
-		if err := server.ServeTLS(listener, certFile, keyFile); err != http.ErrServerClosed {
+		if err := server.ServeTLS(listener, listenerConfig.CertFile, listenerConfig.KeyFile); err != http.ErrServerClosed {
 			log.Fatalf("Failed to start proxy HTTPS server: %s\n", err)
 		}
 		wg.Done()
 	}()
 }
 
-func CreateProxyServers(proxyConfig *ProxyConfig) []*http.Server {
+// CreateProxyServers returns a server for each HTTP and HTTPS listener, in the order they're configured, and
+// what the servers share that should be closed once they've shut down
+func CreateProxyServers(proxyConfig *ProxyConfig) ([]*http.Server, []io.Closer) {
+	return createProxyServers(proxyConfig, newSafeDialer(proxyConfig))
+}
 
-	sd := newSafeDialer(proxyConfig)
-	transport := &http.Transport{
-		Proxy:              nil,
-		IdleConnTimeout:    time.Duration(20) * time.Second,
-		DisableKeepAlives:  true,
-		DisableCompression: true,
-		DialContext:        sd.DialContext,
-		DialTLSContext:     sd.DialTLSContext,
+func createProxyServers(proxyConfig *ProxyConfig, sd *safeDialer) ([]*http.Server, []io.Closer) {
+	var transport http.RoundTripper
+	if proxyConfig.OutboundKeepAlive.Enabled {
+		transport = newCertAwareTransport(sd, proxyConfig.OutboundKeepAlive)
+	} else {
+		transport = newOutboundTransport(sd, proxyConfig.OutboundKeepAlive, false)
 	}
 
 	var mitmer *Mitmer
@@ -190,71 +290,199 @@ func CreateProxyServers(proxyConfig *ProxyConfig) []*http.Server {
 		mitmer.issuerCertificate = x509Cert
 	}
 
+	receipts, err := newReceiptRecorder(proxyConfig.DeliveryReceipts, proxyConfig.Tenants)
+	if err != nil {
+		log.Fatalf("Failed to set up delivery receipts: %s\n", err)
+	}
+	tracer, err := newTracer(proxyConfig.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %s\n", err)
+	}
+
 	var proxyServers []*http.Server
 	for _, listenerConfig := range proxyConfig.Listeners {
+		if listenerConfig.Type == SOCKS5 {
+			continue
+		}
 		listenerConnsGauge := connsGauge.With(prometheus.Labels{"listener": listenerConfig.Address})
-		proxyServers = append(proxyServers, newProxyServer(listenerConfig, proxyConfig, sd, transport, mitmer, listenerConnsGauge))
+		proxyServers = append(proxyServers, newProxyServer(listenerConfig, proxyConfig, sd, transport, mitmer, receipts, tracer, listenerConnsGauge))
 	}
-	return proxyServers
+	var closers []io.Closer
+	if receipts != nil {
+		closers = append(closers, receipts)
+	}
+	if tracer != nil {
+		closers = append(closers, tracer)
+	}
+	return proxyServers, closers
 }
 
-func newProxyServer(listenerConfig ListenerConfig, proxyConfig *ProxyConfig, sd *safeDialer, rt http.RoundTripper, mitmer *Mitmer, connsGauge prometheus.Gauge) *http.Server {
+// CreateSocks5Servers returns a server for each SOCKS5 listener, in the order they're configured
+func CreateSocks5Servers(proxyConfig *ProxyConfig, sd *safeDialer) []*Socks5Server {
+	var socks5Servers []*Socks5Server
+	for _, listenerConfig := range proxyConfig.Listeners {
+		if listenerConfig.Type != SOCKS5 {
+			continue
+		}
+		listenerConnsGauge := connsGauge.With(prometheus.Labels{"listener": listenerConfig.Address})
+		socks5Servers = append(socks5Servers, newSocks5Server(listenerConfig, proxyConfig, sd, listenerConnsGauge))
+	}
+	return socks5Servers
+}
+
+func newProxyServer(listenerConfig ListenerConfig, proxyConfig *ProxyConfig, sd *safeDialer, rt http.RoundTripper, mitmer *Mitmer, receipts *receiptRecorder, tracer *tracer, connsGauge prometheus.Gauge) *http.Server {
 	handler := &ProxyHTTPHandler{
-		roundTripper:               rt,
-		outboundConnectionLifetime: proxyConfig.ConnectionLifetime,
-		idleReadTimeout:            proxyConfig.ReadTimeout,
-		maxContentLength:           proxyConfig.MaxResponseBodySize,
-		currentInboundConnsGauge:   connsGauge,
-		mitmer:                     mitmer,
-	}
-	return &http.Server{
+		roundTripper:             rt,
+		tenants:                  sd.tenants,
+		listenerTenant:           listenerConfig.Tenant,
+		allowedTenants:           listenerConfig.AllowedTenants,
+		users:                    listenerConfig.Users,
+		clientPolicy:             newClientPolicy(listenerConfig.AllowedClientCidrs),
+		listener:                 listenerConfig.Address,
+		currentInboundConnsGauge: connsGauge,
+		mitmer:                   mitmer,
+		receipts:                 receipts,
+		tracer:                   tracer,
+		requestIDHeader:          proxyConfig.RequestIDHeader,
+	}
+	server := &http.Server{
 		Addr:           listenerConfig.Address,
 		Handler:        handler,
 		ConnState:      handler.connStateCallback,
 		MaxHeaderBytes: 1 << 20,
 	}
+	if listenerConfig.Type == HTTPS && !listenerConfig.HTTP2 {
+		// ServeTLS offers h2 by default; a non-nil map without it keeps the listener HTTP/1.1 only
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	if listenerConfig.H2C {
+		server.Handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	server.Handler = handler.trackHijacked(server.Handler)
+	return server
 }
 
 // ProxyHTTPHandler some struct
 type ProxyHTTPHandler struct {
-	roundTripper               http.RoundTripper
-	outboundConnectionLifetime time.Duration
-	idleReadTimeout            time.Duration
-	currentInboundConnsGauge   prometheus.Gauge
-	maxContentLength           uint32
-	mitmer                     *Mitmer
+	roundTripper             http.RoundTripper
+	tenants                  *tenants
+	listenerTenant           string
+	allowedTenants           []string
+	users                    map[string]string
+	clientPolicy             *clientPolicy
+	listener                 string
+	currentInboundConnsGauge prometheus.Gauge
+	mitmer                   *Mitmer
+	receipts                 *receiptRecorder
+	tracer                   *tracer
+	requestIDHeader          string
 }
 
 func (p *ProxyHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	requestUUID := uuid.New()
+	requestUUID := requestIDFor(r)
+	w.Header().Set(RequestIDHeader, requestUUID.String())
+	toAbsoluteForm(r)
+	entry := newAccessLogEntry(r, requestUUID)
+	traceCtx, span := p.tracer.startRequestSpan(r.Context(), r, requestUUID)
+	defer span.finish()
+	var tenant *tenant
+	var identity string
+	err := p.clientPolicy.checkClient(r.RemoteAddr)
+	if err == nil {
+		identity, err = p.authenticate(r)
+	}
+	if err == nil {
+		tenant, err = p.tenants.resolve(p.listenerTenant, p.allowedTenants, identity, r.Header.Get(TenantHeader))
+	}
+	if err != nil {
+		responseCode, errorCode, errorMessage := mapError(requestUUID, err)
+		if responseCode == http.StatusProxyAuthRequired {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="webhook-sentry"`)
+		}
+		sendHTTPError(w, responseCode, errorCode, errorMessage)
+		entry.responseCode, entry.reasonCode = responseCode, errorCode
+		entry.annotateSpan(span)
+		logRequest(entry)
+		updateMetrics(p.listener, r.URL.Hostname(), entry)
+		if p.receipts != nil {
+			p.receipts.record(r, requestUUID, "", "", nil, nil, responseCode, errorCode, 0)
+		}
+		return
+	}
 	if r.Method == http.MethodConnect {
 		// We only allow CONNECT if we have a configured MITM issuer certificate
 		if p.mitmer == nil {
 			http.Error(w, "CONNECT method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		p.mitmer.HandleHttpConnect(requestUUID, w, r)
+		p.mitmer.HandleHttpConnect(requestUUID, tenant, w, r)
 	} else {
-		ctx, cancel := context.WithTimeout(context.TODO(), p.outboundConnectionLifetime)
+		ctx, cancel := context.WithTimeout(withTenant(traceCtx, tenant), tenant.connectionLifetime)
 		defer cancel()
+		entry.tenant = tenant.name
+		entry.clientCert = clientCertFor(r, tenant)
+		ctx, timings := withPhaseTimings(ctx)
 		start := time.Now()
-		resp, err := p.doProxy(ctx, r)
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			// The dialer may try several resolved IPs, so record the one we actually connected to
+			GotConn: func(info httptrace.GotConnInfo) {
+				entry.targetIP, _, _ = net.SplitHostPort(info.Conn.RemoteAddr().String())
+				entry.sourceIP = outboundSourceIP(info.Conn)
+				outboundConnsCounter.With(prometheus.Labels{"reused": strconv.FormatBool(info.Reused), "tenant": tenant.name}).Inc()
+			},
+		})
+		requestBody := &countingReader{ReadCloser: r.Body}
+		r.Body = requestBody
+		resp, err := p.doProxy(ctx, requestUUID, tenant, r)
 		if resp != nil {
 			defer resp.Body.Close()
 		}
 		var responseCode int
 		var errorCode string
 		var errorMessage string
+		var abort bool
+		responseBody := &countingWriter{Writer: w}
+		var body io.Writer = responseBody
+		var capture *bodyCapture
+		if p.receipts != nil {
+			capture = p.receipts.newCapture()
+			body = io.MultiWriter(responseBody, capture)
+		}
 		if err != nil {
 			responseCode, errorCode, errorMessage = mapError(requestUUID, err)
-		} else if resp.ContentLength > 0 && uint32(resp.ContentLength) > p.maxContentLength {
+		} else if resp.ContentLength > 0 && uint32(resp.ContentLength) > tenant.maxResponseBodySize {
 			responseCode = http.StatusBadGateway
 			errorCode = ResponseTooLarge
 			errorMessage = "Response exceeds max content length"
+		} else if resp.ContentLength < 0 && tenant.responseOverflowMode == Buffer {
+			transferStart := time.Now()
+			_, streamSpan := startSpan(ctx, "stream response")
+			buffered, err := bufferResponseBody(requestUUID, tenant, resp, cancel)
+			streamSpan.finishWithError(err)
+			recordPhase(ctx, transferPhase, transferStart)
+			if err != nil {
+				responseCode, errorCode, errorMessage = mapError(requestUUID, err)
+			} else {
+				responseCode = resp.StatusCode
+				resp.TransferEncoding = nil
+				w.Header().Set("Content-Length", strconv.Itoa(len(buffered)))
+				writeResponseHeaders(w, resp)
+				body.Write(buffered)
+			}
 		} else {
 			responseCode = resp.StatusCode
 			writeResponseHeaders(w, resp)
-			p.writeResponseBody(requestUUID, w, resp, cancel)
+			transferStart := time.Now()
+			_, streamSpan := startSpan(ctx, "stream response")
+			overflowed, err := copyResponseBody(requestUUID, tenant, body, resp, cancel)
+			streamSpan.setAttribute("whsentry.truncated", overflowed)
+			streamSpan.finishWithError(err)
+			recordPhase(ctx, transferPhase, transferStart)
+			if overflowed && tenant.responseOverflowMode == Reset {
+				abort = true
+			} else if overflowed {
+				w.Header().Set(http.TrailerPrefix+TruncatedTrailer, "true")
+			}
 		}
 
 		if errorCode != "" {
@@ -265,13 +493,55 @@ func (p *ProxyHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if errorCode == InternalServerError {
 			logError(requestUUID, "Unexpected error while proxying request", err)
 		}
-		logRequest(r, requestUUID, responseCode, duration)
-		updateMetrics(duration, errorCode)
+		if resp != nil {
+			entry.setResponse(resp)
+		}
+		entry.setTimings(timings)
+		entry.responseCode, entry.reasonCode = responseCode, errorCode
+		entry.requestBytes, entry.responseBytes = requestBody.count(), responseBody.n
+		entry.responseTime = duration
+		entry.annotateSpan(span)
+		logRequest(entry)
+		updateMetrics(p.listener, r.URL.Hostname(), entry)
+		timings.observe(tenant.name)
+		if p.receipts != nil {
+			p.receipts.record(r, requestUUID, tenant.name, entry.targetIP, resp, capture, responseCode, errorCode, duration)
+		}
+		if abort {
+			// The status line and part of the body are already out, so the only way to tell the client
+			// the response is incomplete is to break the connection (or the stream, for HTTP/2)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// authenticate checks the Proxy-Authorization credentials if the listener has users, and returns the username,
+// which is the identity that selects the request's tenant. The header isn't sent on to the target.
+func (p *ProxyHTTPHandler) authenticate(r *http.Request) (string, error) {
+	if len(p.users) == 0 {
+		return "", nil
+	}
+	credentials := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	r.Header.Del("Proxy-Authorization")
+	username, password, ok := credentials.BasicAuth()
+	if !ok || !validCredentials(p.users, username, password) {
+		return "", &proxyError{statusCode: http.StatusProxyAuthRequired, message: "Proxy authentication required", errorCode: ProxyAuthRequired}
+	}
+	return username, nil
+}
+
+// validCredentials checks a password in constant time, and compares against something even for unknown users,
+// so the response time doesn't give them away
+func validCredentials(users map[string]string, username string, password string) bool {
+	expected, ok := users[username]
+	if !ok {
+		expected = password + "x"
 	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
 }
 
 func (p *ProxyHTTPHandler) connStateCallback(conn net.Conn, connState http.ConnState) {
-	// NOTE: Hijacked connections do not transition to closed
+	// NOTE: Hijacked connections do not transition to closed; trackHijacked counts them instead
 	if connState == http.StateNew {
 		p.incrementInboundConns()
 	} else if connState == http.StateClosed {
@@ -279,6 +549,49 @@ func (p *ProxyHTTPHandler) connStateCallback(conn net.Conn, connState http.ConnS
 	}
 }
 
+// trackHijacked decrements the inbound connection gauge for connections taken over by a handler, which the
+// server stops tracking. Both h2c upgrades and CONNECT tunnels serve the hijacked connection until it's done
+// before returning, so the connection is gone once next returns.
+func (p *ProxyHTTPHandler) trackHijacked(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only connections served by the HTTP/1 server can be hijacked; an HTTP/2 stream's writer is passed
+		// through untouched
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hw := &hijackRecorder{ResponseWriter: w, hijacker: hj}
+		defer func() {
+			if hw.hijacked {
+				p.decrementInboundConns()
+			}
+		}()
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// hijackRecorder notes whether the connection behind a response was hijacked
+type hijackRecorder struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+	hijacked bool
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := h.hijacker.Hijack()
+	if err == nil {
+		h.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (h *hijackRecorder) Flush() {
+	if f, ok := h.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (p *ProxyHTTPHandler) incrementInboundConns() {
 	p.currentInboundConnsGauge.Inc()
 }
@@ -289,6 +602,10 @@ func (p *ProxyHTTPHandler) decrementInboundConns() {
 
 func writeResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 	for k, values := range resp.Header {
+		// The request ID is the proxy's to set; a target can't change what the client correlates by
+		if k == http.CanonicalHeaderKey(RequestIDHeader) {
+			continue
+		}
 		w.Header().Set(k, values[0])
 		for _, v := range values[1:] {
 			w.Header().Add(k, v)
@@ -302,46 +619,108 @@ func writeResponseHeaders(w http.ResponseWriter, resp *http.Response) {
 	w.WriteHeader(resp.StatusCode)
 }
 
-func (p *ProxyHTTPHandler) writeResponseBody(requestUUID uuid.UUID, w http.ResponseWriter, resp *http.Response, cancel context.CancelFunc) {
+// copyResponseBody copies the response body to dst until it ends, goes over the tenant's maximum size or
+// stalls for longer than the read timeout. The part of the body up to the maximum size is copied. It returns
+// true if the body was too large; in Discard mode, the rest of the body is read before returning.
+func copyResponseBody(requestUUID uuid.UUID, tenant *tenant, dst io.Writer, resp *http.Response, cancel context.CancelFunc) (bool, error) {
 	defer resp.Body.Close()
 	// XXX: pick optimal buffer size
 	buf := make([]byte, 512)
-	timer := time.AfterFunc(p.idleReadTimeout, func() {
+	timer := time.AfterFunc(tenant.readTimeout, func() {
 		cancel()
 	})
+	defer timer.Stop()
 	var bytesReadSoFar uint32 = 0
+	overflowed := false
 	for {
 		n, err := resp.Body.Read(buf)
-		if n > 0 {
+		if n > 0 && !overflowed {
 			bytesReadSoFar += uint32(n)
-			if bytesReadSoFar > p.maxContentLength {
+			if bytesReadSoFar > tenant.maxResponseBodySize {
 				logWarn(requestUUID, "Response body exceeded maximum allowed length", nil)
-				break
+				overflowed = true
+				n -= int(bytesReadSoFar - tenant.maxResponseBodySize)
 			}
-			_, writeErr := w.Write(buf[:n])
-			if writeErr != nil {
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
 				logError(requestUUID, "Error writing to inbound socket", writeErr)
-				break
+				return overflowed, writeErr
+			}
+			if overflowed && tenant.responseOverflowMode != Discard {
+				return true, nil
 			}
 		}
 		if err == io.EOF {
-			break
+			return overflowed, nil
 		} else if err == context.Canceled {
 			logWarn(requestUUID, "Socket idle read time out reached", nil)
-			break
+			return overflowed, err
 		} else if err != nil {
 			logWarn(requestUUID, "Error occured reading response from target", err)
-			break
+			return overflowed, err
 		}
-		timer.Reset(p.idleReadTimeout)
+		timer.Reset(tenant.readTimeout)
+	}
+}
+
+// bufferResponseBody reads the whole response body before any of the response is sent, so that a body over
+// the maximum size can still be turned into an error response
+func bufferResponseBody(requestUUID uuid.UUID, tenant *tenant, resp *http.Response, cancel context.CancelFunc) ([]byte, error) {
+	var body bytes.Buffer
+	overflowed, err := copyResponseBody(requestUUID, tenant, &body, resp, cancel)
+	if overflowed {
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: "Response exceeds max content length", errorCode: ResponseTooLarge}
+	}
+	if err == context.Canceled {
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: "Timed out reading response from target", errorCode: RequestTimedOut}
+	} else if err != nil {
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: "Error reading response from target", errorCode: TCPConnectionError}
 	}
+	return body.Bytes(), nil
+}
+
+// toAbsoluteForm rewrites an HTTP/2 request in the absolute form the rest of the proxy expects.
+// HTTP/2 has no absolute-form request target; the target host is carried in the :authority
+// pseudo-header instead, which ends up in r.Host. CONNECT requests are left alone since their
+// request target is already the authority.
+func toAbsoluteForm(r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method == http.MethodConnect || r.URL.IsAbs() {
+		return
+	}
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+	r.RequestURI = r.URL.String()
 }
 
 type key int
 
+// requestIDFor returns the request ID the client sent, if it's a valid UUID, or else a new one. The header
+// isn't forwarded to the target.
+func requestIDFor(r *http.Request) uuid.UUID {
+	if id, err := uuid.Parse(r.Header.Get(RequestIDHeader)); err == nil {
+		return id
+	}
+	return uuid.New()
+}
+
+// clientCertFor returns the alias of the client certificate a request asks for, or else its tenant's
+func clientCertFor(r *http.Request, tenant *tenant) string {
+	if alias := r.Header.Get("X-Whsentry-Clientcert"); alias != "" {
+		return alias
+	}
+	return tenant.clientCertAlias
+}
+
+// checkClientCertAlias rejects the certificate of another tenant, as if it wasn't in the certificate store
+func checkClientCertAlias(alias string, tenant *tenant) error {
+	if strings.HasPrefix(alias, tenantCertAliasPrefix) && alias != tenant.clientCertAlias {
+		return &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Cert with alias %s not found in certificate store", alias), errorCode: ClientCertNotFoundError}
+	}
+	return nil
+}
+
 const clientCertKey key = 0
 
-func (p ProxyHTTPHandler) doProxy(ctx context.Context, r *http.Request) (*http.Response, error) {
+func (p ProxyHTTPHandler) doProxy(ctx context.Context, requestUUID uuid.UUID, tenant *tenant, r *http.Request) (*http.Response, error) {
 	if !r.URL.IsAbs() {
 		return nil, &proxyError{statusCode: http.StatusBadRequest, message: "Request URI must be absolute", errorCode: InvalidRequestURI}
 	}
@@ -355,15 +734,116 @@ func (p ProxyHTTPHandler) doProxy(ctx context.Context, r *http.Request) (*http.R
 	}
 	clientCert, ok := r.Header["X-Whsentry-Clientcert"]
 	if ok && len(clientCert) > 0 {
+		if err := checkClientCertAlias(clientCert[0], tenant); err != nil {
+			return nil, err
+		}
 		ctx = context.WithValue(ctx, clientCertKey, clientCert[0])
+	} else if tenant.clientCertAlias != "" {
+		ctx = context.WithValue(ctx, clientCertKey, tenant.clientCertAlias)
 	}
-	outboundRequest, err := http.NewRequestWithContext(ctx, r.Method, outboundUri, r.Body)
+	ctx = withEgressPool(ctx, r.Header)
+	body := r.Body
+	var limiter *requestBodyLimiter
+	if tenant.maxRequestBodySize > 0 {
+		if r.ContentLength > int64(tenant.maxRequestBodySize) {
+			logWarn(requestUUID, fmt.Sprintf("Request body of %d bytes exceeds maximum of %d bytes", r.ContentLength, tenant.maxRequestBodySize), nil)
+			return nil, requestTooLargeError(tenant.maxRequestBodySize)
+		}
+		// Chunked bodies don't declare their size, so they're counted as they're forwarded
+		limiter = &requestBodyLimiter{ReadCloser: r.Body, limit: int64(tenant.maxRequestBodySize)}
+		body = limiter
+	}
+	outboundRequest, err := http.NewRequestWithContext(ctx, r.Method, outboundUri, body)
 	if err != nil {
 		return nil, err
 	}
 	copyHeaders(r.Header, outboundRequest.Header)
 	outboundRequest.Header["User-Agent"] = []string{"Webhook Sentry/0.1"}
-	return p.roundTripper.RoundTrip(outboundRequest)
+	if p.requestIDHeader != "" {
+		outboundRequest.Header.Set(p.requestIDHeader, requestUUID.String())
+	}
+	p.tracer.propagate(ctx, outboundRequest.Header)
+	resp, err := p.roundTripper.RoundTrip(withRoundTripTrace(outboundRequest))
+	if limiter != nil && limiter.exceeded() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		logWarn(requestUUID, fmt.Sprintf("Request body without Content-Length was cut off after %d bytes, more than the maximum of %d bytes", limiter.bytesRead(), tenant.maxRequestBodySize), nil)
+		return nil, requestTooLargeError(tenant.maxRequestBodySize)
+	}
+	return resp, err
+}
+
+// withRoundTripTrace times the phases of the round trip that happen after the connection is made. The dialer
+// times the ones before.
+func withRoundTripTrace(r *http.Request) *http.Request {
+	ctx := r.Context()
+	start := time.Now()
+	// The request is written and the response read on different transport goroutines
+	var mu sync.Mutex
+	var wroteRequest time.Time
+	return r.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wroteRequest = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			recordPhase(ctx, ttfbPhase, start)
+			mu.Lock()
+			defer mu.Unlock()
+			if !wroteRequest.IsZero() {
+				recordPhase(ctx, serverPhase, wroteRequest)
+			}
+		},
+	}))
+}
+
+func requestTooLargeError(limit uint32) error {
+	return &proxyError{statusCode: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("Request body exceeds maximum of %d bytes", limit), errorCode: RequestTooLarge}
+}
+
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// requestBodyLimiter fails reads once more than limit bytes of the request body have been read, so an oversized
+// upload is cut off mid-stream instead of being forwarded in full. Reads happen on the transport's goroutine.
+type requestBodyLimiter struct {
+	io.ReadCloser
+	limit int64
+	mu    sync.Mutex
+	read  int64
+}
+
+func (l *requestBodyLimiter) Read(b []byte) (int, error) {
+	l.mu.Lock()
+	remaining := l.limit - l.read
+	l.mu.Unlock()
+	// Read at most one byte past the limit, which is enough to tell it's been exceeded
+	if int64(len(b)) > remaining+1 {
+		b = b[:remaining+1]
+	}
+	n, err := l.ReadCloser.Read(b)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n - int(l.read-l.limit), errRequestBodyTooLarge
+	}
+	return n, err
+}
+
+func (l *requestBodyLimiter) exceeded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.read > l.limit
+}
+
+// bytesRead returns how much of the body has been read from the client. Once the limit is exceeded, that's one
+// byte more than the limit, since reading stops there.
+func (l *requestBodyLimiter) bytesRead() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.read
 }
 
 func sendHTTPError(w http.ResponseWriter, statusCode int, errorCode string, errorMessage string) {
@@ -386,9 +866,14 @@ func mapError(requestUUID uuid.UUID, err error) (int, string, string) {
 			return mapNetOpError(requestUUID, *opErr)
 		}
 		//logError(requestUUID, "Unexpected error while proxying request", err)
-	case x509.CertificateInvalidError, x509.HostnameError, x509.UnknownAuthorityError:
+	}
+	// Newer Go versions wrap these in a tls.CertificateVerificationError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	if errors.As(err, &invalidErr) || errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) {
 		logWarn(requestUUID, "Certificate validation error", err)
-		return http.StatusBadGateway, CertificateValidationError, v.Error()
+		return http.StatusBadGateway, CertificateValidationError, err.Error()
 	}
 	return http.StatusInternalServerError, InternalServerError, "Internal Server Error"
 }
@@ -409,14 +894,12 @@ func mapNetOpError(requestUUID uuid.UUID, err net.OpError) (int, string, string)
 	return http.StatusInternalServerError, InternalServerError, "Internal Server Error"
 }
 
-func logRequest(r *http.Request, requestUUID uuid.UUID, responseCode int, responseTime time.Duration) {
-	url := r.RequestURI
+// requestURL is the URL a request went to, with the scheme the proxy used to reach the target
+func requestURL(r *http.Request) string {
 	if isTLS(r.Header) {
-		url = strings.Replace(url, "http:", "https:", 1)
+		return strings.Replace(r.RequestURI, "http:", "https:", 1)
 	}
-	requestLogger := accessLog.WithFields(logrus.Fields{"uuid": requestUUID.String(), "client_addr": r.RemoteAddr, "method": r.Method, "url": url, "response_code": responseCode,
-		"response_time": responseTime})
-	requestLogger.Info()
+	return r.RequestURI
 }
 
 func logWarn(requestUUID uuid.UUID, message string, err error) {
@@ -436,10 +919,6 @@ func doLog(requestUUID uuid.UUID, message string, err error, level logrus.Level)
 	logger.Log(level, message)
 }
 
-func updateMetrics(duration time.Duration, errorCode string) {
-	responseHistogram.With(prometheus.Labels{"error_code": errorCode}).Observe(float64(duration.Milliseconds()))
-}
-
 func isTLS(h http.Header) bool {
 	tlsHeader, ok := h["X-Whsentry-Tls"]
 	if ok {
@@ -475,10 +954,17 @@ func copyHeaders(inHeader http.Header, outHeader http.Header) {
 
 type safeDialer struct {
 	dialer                     *net.Dialer
+	resolver                   ipResolver
 	cidrBlacklist              []net.IPNet
+	cidrAllowList              []net.IPNet
+	rejectMixedDNSAnswers      bool
+	tenants                    *tenants
 	clientCerts                map[string]tls.Certificate
 	skipServerCertVerification bool
 	rootCerts                  *x509.CertPool
+	nextProtos                 []string
+	upstreamProxies            []*upstreamProxy
+	egressPools                *egressPools
 }
 
 func newSafeDialer(config *ProxyConfig) *safeDialer {
@@ -493,47 +979,162 @@ func newSafeDialer(config *ProxyConfig) *safeDialer {
 			cidrDenyList = append(cidrDenyList, net.IPNet(cidr))
 		}
 	}
+	var cidrAllowList []net.IPNet
+	for _, cidr := range config.CidrAllowList {
+		cidrAllowList = append(cidrAllowList, net.IPNet(cidr))
+	}
+	var nextProtos []string
+	if config.OutboundHTTP2 {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	resolver, err := newResolver(config.DNS, config.RootCACerts)
+	if err != nil {
+		log.Fatalf("Invalid DNS configuration: %s\n", err)
+	}
+	upstreamProxies, err := newUpstreamProxies(config.UpstreamProxies, config.RootCACerts)
+	if err != nil {
+		log.Fatalf("Invalid upstream proxy configuration: %s\n", err)
+	}
+	egressPools, err := newEgressPools(config.EgressPools, config.DefaultEgressPool)
+	if err != nil {
+		log.Fatalf("Invalid egress pool configuration: %s\n", err)
+	}
 	return &safeDialer{
 		dialer:                     dialer,
+		resolver:                   resolver,
 		cidrBlacklist:              cidrDenyList,
+		cidrAllowList:              cidrAllowList,
+		rejectMixedDNSAnswers:      config.RejectMixedDNSAnswers,
+		tenants:                    newTenants(config),
 		skipServerCertVerification: config.InsecureSkipCertVerification,
 		clientCerts:                config.ClientCerts,
 		rootCerts:                  config.RootCACerts,
+		nextProtos:                 nextProtos,
+		upstreamProxies:            upstreamProxies,
+		egressPools:                egressPools,
 	}
 }
 
 func (s *safeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	ipPort, err := s.resolveIPPort(ctx, addr)
+	ipPorts, err := s.resolveIPPorts(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
-	return s.dialer.DialContext(ctx, "tcp4", ipPort)
+	host, _, _ := net.SplitHostPort(addr)
+	return s.dialTarget(ctx, host, ipPorts)
 }
 
-func (s *safeDialer) resolveIPPort(ctx context.Context, addr string) (string, error) {
+// resolveIPPorts returns the IP:port of every address addr resolves to that we're allowed to connect to,
+// in the order the resolver returned them
+func (s *safeDialer) resolveIPPorts(ctx context.Context, addr string) ([]string, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	host, err = canonicalHost(host)
+	if err != nil {
+		return nil, err
 	}
-	ips, err := s.dialer.Resolver.LookupIPAddr(ctx, host)
+	tenant := s.tenantFor(ctx)
+	if err := tenant.hostPolicy.checkHost(host); err != nil {
+		return nil, err
+	}
+	if err := tenant.portPolicy.checkPort(host, port); err != nil {
+		return nil, err
+	}
+	lookupStart := time.Now()
+	_, dnsSpan := startSpan(ctx, "dns lookup")
+	dnsSpan.setAttribute("net.peer.name", host)
+	ips, err := s.resolver.LookupIPAddr(ctx, host)
+	dnsSpan.setAttribute("whsentry.dns_answers", len(ips))
+	dnsSpan.finishWithError(err)
+	dnsLookupHistogram.Observe(float64(time.Since(lookupStart).Milliseconds()))
+	recordPhase(ctx, dnsPhase, lookupStart)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var chosenIP net.IP = nil
+	var ipPorts []string
+	var blockedIP net.IP = nil
 	for _, ip := range ips {
-		if strings.Count(ip.IP.String(), ":") < 2 {
-			chosenIP = ip.IP
-			break
+		if strings.Count(ip.IP.String(), ":") >= 2 {
+			continue
 		}
+		if !isAllowlisted(s.cidrAllowList, ip.IP) && isBlacklisted(s.cidrBlacklist, ip.IP) {
+			if s.rejectMixedDNSAnswers {
+				// An attacker controlling the DNS answer could order it so we'd pick a blocked IP, so
+				// don't connect to a host that resolves to any blocked IP at all
+				return nil, &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Target %s resolved to blocked IP %s", host, ip.IP.String()), errorCode: BlockedIPAddress}
+			}
+			if blockedIP == nil {
+				blockedIP = ip.IP
+			}
+			continue
+		}
+		ipPorts = append(ipPorts, net.JoinHostPort(ip.IP.String(), port))
+	}
+	if len(ipPorts) == 0 {
+		if blockedIP != nil {
+			return nil, &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("IP %s is blocked", blockedIP.String()), errorCode: BlockedIPAddress}
+		}
+		return nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Target %s did not resolve to a valid IPv4 address", addr), errorCode: UnableToResolveIP}
+	}
+	return ipPorts, nil
+}
+
+// dialFirstReachable tries each address in turn until one connects. Like the standard library dialer,
+// the connect timeout is spread over the addresses that haven't been tried yet, so a single unresponsive
+// address can't use up all of it. A zero connect timeout means there's no deadline other than ctx's.
+func (s *safeDialer) dialFirstReachable(ctx context.Context, dialer *net.Dialer, ipPorts []string) (net.Conn, error) {
+	const minAttemptTimeout = 2 * time.Second
+	var deadline time.Time
+	if dialer.Timeout > 0 {
+		deadline = time.Now().Add(dialer.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
 	}
-	if chosenIP == nil {
-		return "", &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Target %s did not resolve to a valid IPv4 address", addr), errorCode: UnableToResolveIP}
+	var lastErr error
+	for i, ipPort := range ipPorts {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			attemptTimeout := remaining / time.Duration(len(ipPorts)-i)
+			if attemptTimeout < minAttemptTimeout {
+				attemptTimeout = minAttemptTimeout
+				if remaining < minAttemptTimeout {
+					attemptTimeout = remaining
+				}
+			}
+			attemptCtx, cancel = context.WithTimeout(ctx, attemptTimeout)
+		}
+		conn, err := dialer.DialContext(attemptCtx, "tcp4", ipPort)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || (!deadline.IsZero() && time.Until(deadline) <= 0) {
+			break
+		}
 	}
-	if isBlacklisted(s.cidrBlacklist, chosenIP) {
-		return "", &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("IP %s is blocked", chosenIP.String()), errorCode: BlockedIPAddress}
+	return nil, lastErr
+}
+
+// withConnectTimeout is context.WithTimeout, except that a zero connect timeout means there's no deadline other
+// than ctx's
+func withConnectTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, timeout)
+}
 
-	return net.JoinHostPort(chosenIP.String(), port), nil
+// connectDeadline returns the deadline a connect timeout sets from now, or no deadline for a zero timeout
+func connectDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
 }
 
 func (s *safeDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -543,7 +1144,7 @@ func (s *safeDialer) DialTLSContext(ctx context.Context, network, addr string) (
 		return nil, err
 	}
 
-	ipPort, err := s.resolveIPPort(ctx, addr)
+	ipPorts, err := s.resolveIPPorts(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -553,14 +1154,28 @@ func (s *safeDialer) DialTLSContext(ctx context.Context, network, addr string) (
 			return nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Cert with alias %s not found in certificate store", certAlias), errorCode: ClientCertNotFoundError}
 		}
 	}
-	conn, err := s.dialer.DialContext(ctx, "tcp4", ipPort)
+	conn, err := s.dialTarget(ctx, host, ipPorts)
 	if err != nil {
 		return nil, err
 	}
-	return s.doTLSHandshake(conn, host, certAlias)
+	defer recordPhase(ctx, tlsPhase, time.Now())
+	_, tlsSpan := startSpan(ctx, "tls handshake")
+	tlsSpan.setAttribute("tls.server_name", host)
+	tlsConn, err := s.doTLSHandshakeWithALPN(conn, host, certAlias, s.nextProtos, s.tenantFor(ctx).connectTimeout)
+	if err == nil {
+		tlsSpan.setAttribute("tls.protocol_version", tlsVersionName(tlsConn.(*tls.Conn).ConnectionState().Version))
+	}
+	tlsSpan.finishWithError(err)
+	return tlsConn, err
 }
 
 func (s *safeDialer) doTLSHandshake(conn net.Conn, hostname string, certAlias string) (net.Conn, error) {
+	return s.doTLSHandshakeWithALPN(conn, hostname, certAlias, nil, s.dialer.Timeout)
+}
+
+// doTLSHandshakeWithALPN offers nextProtos to the server through ALPN. This must only be used when we speak
+// HTTP to the target ourselves; a MITMed connection has to stick to whatever the client negotiated with us.
+func (s *safeDialer) doTLSHandshakeWithALPN(conn net.Conn, hostname string, certAlias string, nextProtos []string, timeout time.Duration) (net.Conn, error) {
 	var clientCert tls.Certificate
 	if certAlias == "" {
 		certAlias = "default"
@@ -579,14 +1194,17 @@ func (s *safeDialer) doTLSHandshake(conn net.Conn, hostname string, certAlias st
 			}
 			return &clientCert, nil
 		},
-		RootCAs: s.rootCerts,
+		RootCAs:    s.rootCerts,
+		NextProtos: nextProtos,
 	}
 	tlsConn := tls.Client(conn, tlsConfig)
 	// NOTE: this effectively makes the total timeout for a TLS conn (2 * Config.Timeout)
-	tlsConn.SetDeadline(time.Now().Add(s.dialer.Timeout))
+	tlsConn.SetDeadline(time.Now().Add(timeout))
 	if err := tlsConn.Handshake(); err != nil {
+		tlsHandshakeCounter.With(prometheus.Labels{"result": tlsHandshakeResult(err)}).Inc()
 		return nil, err
 	}
+	tlsHandshakeCounter.With(prometheus.Labels{"result": "success"}).Inc()
 	tlsConn.SetDeadline(time.Time{})
 	return tlsConn, nil
 }
@@ -603,6 +1221,15 @@ func isBlacklisted(cidrBlacklist []net.IPNet, ip net.IP) bool {
 	return false
 }
 
+func isAllowlisted(cidrAllowList []net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrAllowList {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 type proxyError struct {
 	statusCode uint
 	message    string
@@ -620,17 +1247,6 @@ func isTruish(val string) bool {
 	return val == "1" || strings.EqualFold(val, "true")
 }
 
-type AccessLogTextFormatter struct {
-}
-
-func (f *AccessLogTextFormatter) Format(entry *logrus.Entry) ([]byte, error) {
-	fields := entry.Data
-	ts := entry.Time.Format(time.RFC3339)
-	responseTime := fields["response_time"].(time.Duration)
-	logLine := fmt.Sprintf("[%s] %s %s %s %s %d %dms\n", ts, fields["uuid"], fields["client_addr"], fields["method"], fields["url"], fields["response_code"], responseTime.Milliseconds())
-	return []byte(logLine), nil
-}
-
 type ProxyLogTextFormatter struct {
 }
 
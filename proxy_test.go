@@ -5,7 +5,11 @@ package main
 
 import (
 	"net/http"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 func TestCopyHeadersSkipProxyConnection(t *testing.T) {
@@ -88,3 +92,29 @@ func TestIsTLS(t *testing.T) {
 		}
 	})
 }
+
+func TestAccessLogTextFormatter(t *testing.T) {
+	entry := accessLog.WithFields(logrus.Fields{"uuid": "abc", "client_addr": "127.0.0.1:5000", "method": "GET", "url": "http://example.com/",
+		"target_ip": "203.0.113.10", "source_ip": "198.51.100.7", "protocol": "HTTP/2.0", "tenant": "billing", "response_code": 200, "response_time": 15 * time.Millisecond})
+	line, err := (&AccessLogTextFormatter{}).Format(entry)
+	if err != nil {
+		t.Fatalf("Failed to format access log entry: %s", err)
+	}
+	if !strings.HasSuffix(string(line), "abc 127.0.0.1:5000 GET http://example.com/ 200 15ms 203.0.113.10 HTTP/2.0 198.51.100.7 billing\n") {
+		t.Errorf("Unexpected access log line: %s", line)
+	}
+}
+
+func TestAccessLogTemplate(t *testing.T) {
+	formatter, err := newAccessLogTextFormatter(`{{.uuid}} {{.response_code}} {{.reason_code}} {{ms .ttfb}}ms "{{.user_agent}}"`)
+	checkNoError(t, err)
+	entry := accessLog.WithFields(logrus.Fields{"uuid": "abc", "response_code": 403, "reason_code": "1013", "ttfb": 42 * time.Millisecond})
+	line, err := formatter.Format(entry)
+	checkNoError(t, err)
+	assertEqual(t, "abc 403 1013 42ms \"-\"\n", string(line))
+
+	_, err = newAccessLogTextFormatter("{{.uuid")
+	if err == nil {
+		t.Errorf("Expected an invalid template to be rejected")
+	}
+}
@@ -0,0 +1,204 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections that start with a PROXY protocol header, and reports the client
+// address from the header as the connection's remote address. Connections from untrusted sources are passed
+// through as they are, so they can't spoof their address.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []net.IPNet
+}
+
+func newProxyProtocolListener(listener net.Listener, config ProxyProtocolConfig) net.Listener {
+	var trusted []net.IPNet
+	for _, cidr := range config.TrustedCidrs {
+		trusted = append(trusted, net.IPNet(cidr))
+	}
+	return &proxyProtocolListener{Listener: listener, trusted: trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// isTrusted returns whether the address may send a PROXY protocol header. Unix socket peers are on the same
+// host, so they're always trusted.
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, cidr := range l.trusted {
+		if cidr.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn reads the PROXY protocol header on first use rather than in Accept, so that a slow client
+// can't hold up the accept loop
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		c.remoteAddr, c.err = readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Warnf("Invalid PROXY protocol header from %s: %s\n", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a v1 or v2 header, and returns the source address in it. It's nil if the header
+// doesn't carry addresses, like for health checks from the load balancer itself. The destination address is
+// ignored, since the proxy's own address is what matters for anything it listens on.
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyProtocolV1(reader)
+	case proxyProtocolV2Signature[0]:
+		signature, err := reader.Peek(len(proxyProtocolV2Signature))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(signature, proxyProtocolV2Signature) {
+			return readProxyProtocolV2(reader)
+		}
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyProtocolV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	// The longest v1 header is 107 bytes, including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	if _, err := parseProxyProtocolV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	src, err := parseProxyProtocolV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+func parseProxyProtocolV1Addr(ipStr string, portStr string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipStr)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid address %s:%s in v1 header", ipStr, portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d in v2 header", versionCommand>>4)
+	}
+	// LOCAL connections come from the load balancer itself, so the real addresses apply
+	if versionCommand&0x0f == 0 {
+		return nil, nil
+	}
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("v2 header is too short for its address family")
+	}
+	// Anything after the addresses is TLVs, which we don't need
+	return &net.TCPAddr{IP: net.IP(payload[:ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen:]))}, nil
+}
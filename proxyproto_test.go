@@ -0,0 +1,164 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+const proxyProtocolAddress = "127.0.0.1:11093"
+
+func proxyProtocolV2Header(command byte, family byte, addrs []byte) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2Addrs := []byte{203, 0, 113, 7, 127, 0, 0, 1, 0x9c, 0x40, 0x2b, 0x5d}
+	// A PP2_TYPE_AUTHORITY TLV after the addresses
+	v2AddrsWithTLV := append(append([]byte(nil), v2Addrs...), 0x02, 0x00, 0x03, 'f', 'o', 'o')
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		err        string
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 203.0.113.7 127.0.0.1 40000 11093\r\n", remoteAddr: "203.0.113.7:40000"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 ::1 40000 11093\r\n", remoteAddr: "[2001:db8::1]:40000"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 malformed", header: "PROXY TCP4 203.0.113.7\r\n", err: "malformed v1 header"},
+		{name: "v1 invalid port", header: "PROXY TCP4 203.0.113.7 127.0.0.1 99999 11093\r\n", err: "invalid address"},
+		{name: "v1 without CRLF", header: "PROXY TCP4 203.0.113.7 127.0.0.1 40000 11093\n", err: "not terminated by CRLF"},
+		{name: "v2 TCP4", header: string(proxyProtocolV2Header(0x1, 0x11, v2Addrs)), remoteAddr: "203.0.113.7:40000"},
+		{name: "v2 with TLVs", header: string(proxyProtocolV2Header(0x1, 0x11, v2AddrsWithTLV)), remoteAddr: "203.0.113.7:40000"},
+		{name: "v2 LOCAL", header: string(proxyProtocolV2Header(0x0, 0x00, nil))},
+		{name: "v2 too short", header: string(proxyProtocolV2Header(0x1, 0x11, v2Addrs[:8])), err: "too short"},
+		{name: "Missing header", header: "GET / HTTP/1.1\r\n", err: "missing PROXY protocol header"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(test.header + "rest"))
+			addr, err := readProxyProtocolHeader(reader)
+			if test.err != "" {
+				assertError(t, test.err, err)
+				return
+			}
+			checkNoError(t, err)
+			if test.remoteAddr == "" {
+				assertEqual(t, nil, addr)
+			} else {
+				assertEqual(t, test.remoteAddr, addr.String())
+			}
+			rest, _ := ioutil.ReadAll(reader)
+			assertEqual(t, "rest", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	target := startTargetServer(t)
+	defer target.Shutdown(context.TODO())
+
+	startProxyWithProxyProtocol := func(trustedCidr string, allowedClientCidrs ...Cidr) (*http.Server, *bytes.Buffer) {
+		config := NewDefaultConfig()
+		config.InsecureSkipCidrDenyList = true
+		config.AllowedPorts = append(config.AllowedPorts, testTargetPorts...)
+		config.Listeners = []ListenerConfig{{
+			Address:            proxyProtocolAddress,
+			Type:               HTTP,
+			ProxyProtocol:      ProxyProtocolConfig{Enabled: true, TrustedCidrs: []Cidr{Cidr(mustParseCIDR(t, trustedCidr))}},
+			AllowedClientCidrs: allowedClientCidrs,
+		}}
+		setupLogging(config)
+		accessLogBuffer := new(bytes.Buffer)
+		accessLog.Out = accessLogBuffer
+		proxy := createTestProxyServer(t, config)
+		listener, err := listen(config.Listeners[0])
+		checkNoError(t, err)
+		go proxy.Serve(listener)
+		return proxy, accessLogBuffer
+	}
+	defer func() { accessLog.Out = os.Stdout }()
+
+	sendRequest := func(header string) *http.Response {
+		conn, err := net.Dial("tcp4", proxyProtocolAddress)
+		checkNoError(t, err)
+		defer conn.Close()
+		fmt.Fprintf(conn, "%sGET http://localhost:%s/target HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", header, httpTargetServerPort)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil
+		}
+		ioutil.ReadAll(resp.Body)
+		return resp
+	}
+
+	t.Run("Trusted source", func(t *testing.T) {
+		proxy, accessLogBuffer := startProxyWithProxyProtocol("127.0.0.0/8")
+		defer proxy.Shutdown(context.TODO())
+		waitForStartup(t, proxyProtocolAddress)
+
+		resp := sendRequest("PROXY TCP4 203.0.113.7 127.0.0.1 40000 11093\r\n")
+		if resp == nil {
+			t.Fatal("Expected a response from the proxy")
+		}
+		assertEqual(t, 200, resp.StatusCode)
+		if !strings.Contains(accessLogBuffer.String(), " 203.0.113.7:40000 GET ") {
+			t.Errorf("Expected client address from PROXY header in access log, got %s", accessLogBuffer.String())
+		}
+
+		if resp := sendRequest(""); resp != nil {
+			t.Errorf("Expected request without PROXY header from trusted source to be rejected, got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Untrusted source", func(t *testing.T) {
+		proxy, accessLogBuffer := startProxyWithProxyProtocol("10.0.0.0/8")
+		defer proxy.Shutdown(context.TODO())
+		waitForStartup(t, proxyProtocolAddress)
+
+		resp := sendRequest("PROXY TCP4 203.0.113.7 127.0.0.1 40000 11093\r\n")
+		if resp != nil && resp.StatusCode == 200 {
+			t.Error("Expected PROXY header from untrusted source not to be accepted")
+		}
+
+		resp = sendRequest("")
+		if resp == nil {
+			t.Fatal("Expected a response from the proxy")
+		}
+		assertEqual(t, 200, resp.StatusCode)
+		if !strings.Contains(accessLogBuffer.String(), " 127.0.0.1:") {
+			t.Errorf("Expected real client address in access log, got %s", accessLogBuffer.String())
+		}
+	})
+
+	t.Run("Allowed clients are checked by the address in the header", func(t *testing.T) {
+		proxy, _ := startProxyWithProxyProtocol("127.0.0.0/8", Cidr(mustParseCIDR(t, "203.0.113.0/24")))
+		defer proxy.Shutdown(context.TODO())
+		waitForStartup(t, proxyProtocolAddress)
+
+		resp := sendRequest("PROXY TCP4 203.0.113.7 127.0.0.1 40000 11093\r\n")
+		if resp == nil {
+			t.Fatal("Expected a response from the proxy")
+		}
+		assertEqual(t, 200, resp.StatusCode)
+
+		resp = sendRequest("PROXY TCP4 198.51.100.7 127.0.0.1 40000 11093\r\n")
+		if resp == nil {
+			t.Fatal("Expected a response from the proxy")
+		}
+		assertReasonCode(t, resp, http.StatusForbidden, ClientNotAllowed)
+	})
+}
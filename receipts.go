@@ -0,0 +1,212 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReceiptSignatureHeader carries the HMAC-SHA256 of a delivery receipt posted to the callback URL, as
+// "sha256=<hex digest>", keyed with the configured signing key
+const ReceiptSignatureHeader = "X-WhSentry-Signature"
+
+// deliveryReceipt records what the target returned for a request. The uuid is the same as in the access log.
+// Status is the target's response status, while ResponseCode is what the client got, which differs when the
+// proxy rejected the request or the response. Body is base64 encoded in JSON.
+type deliveryReceipt struct {
+	UUID          string      `json:"uuid"`
+	Time          time.Time   `json:"time"`
+	Tenant        string      `json:"tenant,omitempty"`
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	TargetIP      string      `json:"target_ip,omitempty"`
+	Status        int         `json:"status,omitempty"`
+	ResponseCode  int         `json:"response_code"`
+	ReasonCode    string      `json:"reason_code,omitempty"`
+	Headers       http.Header `json:"headers,omitempty"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated"`
+	ResponseTime  int64       `json:"response_time_ms"`
+}
+
+// bodyCapture keeps the first max bytes written to it
+type bodyCapture struct {
+	body      []byte
+	max       int
+	truncated bool
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	if room := c.max - len(c.body); room < len(p) {
+		c.body = append(c.body, p[:room]...)
+		c.truncated = true
+	} else {
+		c.body = append(c.body, p...)
+	}
+	return len(p), nil
+}
+
+// receiptRecorder sends delivery receipts in the background, so a slow callback doesn't hold up requests.
+// Receipts are dropped, with a warning, if the queue is full or the recorder is closed. Only plain HTTP
+// requests get receipts; MITM'd CONNECT tunnels and SOCKS5 connections don't.
+type receiptRecorder struct {
+	config DeliveryReceiptsConfig
+	// signingKeys are the keys of tenants that sign their receipts with their own
+	signingKeys map[string]string
+	client      *http.Client
+	file        *os.File
+	queue       chan *deliveryReceipt
+	done        chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newReceiptRecorder returns nil if delivery receipts aren't enabled
+func newReceiptRecorder(config DeliveryReceiptsConfig, tenants []TenantConfig) (*receiptRecorder, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	r := &receiptRecorder{
+		config:      config,
+		signingKeys: make(map[string]string),
+		client:      &http.Client{Timeout: config.Timeout},
+		queue:       make(chan *deliveryReceipt, config.QueueSize),
+		done:        make(chan struct{}),
+	}
+	for _, tenant := range tenants {
+		if tenant.SigningKey != "" {
+			r.signingKeys[tenant.Name] = tenant.SigningKey
+		}
+	}
+	if config.File != "" {
+		f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot open delivery receipt file: %s", err)
+		}
+		r.file = f
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *receiptRecorder) newCapture() *bodyCapture {
+	return &bodyCapture{max: r.config.MaxBodyBytes}
+}
+
+// record queues a receipt for a request. resp and capture are nil if the request never got a response from
+// the target.
+func (r *receiptRecorder) record(req *http.Request, requestUUID uuid.UUID, tenant string, targetIP string, resp *http.Response, capture *bodyCapture, responseCode int, errorCode string, responseTime time.Duration) {
+	receipt := &deliveryReceipt{
+		UUID:         requestUUID.String(),
+		Time:         time.Now(),
+		Tenant:       tenant,
+		Method:       req.Method,
+		URL:          requestURL(req),
+		TargetIP:     targetIP,
+		ResponseCode: responseCode,
+		ReasonCode:   errorCode,
+		ResponseTime: responseTime.Milliseconds(),
+	}
+	if resp != nil {
+		receipt.Status = resp.StatusCode
+		receipt.Headers = resp.Header
+	}
+	if capture != nil {
+		receipt.Body = capture.body
+		receipt.BodyTruncated = capture.truncated
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		logWarn(requestUUID, "Delivery receipts are shutting down, dropping receipt", nil)
+		return
+	}
+	select {
+	case r.queue <- receipt:
+	default:
+		logWarn(requestUUID, "Delivery receipt queue is full, dropping receipt", nil)
+	}
+}
+
+// Close stops accepting receipts, waits for the queued ones to be sent, and closes the receipt file
+func (r *receiptRecorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+	<-r.done
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
+
+func (r *receiptRecorder) run() {
+	defer close(r.done)
+	for receipt := range r.queue {
+		data, err := json.Marshal(receipt)
+		if err != nil {
+			log.Errorf("Failed to encode delivery receipt for request %s: %s\n", receipt.UUID, err)
+			continue
+		}
+		if r.file != nil {
+			if _, err := r.file.Write(append(data, '\n')); err != nil {
+				log.Errorf("Failed to write delivery receipt for request %s: %s\n", receipt.UUID, err)
+			}
+		}
+		if r.config.CallbackURL != "" {
+			if err := r.post(data, r.signingKey(receipt.Tenant)); err != nil {
+				log.Warnf("Failed to post delivery receipt for request %s: %s\n", receipt.UUID, err)
+			}
+		}
+	}
+}
+
+// signingKey returns the key for a tenant's receipts: its own if it has one, or else the global one
+func (r *receiptRecorder) signingKey(tenant string) string {
+	if key, ok := r.signingKeys[tenant]; ok {
+		return key
+	}
+	return r.config.SigningKey
+}
+
+func (r *receiptRecorder) post(data []byte, signingKey string) error {
+	req, err := http.NewRequest(http.MethodPost, r.config.CallbackURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ReceiptSignatureHeader, "sha256="+signReceipt(signingKey, data))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signReceipt(key string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
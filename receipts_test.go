@@ -0,0 +1,126 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDeliveryReceipts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receipts")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	receiptFile := filepath.Join(dir, "receipts.jsonl")
+
+	type postedReceipt struct {
+		signature string
+		body      []byte
+	}
+	posted := make(chan postedReceipt, 10)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		posted <- postedReceipt{signature: r.Header.Get(ReceiptSignatureHeader), body: body}
+	}))
+	defer callback.Close()
+
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.DeliveryReceipts = DeliveryReceiptsConfig{
+				Enabled:      true,
+				MaxBodyBytes: 5,
+				CallbackURL:  callback.URL,
+				SigningKey:   "s3cret",
+				Timeout:      time.Second,
+				File:         receiptFile,
+				QueueSize:    10,
+			}
+			config.Tenants = []TenantConfig{{Name: "billing", SigningKey: "billing-s3cret"}}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+
+	resp, err := client.Get("http://localhost:" + httpTargetServerPort + "/target")
+	checkNoError(t, err)
+	responseData, _ := ioutil.ReadAll(resp.Body)
+	assertEqual(t, "Hello from target", string(responseData))
+
+	var receipt deliveryReceipt
+	select {
+	case p := <-posted:
+		assertEqual(t, "sha256="+signReceipt("s3cret", p.body), p.signature)
+		checkNoError(t, json.Unmarshal(p.body, &receipt))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery receipt")
+	}
+	assertEqual(t, 200, receipt.Status)
+	assertEqual(t, "custom", receipt.Headers.Get("X-Custom-Header"))
+	assertEqual(t, "Hello", string(receipt.Body))
+	assertEqual(t, true, receipt.BodyTruncated)
+	assertEqual(t, "http://localhost:"+httpTargetServerPort+"/target", receipt.URL)
+
+	// The file is written before the callback is posted
+	f, err := os.Open(receiptFile)
+	checkNoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("Expected a delivery receipt in the receipt file")
+	}
+	var fileReceipt deliveryReceipt
+	checkNoError(t, json.Unmarshal(scanner.Bytes(), &fileReceipt))
+	assertEqual(t, receipt.UUID, fileReceipt.UUID)
+
+	// A tenant's receipts are signed with its own key
+	req, _ := http.NewRequest("GET", "http://localhost:"+httpTargetServerPort+"/target", nil)
+	req.Header.Set(TenantHeader, "billing")
+	resp, err = client.Do(req)
+	checkNoError(t, err)
+	ioutil.ReadAll(resp.Body)
+	select {
+	case p := <-posted:
+		assertEqual(t, "sha256="+signReceipt("billing-s3cret", p.body), p.signature)
+		checkNoError(t, json.Unmarshal(p.body, &receipt))
+		assertEqual(t, "billing", receipt.Tenant)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery receipt")
+	}
+}
+
+func TestDeliveryReceiptsClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receipts")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	receiptFile := filepath.Join(dir, "receipts.jsonl")
+
+	recorder, err := newReceiptRecorder(DeliveryReceiptsConfig{Enabled: true, File: receiptFile, QueueSize: 10}, nil)
+	checkNoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/hook", nil)
+	for i := 0; i < 5; i++ {
+		recorder.record(req, uuid.New(), "", "", nil, nil, http.StatusOK, "", 0)
+	}
+	// Everything queued is written before Close returns, and later receipts are dropped
+	checkNoError(t, recorder.Close())
+	recorder.record(req, uuid.New(), "", "", nil, nil, http.StatusOK, "", 0)
+	checkNoError(t, recorder.Close())
+
+	data, err := ioutil.ReadFile(receiptFile)
+	checkNoError(t, err)
+	assertEqual(t, 5, bytes.Count(data, []byte("\n")))
+}
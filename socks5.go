@@ -0,0 +1,862 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SOCKS5 constants from RFC 1928 and RFC 1929
+const (
+	socks5Version        = 0x05
+	socks5AuthVersion    = 0x01
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoAccept   = 0xff
+	socks5AuthSuccess    = 0x00
+	socks5AuthFailure    = 0x01
+	socks5CmdConnect     = 0x01
+	socks5CmdBind        = 0x02
+	socks5CmdUDPAssoc    = 0x03
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5Succeeded      = 0x00
+	socks5GeneralFailure = 0x01
+	socks5NotAllowed     = 0x02
+	socks5NetUnreachable = 0x03
+	socks5HostUnreach    = 0x04
+	socks5ConnRefused    = 0x05
+	socks5CmdNotSupp     = 0x07
+	socks5AddrNotSupp    = 0x08
+)
+
+// ErrSocks5ServerClosed is returned by Socks5Server.Serve after a call to Close
+var ErrSocks5ServerClosed = errors.New("socks5: Server closed")
+
+var socks5Commands = map[byte]string{
+	socks5CmdConnect:  "CONNECT",
+	socks5CmdBind:     "BIND",
+	socks5CmdUDPAssoc: "UDP_ASSOCIATE",
+}
+
+// Socks5Server accepts SOCKS5 connections and makes every outbound connection through the safe dialer,
+// so the same CIDR, host and port policies apply as for HTTP requests.
+type Socks5Server struct {
+	Addr           string
+	config         Socks5Config
+	dialer         *safeDialer
+	listenerTenant string
+	clientPolicy   *clientPolicy
+	connsGauge     prometheus.Gauge
+
+	// ctx is cancelled on Close, which stops lookups and dials in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+func newSocks5Server(listenerConfig ListenerConfig, proxyConfig *ProxyConfig, sd *safeDialer, connsGauge prometheus.Gauge) *Socks5Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Socks5Server{
+		Addr:           listenerConfig.Address,
+		config:         listenerConfig.Socks5,
+		dialer:         sd,
+		listenerTenant: listenerConfig.Tenant,
+		clientPolicy:   newClientPolicy(listenerConfig.AllowedClientCidrs),
+		connsGauge:     connsGauge,
+		ctx:            ctx,
+		cancel:         cancel,
+		conns:          make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on the listener until Close is called, after which it returns ErrSocks5ServerClosed
+func (s *Socks5Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrSocks5ServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrSocks5ServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrSocks5ServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections, closes all open tunnels and UDP associations, and waits for their
+// handlers to return
+func (s *Socks5Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+	return err
+}
+
+func (s *Socks5Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Socks5Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Socks5Server) serveConn(conn net.Conn) {
+	defer s.handlers.Done()
+	s.connsGauge.Inc()
+	defer s.connsGauge.Dec()
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	requestUUID := uuid.New()
+	// Clients get a connect timeout's worth of time to negotiate, if there is one, after which only the tunnel
+	// deadlines apply
+	conn.SetDeadline(connectDeadline(s.dialer.dialer.Timeout))
+	reader := bufio.NewReader(conn)
+	username, err := s.authenticate(reader, conn)
+	if err != nil {
+		logWarn(requestUUID, "SOCKS5 handshake failed", err)
+		return
+	}
+	cmd, target, err := readSocks5Request(reader)
+	if err != nil {
+		logWarn(requestUUID, "Invalid SOCKS5 request", err)
+		if reply, ok := err.(socks5ReplyError); ok {
+			writeSocks5Reply(conn, byte(reply), nil)
+		}
+		return
+	}
+
+	start := time.Now()
+	entry := &accessLogEntry{uuid: requestUUID, clientAddr: conn.RemoteAddr().String(), method: socks5CommandName(cmd), url: target, protocol: "SOCKS5"}
+	var reply byte
+	var tenant *tenant
+	err = s.clientPolicy.checkClient(entry.clientAddr)
+	if err == nil {
+		tenant, err = s.dialer.tenants.resolve(s.listenerTenant, nil, username, "")
+	}
+	switch {
+	case err != nil:
+		if pErr, ok := err.(*proxyError); ok {
+			entry.reasonCode = pErr.errorCode
+		}
+		reply = socks5ReplyFor(requestUUID, err)
+		writeSocks5Reply(conn, reply, nil)
+	case cmd == socks5CmdConnect:
+		reply = s.handleConnect(requestUUID, tenant, conn, reader, target, entry)
+	case cmd == socks5CmdBind && s.config.AllowBind:
+		reply = s.handleBind(requestUUID, tenant, conn, reader, target, entry)
+	case cmd == socks5CmdUDPAssoc && s.config.AllowUDPAssociate:
+		reply = s.handleUDPAssociate(requestUUID, tenant, conn, reader, target, entry)
+	default:
+		reply = socks5CmdNotSupp
+		writeSocks5Reply(conn, reply, nil)
+	}
+	if tenant != nil {
+		entry.tenant = tenant.name
+	}
+	entry.socksReply = strconv.Itoa(int(reply))
+	entry.responseCode = socks5StatusCode(reply)
+	entry.responseTime = time.Since(start)
+	logRequest(entry)
+	host, _, _ := net.SplitHostPort(target)
+	updateMetrics(s.Addr, host, entry)
+}
+
+// authenticate negotiates the authentication method, and checks the username and password if users are configured.
+// It returns the authenticated username, if any.
+func (s *Socks5Server) authenticate(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNone)
+	if len(s.config.Users) > 0 {
+		method = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return "", errors.New("client did not offer an acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthNone {
+		return "", nil
+	}
+
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if version != socks5AuthVersion {
+		return "", fmt.Errorf("unsupported username/password authentication version %d", version)
+	}
+	username, err := readSocks5String(reader)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSocks5String(reader)
+	if err != nil {
+		return "", err
+	}
+	if !validCredentials(s.config.Users, username, password) {
+		conn.Write([]byte{socks5AuthVersion, socks5AuthFailure})
+		return "", fmt.Errorf("authentication failed for user %q", username)
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, socks5AuthSuccess})
+	return username, err
+}
+
+func (s *Socks5Server) handleConnect(requestUUID uuid.UUID, tenant *tenant, conn net.Conn, reader *bufio.Reader, target string, entry *accessLogEntry) byte {
+	ctx, cancel := withConnectTimeout(withTenant(s.ctx, tenant), tenant.connectTimeout)
+	outboundConn, err := s.dialer.DialContext(ctx, "tcp4", target)
+	cancel()
+	if err != nil {
+		reply := socks5ReplyFor(requestUUID, err)
+		writeSocks5Reply(conn, reply, nil)
+		return reply
+	}
+	defer outboundConn.Close()
+	entry.targetIP, _, _ = net.SplitHostPort(outboundConn.RemoteAddr().String())
+	entry.sourceIP = outboundSourceIP(outboundConn)
+	if err := writeSocks5Reply(conn, socks5Succeeded, outboundConn.LocalAddr()); err != nil {
+		return socks5Succeeded
+	}
+	entry.requestBytes, entry.responseBytes = s.relay(requestUUID, tenant, conn, reader, outboundConn)
+	return socks5Succeeded
+}
+
+// handleBind listens for a single connection from the target, for protocols like active mode FTP. The target
+// must pass the same checks as a CONNECT target, and only a connection from one of its IPs is accepted.
+func (s *Socks5Server) handleBind(requestUUID uuid.UUID, tenant *tenant, conn net.Conn, reader *bufio.Reader, target string, entry *accessLogEntry) byte {
+	ctx, cancel := withConnectTimeout(withTenant(s.ctx, tenant), tenant.connectTimeout)
+	ipPorts, err := s.dialer.resolveIPPorts(ctx, target)
+	cancel()
+	if err != nil {
+		reply := socks5ReplyFor(requestUUID, err)
+		writeSocks5Reply(conn, reply, nil)
+		return reply
+	}
+	listener, err := net.Listen("tcp4", net.JoinHostPort(localIP(conn), "0"))
+	if err != nil {
+		logError(requestUUID, "Could not listen for SOCKS5 BIND", err)
+		writeSocks5Reply(conn, socks5GeneralFailure, nil)
+		return socks5GeneralFailure
+	}
+	defer listener.Close()
+	if err := writeSocks5Reply(conn, socks5Succeeded, listener.Addr()); err != nil {
+		return socks5GeneralFailure
+	}
+
+	listener.(*net.TCPListener).SetDeadline(connectDeadline(tenant.connectTimeout))
+	accepted := make(chan struct{})
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			listener.Close()
+		case <-accepted:
+		}
+	}()
+	inboundConn, err := listener.Accept()
+	close(accepted)
+	if err != nil {
+		writeSocks5Reply(conn, socks5HostUnreach, nil)
+		return socks5HostUnreach
+	}
+	defer inboundConn.Close()
+	entry.targetIP, _, _ = net.SplitHostPort(inboundConn.RemoteAddr().String())
+	if !containsIP(ipPorts, entry.targetIP) {
+		logWarn(requestUUID, fmt.Sprintf("Rejecting SOCKS5 BIND connection from unexpected peer %s", entry.targetIP), nil)
+		writeSocks5Reply(conn, socks5NotAllowed, nil)
+		return socks5NotAllowed
+	}
+	if err := writeSocks5Reply(conn, socks5Succeeded, inboundConn.RemoteAddr()); err != nil {
+		return socks5Succeeded
+	}
+	entry.requestBytes, entry.responseBytes = s.relay(requestUUID, tenant, conn, reader, inboundConn)
+	return socks5Succeeded
+}
+
+// localIP is the IP the client connected to, which BIND and UDP ASSOCIATE listen on. Clients on a Unix
+// socket are on the same host, so they get the loopback address.
+func localIP(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+func clientIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+func containsIP(ipPorts []string, ip string) bool {
+	for _, ipPort := range ipPorts {
+		if host, _, _ := net.SplitHostPort(ipPort); host == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// relay copies data both ways until either side closes the connection, the connection lifetime is up, or the
+// target has been idle for the read timeout. It returns the number of bytes sent to and received from the target.
+func (s *Socks5Server) relay(requestUUID uuid.UUID, tenant *tenant, clientConn net.Conn, clientReader *bufio.Reader, targetConn net.Conn) (int64, int64) {
+	clientConn.SetDeadline(time.Time{})
+	lifetime := time.AfterFunc(tenant.connectionLifetime, func() {
+		clientConn.Close()
+		targetConn.Close()
+	})
+	defer lifetime.Stop()
+
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Errors here are usually just the other direction closing both connections
+		sent, _ = io.Copy(targetConn, clientReader)
+		if tcpConn, ok := targetConn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		} else {
+			targetConn.Close()
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		targetConn.SetReadDeadline(time.Now().Add(tenant.readTimeout))
+		n, err := targetConn.Read(buf)
+		if n > 0 {
+			received += int64(n)
+			if _, writeErr := clientConn.Write(buf[:n]); writeErr != nil {
+				break
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				logWarn(requestUUID, "Socket idle read time out reached", nil)
+			}
+			break
+		}
+	}
+	clientConn.Close()
+	targetConn.Close()
+	wg.Wait()
+	return sent, received
+}
+
+// handleUDPAssociate relays UDP datagrams between the client and targets until the client closes the TCP
+// connection. Every target must pass the same checks as a CONNECT target, and only datagrams from targets
+// the client has sent to are relayed back.
+func (s *Socks5Server) handleUDPAssociate(requestUUID uuid.UUID, tenant *tenant, conn net.Conn, reader *bufio.Reader, clientHint string, entry *accessLogEntry) byte {
+	udpConn, err := net.ListenPacket("udp4", net.JoinHostPort(localIP(conn), "0"))
+	if err != nil {
+		logError(requestUUID, "Could not listen for SOCKS5 UDP ASSOCIATE", err)
+		writeSocks5Reply(conn, socks5GeneralFailure, nil)
+		return socks5GeneralFailure
+	}
+	defer udpConn.Close()
+	if err := writeSocks5Reply(conn, socks5Succeeded, udpConn.LocalAddr()); err != nil {
+		return socks5Succeeded
+	}
+
+	ctx, cancel := context.WithCancel(withTenant(s.ctx, tenant))
+	association := &udpAssociation{
+		ctx:         ctx,
+		cancel:      cancel,
+		requestUUID: requestUUID,
+		conn:        udpConn,
+		dialer:      s.dialer,
+		tenant:      tenant,
+		clientIP:    clientIP(conn),
+		maxTargets:  udpMaxTargets,
+		idleTimeout: udpTargetIdleTimeout,
+		targets:     make(map[string]chan []byte),
+		remotes:     make(map[string]int),
+		outbound:    make(map[string]net.PacketConn),
+	}
+	// The client may tell us which port it will send from; a zero port means it doesn't know yet
+	if _, port, err := net.SplitHostPort(clientHint); err == nil && port != "0" {
+		association.clientPort, _ = strconv.Atoi(port)
+	}
+	association.goroutines.Add(1)
+	go association.serve()
+	defer association.close()
+
+	// The association lasts as long as the TCP connection, up to the connection lifetime
+	conn.SetDeadline(time.Now().Add(tenant.connectionLifetime))
+	io.Copy(ioutil.Discard, reader)
+	entry.requestBytes = atomic.LoadInt64(&association.sent)
+	entry.responseBytes = atomic.LoadInt64(&association.received)
+	return socks5Succeeded
+}
+
+const (
+	// udpTargetQueueSize is how many datagrams to a target can wait for it to be resolved before more are dropped
+	udpTargetQueueSize = 64
+	// udpMaxTargets is how many targets an association can send to at once; datagrams to more are dropped
+	udpMaxTargets = 256
+	// udpTargetIdleTimeout is how long an association keeps a target the client hasn't sent to. Replies from
+	// it are dropped after that, until the client sends to it again.
+	udpTargetIdleTimeout = 2 * time.Minute
+)
+
+// udpAssociation relays datagrams between the client, on conn, and its targets. Datagrams to a target go out
+// on a socket bound to the target's egress pool address, from a goroutine of their own, so resolving one
+// target doesn't hold up datagrams to the others.
+type udpAssociation struct {
+	// ctx is cancelled when the association closes, which stops target lookups in flight
+	ctx         context.Context
+	cancel      context.CancelFunc
+	requestUUID uuid.UUID
+	conn        net.PacketConn
+	dialer      *safeDialer
+	tenant      *tenant
+	clientIP    net.IP
+	clientPort  int
+	maxTargets  int
+	idleTimeout time.Duration
+	sent        int64
+	received    int64
+
+	mu         sync.Mutex
+	closed     bool
+	clientAddr *net.UDPAddr
+	// targets has the queue of datagrams to each requested target, and remotes counts the targets resolved
+	// to each IP:port we send datagrams to
+	targets     map[string]chan []byte
+	remotes     map[string]int
+	targetsFull bool
+	// outbound has the sockets datagrams to targets are sent from, by local IP
+	outbound map[string]net.PacketConn
+	// goroutines has the goroutines serving the client, sending to targets and relaying their replies
+	goroutines sync.WaitGroup
+}
+
+func (a *udpAssociation) serve() {
+	defer a.goroutines.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		from := addr.(*net.UDPAddr)
+		a.mu.Lock()
+		fromClient := a.isFromClient(from)
+		if fromClient {
+			a.clientAddr = from
+		}
+		a.mu.Unlock()
+		if fromClient {
+			a.forward(buf[:n])
+		}
+	}
+}
+
+func (a *udpAssociation) isFromClient(from *net.UDPAddr) bool {
+	if a.clientAddr != nil {
+		return from.IP.Equal(a.clientAddr.IP) && from.Port == a.clientAddr.Port
+	}
+	if !from.IP.Equal(a.clientIP) {
+		return false
+	}
+	return a.clientPort == 0 || from.Port == a.clientPort
+}
+
+// forward queues a datagram from the client for its target. Fragmented datagrams aren't supported, and are
+// dropped, as are datagrams to a target whose queue is full.
+func (a *udpAssociation) forward(datagram []byte) {
+	if len(datagram) < 4 || datagram[2] != 0 {
+		return
+	}
+	reader := bytes.NewReader(datagram[4:])
+	target, err := readSocks5Addr(reader, datagram[3])
+	if err != nil {
+		return
+	}
+	payload := append([]byte(nil), datagram[len(datagram)-reader.Len():]...)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	queue, ok := a.targets[target]
+	if !ok {
+		if len(a.targets) >= a.maxTargets {
+			if !a.targetsFull {
+				a.targetsFull = true
+				logWarn(a.requestUUID, fmt.Sprintf("Dropping SOCKS5 UDP datagrams to new targets, since the association already has %d", a.maxTargets), nil)
+			}
+			return
+		}
+		queue = make(chan []byte, udpTargetQueueSize)
+		a.targets[target] = queue
+		a.goroutines.Add(1)
+		go a.sendTo(target, queue)
+	}
+	select {
+	case queue <- payload:
+	default:
+	}
+}
+
+// sendTo resolves a target and sends it the datagrams queued for it until the association is closed, or the
+// client hasn't sent to the target for the idle timeout. If the target isn't allowed, its datagrams are dropped.
+func (a *udpAssociation) sendTo(target string, queue chan []byte) {
+	defer a.goroutines.Done()
+	ctx, cancel := withConnectTimeout(a.ctx, a.tenant.connectTimeout)
+	udpAddr, out, err := a.resolveTarget(ctx, target)
+	cancel()
+	if err != nil && a.ctx.Err() == nil {
+		logWarn(a.requestUUID, fmt.Sprintf("Dropping SOCKS5 UDP datagrams to %s", target), err)
+	}
+
+	idleDeadline := time.Now().Add(a.idleTimeout)
+	idle := time.NewTimer(a.idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case payload, ok := <-queue:
+			if !ok {
+				return
+			}
+			if err == nil {
+				if _, writeErr := out.WriteTo(payload, udpAddr); writeErr == nil {
+					atomic.AddInt64(&a.sent, int64(len(payload)))
+				}
+			}
+			idleDeadline = time.Now().Add(a.idleTimeout)
+		case <-idle.C:
+			if remaining := time.Until(idleDeadline); remaining > 0 {
+				idle.Reset(remaining)
+				continue
+			}
+			if a.expire(target, queue, udpAddr) {
+				return
+			}
+			idleDeadline = time.Now().Add(a.idleTimeout)
+			idle.Reset(a.idleTimeout)
+		}
+	}
+}
+
+// expire forgets an idle target, unless a datagram to it was queued in the meantime. udpAddr is where the
+// target resolved to, or nil if it couldn't be resolved.
+func (a *udpAssociation) expire(target string, queue chan []byte, udpAddr *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed || len(queue) > 0 {
+		return false
+	}
+	delete(a.targets, target)
+	a.targetsFull = false
+	if udpAddr != nil {
+		remote := udpAddr.String()
+		if a.remotes[remote]--; a.remotes[remote] <= 0 {
+			delete(a.remotes, remote)
+		}
+	}
+	return true
+}
+
+func (a *udpAssociation) resolveTarget(ctx context.Context, target string) (*net.UDPAddr, net.PacketConn, error) {
+	ipPorts, err := a.dialer.resolveIPPorts(ctx, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", ipPorts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _, _ := net.SplitHostPort(target)
+	pool, err := a.dialer.egressPools.poolFor(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	var localIP string
+	if pool != nil {
+		localIP = pool.nextAddr().IP.String()
+	}
+	out, err := a.outboundFrom(localIP)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.mu.Lock()
+	a.remotes[udpAddr.String()]++
+	a.mu.Unlock()
+	return udpAddr, out, nil
+}
+
+// outboundFrom returns the socket for datagrams sent from localIP, opening it and relaying replies to it if
+// it isn't open yet. An empty localIP leaves the source address to the OS.
+func (a *udpAssociation) outboundFrom(localIP string) (net.PacketConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, errors.New("association closed")
+	}
+	if out, ok := a.outbound[localIP]; ok {
+		return out, nil
+	}
+	out, err := net.ListenPacket("udp4", net.JoinHostPort(localIP, "0"))
+	if err != nil {
+		return nil, err
+	}
+	a.outbound[localIP] = out
+	a.goroutines.Add(1)
+	go a.relayReplies(out)
+	return out, nil
+}
+
+// relayReplies sends datagrams from targets the client has sent to back to the client
+func (a *udpAssociation) relayReplies(out net.PacketConn) {
+	defer a.goroutines.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := out.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		from := addr.(*net.UDPAddr)
+		a.mu.Lock()
+		known, clientAddr := a.remotes[from.String()] > 0, a.clientAddr
+		a.mu.Unlock()
+		if known && clientAddr != nil {
+			datagram := append([]byte{0, 0, 0}, encodeSocks5Addr(from)...)
+			datagram = append(datagram, buf[:n]...)
+			if _, err := a.conn.WriteTo(datagram, clientAddr); err == nil {
+				atomic.AddInt64(&a.received, int64(n))
+			}
+		}
+	}
+}
+
+// close closes the client and outbound sockets, and waits for the goroutines serving them and sending to
+// targets to return
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	a.closed = true
+	a.cancel()
+	a.conn.Close()
+	for _, queue := range a.targets {
+		close(queue)
+	}
+	for _, out := range a.outbound {
+		out.Close()
+	}
+	a.mu.Unlock()
+	a.goroutines.Wait()
+}
+
+// socks5ReplyError is a request parsing error that should be reported to the client with the given reply code
+type socks5ReplyError byte
+
+func (e socks5ReplyError) Error() string {
+	return fmt.Sprintf("SOCKS5 reply code %d", byte(e))
+}
+
+func readSocks5Request(reader *bufio.Reader) (byte, string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	target, err := readSocks5Addr(reader, header[3])
+	return header[1], target, err
+}
+
+// readSocks5Addr reads an address and port of the given address type. IPv6 addresses aren't supported since
+// outbound connections are IPv4 only.
+func readSocks5Addr(reader io.Reader, addrType byte) (string, error) {
+	var host string
+	switch addrType {
+	case socks5AddrIPv4:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		domain, err := readSocks5String(reader)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		return "", socks5ReplyError(socks5AddrNotSupp)
+	}
+	var port uint16
+	if err := binary.Read(reader, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func readSocks5String(reader io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length[0])
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func encodeSocks5Addr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+	}
+	encoded := append([]byte{socks5AddrIPv4}, ip4...)
+	return append(encoded, byte(port>>8), byte(port))
+}
+
+func writeSocks5Reply(conn net.Conn, reply byte, boundAddr net.Addr) error {
+	_, err := conn.Write(append([]byte{socks5Version, reply, 0}, encodeSocks5Addr(boundAddr)...))
+	return err
+}
+
+// socks5ReplyFor maps a dial error to the closest SOCKS5 reply code
+func socks5ReplyFor(requestUUID uuid.UUID, err error) byte {
+	if pErr, ok := err.(*proxyError); ok {
+		switch pErr.errorCode {
+		case UnableToResolveIP, InvalidHostname:
+			return socks5HostUnreach
+		}
+		return socks5NotAllowed
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetUnreachable
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.As(err, &dnsErr) || errors.As(err, &netErr) {
+		return socks5HostUnreach
+	}
+	logError(requestUUID, "Unexpected error in SOCKS5 request", err)
+	return socks5GeneralFailure
+}
+
+func socks5CommandName(cmd byte) string {
+	if name, ok := socks5Commands[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", cmd)
+}
+
+// socks5StatusCodes maps SOCKS5 replies to the status an HTTP request failing the same way gets, so that
+// response_code in the access log and the status_class of the request metrics mean the same for both
+var socks5StatusCodes = map[byte]int{
+	socks5Succeeded:      http.StatusOK,
+	socks5GeneralFailure: http.StatusInternalServerError,
+	socks5NotAllowed:     http.StatusForbidden,
+	socks5NetUnreachable: http.StatusBadGateway,
+	socks5HostUnreach:    http.StatusBadGateway,
+	socks5ConnRefused:    http.StatusBadGateway,
+	socks5CmdNotSupp:     http.StatusNotImplemented,
+	socks5AddrNotSupp:    http.StatusBadRequest,
+}
+
+func socks5StatusCode(reply byte) int {
+	if code, ok := socks5StatusCodes[reply]; ok {
+		return code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,375 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	proxySocks5Address = "127.0.0.1:11092"
+	udpTargetPort      = "14400"
+)
+
+func startSocks5Proxy(t *testing.T, configSetup func(*ProxyConfig, *ListenerConfig)) *Socks5Server {
+	config := NewDefaultConfig()
+	config.CidrAllowList = []Cidr{Cidr(mustParseCIDR(t, "127.0.0.0/8"))}
+	config.AllowedPorts = append(config.AllowedPorts, testTargetPorts...)
+	listenerConfig := ListenerConfig{Address: proxySocks5Address, Type: SOCKS5}
+	if configSetup != nil {
+		configSetup(config, &listenerConfig)
+	}
+	config.Listeners = []ListenerConfig{listenerConfig}
+	setupLogging(config)
+	server := CreateSocks5Servers(config, newSafeDialer(config))[0]
+	listener, err := net.Listen("tcp4", proxySocks5Address)
+	if err != nil {
+		t.Fatalf("Could not start SOCKS5 proxy listener: %s\n", err)
+	}
+	go server.Serve(listener)
+	// Close waits for the connections and UDP associations to finish, so none of them log into the next test
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("Invalid CIDR %s: %s", s, err)
+	}
+	return *cidr
+}
+
+func socks5HTTPClient(t *testing.T, auth *proxy.Auth) *http.Client {
+	dialer, err := proxy.SOCKS5("tcp", proxySocks5Address, auth, proxy.Direct)
+	if err != nil {
+		t.Fatalf("Failed to create SOCKS5 dialer: %s", err)
+	}
+	return &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+}
+
+// socks5Handshake connects to the proxy and sends a request for the given command, returning the connection
+// and the reply code
+func socks5Handshake(t *testing.T, cmd byte, target *net.TCPAddr) (net.Conn, *bufio.Reader, byte, *net.TCPAddr) {
+	conn, err := net.Dial("tcp4", proxySocks5Address)
+	if err != nil {
+		t.Fatalf("Failed to connect to SOCKS5 proxy: %s", err)
+	}
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	reader := bufio.NewReader(conn)
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(reader, method); err != nil || method[1] != socks5AuthNone {
+		t.Fatalf("SOCKS5 method negotiation failed: %v %v", method, err)
+	}
+	conn.Write(append([]byte{socks5Version, cmd, 0}, encodeSocks5Addr(target)...))
+	reply, bound := readSocks5Reply(t, reader)
+	return conn, reader, reply, bound
+}
+
+func readSocks5Reply(t *testing.T, reader *bufio.Reader) (byte, *net.TCPAddr) {
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS5 reply: %s", err)
+	}
+	return reply[1], &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+}
+
+func TestSocks5Connect(t *testing.T) {
+	target := startTargetServer(t)
+	defer target.Close()
+	server := startSocks5Proxy(t, nil)
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	t.Run("Allowed target", func(t *testing.T) {
+		resp, err := socks5HTTPClient(t, nil).Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		checkNoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkNoError(t, err)
+		assertEqual(t, "Hello from target", string(body))
+	})
+
+	t.Run("Port not allowed", func(t *testing.T) {
+		_, err := socks5HTTPClient(t, nil).Get("http://127.0.0.1:25/target")
+		assertError(t, "connection not allowed by ruleset", err)
+	})
+
+	t.Run("Connection refused", func(t *testing.T) {
+		_, err := socks5HTTPClient(t, nil).Get("http://127.0.0.1:14402/target")
+		assertError(t, "connection refused", err)
+	})
+
+	t.Run("Logs the reply and counts the session", func(t *testing.T) {
+		accessLogBuffer := new(bytes.Buffer)
+		accessLog.Out = accessLogBuffer
+		accessLog.SetFormatter(&logrus.JSONFormatter{})
+		defer func() {
+			accessLog.Out = os.Stdout
+			accessLog.SetFormatter(&AccessLogTextFormatter{})
+		}()
+		labels := map[string]string{"listener": proxySocks5Address, "status_class": "4xx"}
+		before := counterValue(t, requestsCounter, labels)
+
+		socks5HTTPClient(t, nil).Get("http://127.0.0.1:25/target")
+		// The session is logged, then counted, after the client has its reply
+		deadline := time.Now().Add(5 * time.Second)
+		for counterValue(t, requestsCounter, labels) == before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assertEqual(t, before+1, counterValue(t, requestsCounter, labels))
+		record := make(map[string]interface{})
+		checkNoError(t, json.Unmarshal(accessLogBuffer.Bytes(), &record))
+		assertEqual(t, "2", record["socks_reply"])
+		assertEqual(t, float64(http.StatusForbidden), record["response_code"])
+	})
+}
+
+func TestSocks5CidrDenyList(t *testing.T) {
+	target := startTargetServer(t)
+	defer target.Close()
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		config.CidrAllowList = nil
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	_, err := socks5HTTPClient(t, nil).Get(fmt.Sprintf("http://127.0.0.1:%s/target", httpTargetServerPort))
+	assertError(t, "connection not allowed by ruleset", err)
+}
+
+func TestSocks5AllowedClients(t *testing.T) {
+	target := startTargetServer(t)
+	defer target.Close()
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		l.AllowedClientCidrs = []Cidr{Cidr(mustParseCIDR(t, "10.0.0.0/8"))}
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	_, err := socks5HTTPClient(t, nil).Get(fmt.Sprintf("http://127.0.0.1:%s/target", httpTargetServerPort))
+	assertError(t, "connection not allowed by ruleset", err)
+}
+
+func TestSocks5Authentication(t *testing.T) {
+	target := startTargetServer(t)
+	defer target.Close()
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		l.Socks5.Users = map[string]string{"webhooks": "s3cret"}
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	t.Run("Valid credentials", func(t *testing.T) {
+		resp, err := socks5HTTPClient(t, &proxy.Auth{User: "webhooks", Password: "s3cret"}).Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		checkNoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkNoError(t, err)
+		assertEqual(t, "Hello from target", string(body))
+	})
+
+	t.Run("Invalid password", func(t *testing.T) {
+		_, err := socks5HTTPClient(t, &proxy.Auth{User: "webhooks", Password: "wrong"}).Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		assertError(t, "username/password authentication failed", err)
+	})
+
+	t.Run("No credentials", func(t *testing.T) {
+		_, err := socks5HTTPClient(t, nil).Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+		assertError(t, "no acceptable authentication methods", err)
+	})
+}
+
+func TestSocks5BindAndUDPAssociateRejectedByDefault(t *testing.T) {
+	server := startSocks5Proxy(t, nil)
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	for _, cmd := range []byte{socks5CmdBind, socks5CmdUDPAssoc} {
+		conn, _, reply, _ := socks5Handshake(t, cmd, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 14400})
+		conn.Close()
+		assertEqual(t, byte(socks5CmdNotSupp), reply)
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		l.Socks5.AllowBind = true
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	conn, reader, reply, bound := socks5Handshake(t, socks5CmdBind, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 14400})
+	defer conn.Close()
+	assertEqual(t, byte(socks5Succeeded), reply)
+
+	peer, err := net.Dial("tcp4", bound.String())
+	checkNoError(t, err)
+	defer peer.Close()
+	reply, _ = readSocks5Reply(t, reader)
+	assertEqual(t, byte(socks5Succeeded), reply)
+
+	peer.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	checkNoError(t, err)
+	assertEqual(t, "hello", string(buf))
+}
+
+func TestSocks5UDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:"+udpTargetPort)
+	checkNoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo([]byte(strings.ToUpper(string(buf[:n]))), addr)
+		}
+	}()
+
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		l.Socks5.AllowUDPAssociate = true
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	conn, _, reply, relayAddr := socks5Handshake(t, socks5CmdUDPAssoc, &net.TCPAddr{IP: net.IPv4zero})
+	defer conn.Close()
+	assertEqual(t, byte(socks5Succeeded), reply)
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	checkNoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	relay := &net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port}
+
+	t.Run("Relays datagrams to allowed targets", func(t *testing.T) {
+		datagram := append([]byte{0, 0, 0, socks5AddrDomain, byte(len("localhost"))}, "localhost"...)
+		datagram = append(datagram, 0x38, 0x40) // port 14400
+		client.WriteTo(append(datagram, "ping"...), relay)
+
+		buf := make([]byte, 1024)
+		n, _, err := client.ReadFrom(buf)
+		checkNoError(t, err)
+		// RSV, FRAG, then the IPv4 source address and port
+		assertEqual(t, "127.0.0.1:"+udpTargetPort, (&net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(buf[8])<<8 | int(buf[9])}).String())
+		assertEqual(t, "PING", string(buf[10:n]))
+	})
+
+	t.Run("Drops datagrams to disallowed ports", func(t *testing.T) {
+		datagram := append([]byte{0, 0, 0, socks5AddrIPv4, 127, 0, 0, 1}, 0, 25)
+		client.WriteTo(append(datagram, "ping"...), relay)
+		client.SetDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err := client.ReadFrom(make([]byte, 1024))
+		if err == nil {
+			t.Error("Expected datagram to a disallowed port to be dropped")
+		}
+	})
+}
+
+func TestSocks5UDPAssociateEgressAndSlowLookups(t *testing.T) {
+	// The echo server answers with the address the datagram came from
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:"+udpTargetPort)
+	checkNoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			_, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo([]byte(addr.(*net.UDPAddr).IP.String()), addr)
+		}
+	}()
+	// A DNS server that never answers, so lookups of anything but the static hosts hang until the timeout
+	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	checkNoError(t, err)
+	defer blackhole.Close()
+
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		l.Socks5.AllowUDPAssociate = true
+		config.DNS = DNSConfig{Servers: []string{blackhole.LocalAddr().String()}, Timeout: 3 * time.Second, Hosts: map[string]string{"localhost": "127.0.0.1"}}
+		config.EgressPools = []EgressPoolConfig{{Name: "shared", Addresses: []string{"127.0.0.2"}}}
+		config.DefaultEgressPool = "shared"
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	conn, _, reply, relayAddr := socks5Handshake(t, socks5CmdUDPAssoc, &net.TCPAddr{IP: net.IPv4zero})
+	defer conn.Close()
+	assertEqual(t, byte(socks5Succeeded), reply)
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	checkNoError(t, err)
+	defer client.Close()
+	relay := &net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port}
+
+	for _, host := range []string{"slow.test", "localhost"} {
+		datagram := append([]byte{0, 0, 0, socks5AddrDomain, byte(len(host))}, host...)
+		datagram = append(datagram, 0x38, 0x40) // port 14400
+		client.WriteTo(append(datagram, "ping"...), relay)
+	}
+	// The reply from localhost must not wait for slow.test to resolve
+	client.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFrom(buf)
+	checkNoError(t, err)
+	assertEqual(t, "127.0.0.2", string(buf[10:n]))
+}
+
+func TestUDPAssociationTargetLimits(t *testing.T) {
+	config := NewDefaultConfig()
+	config.CidrAllowList = []Cidr{Cidr(mustParseCIDR(t, "127.0.0.0/8"))}
+	config.AllowedPorts = append(config.AllowedPorts, testTargetPorts...)
+	sd := newSafeDialer(config)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	checkNoError(t, err)
+	ctx, cancel := context.WithCancel(withTenant(context.Background(), sd.tenants.defaultTenant))
+	association := &udpAssociation{
+		ctx:         ctx,
+		cancel:      cancel,
+		conn:        conn,
+		dialer:      sd,
+		tenant:      sd.tenants.defaultTenant,
+		maxTargets:  2,
+		idleTimeout: 200 * time.Millisecond,
+		targets:     make(map[string]chan []byte),
+		remotes:     make(map[string]int),
+		outbound:    make(map[string]net.PacketConn),
+	}
+	defer association.close()
+	targetCount := func() (int, int) {
+		association.mu.Lock()
+		defer association.mu.Unlock()
+		return len(association.targets), len(association.remotes)
+	}
+
+	for _, port := range []byte{0x40, 0x41, 0x42} {
+		association.forward(append([]byte{0, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0x38, port}, "ping"...))
+	}
+	targets, _ := targetCount()
+	assertEqual(t, 2, targets)
+
+	time.Sleep(time.Second)
+	targets, remotes := targetCount()
+	assertEqual(t, 0, targets)
+	assertEqual(t, 0, remotes)
+}
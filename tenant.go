@@ -0,0 +1,150 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TenantHeader selects a tenant profile for a request that isn't already tied to one by its listener or identity
+const TenantHeader = "X-WhSentry-Tenant"
+
+const tenantKey key = 2
+
+// tenantCertAliasPrefix namespaces the client certificates of tenants, so a request can't pick another
+// tenant's certificate by alias
+const tenantCertAliasPrefix = "tenant:"
+
+func tenantCertAlias(name string) string {
+	return tenantCertAliasPrefix + name
+}
+
+// tenant holds the settings that apply to a request: those of its tenant profile, with anything the profile
+// doesn't set taken from the global config. Requests without a tenant get the default tenant, which has no
+// name and only the global settings.
+type tenant struct {
+	name                 string
+	connectTimeout       time.Duration
+	connectionLifetime   time.Duration
+	readTimeout          time.Duration
+	maxResponseBodySize  uint32
+	responseOverflowMode OverflowMode
+	maxRequestBodySize   uint32
+	hostPolicy           *hostPolicy
+	portPolicy           *portPolicy
+	// clientCertAlias is the client certificate used when the request doesn't ask for one, if not the default
+	clientCertAlias string
+	// egressPool is used when the request doesn't select one by name, if not the one picked by destination
+	egressPool string
+}
+
+type tenants struct {
+	defaultTenant *tenant
+	byName        map[string]*tenant
+	byIdentity    map[string]*tenant
+}
+
+func newTenants(config *ProxyConfig) *tenants {
+	defaultTenant := &tenant{
+		connectTimeout:       config.ConnectTimeout,
+		connectionLifetime:   config.ConnectionLifetime,
+		readTimeout:          config.ReadTimeout,
+		maxResponseBodySize:  config.MaxResponseBodySize,
+		responseOverflowMode: config.ResponseOverflowMode,
+		maxRequestBodySize:   config.MaxRequestBodySize,
+		hostPolicy:           &hostPolicy{denyList: config.HostDenyList, allowList: config.HostAllowList},
+		portPolicy:           newPortPolicy(config.AllowedPorts, config.PortExceptions),
+	}
+	t := &tenants{
+		defaultTenant: defaultTenant,
+		byName:        make(map[string]*tenant),
+		byIdentity:    make(map[string]*tenant),
+	}
+	for _, tenantConfig := range config.Tenants {
+		profile := *defaultTenant
+		profile.name = tenantConfig.Name
+		profile.egressPool = tenantConfig.EgressPool
+		if tenantConfig.ConnectTimeout > 0 {
+			profile.connectTimeout = tenantConfig.ConnectTimeout
+		}
+		if tenantConfig.ConnectionLifetime > 0 {
+			profile.connectionLifetime = tenantConfig.ConnectionLifetime
+		}
+		if tenantConfig.ReadTimeout > 0 {
+			profile.readTimeout = tenantConfig.ReadTimeout
+		}
+		if tenantConfig.MaxResponseBodySize > 0 {
+			profile.maxResponseBodySize = tenantConfig.MaxResponseBodySize
+		}
+		if tenantConfig.ResponseOverflowMode != "" {
+			profile.responseOverflowMode = tenantConfig.ResponseOverflowMode
+		}
+		if tenantConfig.MaxRequestBodySize > 0 {
+			profile.maxRequestBodySize = tenantConfig.MaxRequestBodySize
+		}
+		// The global policies always apply, so a tenant can only narrow the hosts and ports it may connect to
+		profile.hostPolicy = &hostPolicy{denyList: tenantConfig.HostDenyList, allowList: tenantConfig.HostAllowList, within: defaultTenant.hostPolicy}
+		if len(tenantConfig.AllowedPorts) > 0 {
+			ports := newPortPolicy(tenantConfig.AllowedPorts, nil)
+			ports.within = defaultTenant.portPolicy
+			profile.portPolicy = ports
+		}
+		if _, ok := config.ClientCerts[tenantCertAlias(tenantConfig.Name)]; ok {
+			profile.clientCertAlias = tenantCertAlias(tenantConfig.Name)
+		}
+		t.byName[profile.name] = &profile
+		for _, identity := range tenantConfig.Identities {
+			t.byIdentity[identity] = &profile
+		}
+	}
+	return t
+}
+
+// resolve picks the tenant for a request. An authenticated identity that belongs to a tenant takes precedence,
+// then the listener's tenant. The tenant header can only pick a tenant if neither of those applies and the
+// listener allows it, or if it names the same tenant, so a client can't switch to another tenant's settings.
+func (t *tenants) resolve(listenerTenant string, allowedTenants []string, identity string, requested string) (*tenant, error) {
+	selected := listenerTenant
+	if profile, ok := t.byIdentity[identity]; ok && identity != "" {
+		selected = profile.name
+	}
+	if requested != "" {
+		if selected != requested && (selected != "" || !containsString(allowedTenants, requested)) {
+			return nil, &proxyError{statusCode: http.StatusForbidden, message: fmt.Sprintf("Tenant %s is not allowed for this client", requested), errorCode: TenantNotAllowed}
+		}
+		selected = requested
+	}
+	if selected == "" {
+		return t.defaultTenant, nil
+	}
+	profile, ok := t.byName[selected]
+	if !ok {
+		return nil, &proxyError{statusCode: http.StatusBadRequest, message: fmt.Sprintf("Tenant %s not found", selected), errorCode: TenantNotFound}
+	}
+	return profile, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey, t)
+}
+
+// tenantFor returns the tenant a dial is for, falling back to the default tenant
+func (s *safeDialer) tenantFor(ctx context.Context) *tenant {
+	if t, ok := ctx.Value(tenantKey).(*tenant); ok {
+		return t
+	}
+	return s.tenants.defaultTenant
+}
@@ -0,0 +1,271 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestTenantResolution(t *testing.T) {
+	config := NewDefaultConfig()
+	config.HostDenyList = []HostPattern{mustParseHostPattern(t, "metadata.google.internal")}
+	config.Tenants = []TenantConfig{
+		{Name: "billing", Identities: []string{"billing-svc"}, ConnectTimeout: 2 * time.Second, AllowedPorts: []uint16{443}},
+		{Name: "crm", HostDenyList: []HostPattern{mustParseHostPattern(t, ".internal.example.com")}},
+	}
+	tenants := newTenants(config)
+
+	t.Run("No tenant", func(t *testing.T) {
+		tenant, err := tenants.resolve("", nil, "", "")
+		checkNoError(t, err)
+		assertEqual(t, "", tenant.name)
+		assertEqual(t, config.ConnectTimeout, tenant.connectTimeout)
+	})
+
+	t.Run("By header", func(t *testing.T) {
+		tenant, err := tenants.resolve("", []string{"crm"}, "", "crm")
+		checkNoError(t, err)
+		assertEqual(t, "crm", tenant.name)
+	})
+
+	t.Run("Header needs the listener to allow the tenant", func(t *testing.T) {
+		_, err := tenants.resolve("", nil, "", "crm")
+		assertError(t, "Tenant crm is not allowed for this client", err)
+		_, err = tenants.resolve("", []string{"crm"}, "", "billing")
+		assertError(t, "Tenant billing is not allowed for this client", err)
+	})
+
+	t.Run("By listener", func(t *testing.T) {
+		tenant, err := tenants.resolve("crm", nil, "", "")
+		checkNoError(t, err)
+		assertEqual(t, "crm", tenant.name)
+	})
+
+	t.Run("Identity takes precedence over listener", func(t *testing.T) {
+		tenant, err := tenants.resolve("crm", nil, "billing-svc", "")
+		checkNoError(t, err)
+		assertEqual(t, "billing", tenant.name)
+	})
+
+	t.Run("Header can't switch tenants", func(t *testing.T) {
+		_, err := tenants.resolve("crm", []string{"billing"}, "", "billing")
+		assertError(t, "Tenant billing is not allowed for this client", err)
+		tenant, err := tenants.resolve("", nil, "billing-svc", "billing")
+		checkNoError(t, err)
+		assertEqual(t, "billing", tenant.name)
+	})
+
+	t.Run("Unknown tenant", func(t *testing.T) {
+		_, err := tenants.resolve("", []string{"missing"}, "", "missing")
+		assertError(t, "Tenant missing not found", err)
+	})
+
+	t.Run("Overrides and inherited settings", func(t *testing.T) {
+		billing := tenants.byName["billing"]
+		assertEqual(t, 2*time.Second, billing.connectTimeout)
+		assertEqual(t, config.ReadTimeout, billing.readTimeout)
+		assertEqual(t, config.MaxResponseBodySize, billing.maxResponseBodySize)
+		checkNoError(t, billing.portPolicy.checkPort("example.com", "443"))
+		assertError(t, "Port 80 is not allowed", billing.portPolicy.checkPort("example.com", "80"))
+	})
+
+	t.Run("Deny lists add to the global one", func(t *testing.T) {
+		crm := tenants.byName["crm"]
+		assertError(t, "blocked by rule", crm.hostPolicy.checkHost("metadata.google.internal"))
+		assertError(t, "blocked by rule", crm.hostPolicy.checkHost("db.internal.example.com"))
+		checkNoError(t, tenants.defaultTenant.hostPolicy.checkHost("db.internal.example.com"))
+	})
+
+	t.Run("Allow lists narrow the global ones", func(t *testing.T) {
+		config := NewDefaultConfig()
+		config.HostAllowList = []HostPattern{mustParseHostPattern(t, ".example.com")}
+		config.AllowedPorts = []uint16{80, 443}
+		config.PortExceptions = []PortException{{Host: mustParseHostPattern(t, "smtp.example.com"), Ports: []uint16{25}}}
+		config.Tenants = []TenantConfig{{
+			Name:          "mail",
+			HostAllowList: []HostPattern{mustParseHostPattern(t, "smtp.example.com"), mustParseHostPattern(t, "smtp.other.com")},
+			AllowedPorts:  []uint16{25, 443, 8443},
+		}}
+		mail := newTenants(config).byName["mail"]
+		checkNoError(t, mail.hostPolicy.checkHost("smtp.example.com"))
+		assertError(t, "not in the allow list", mail.hostPolicy.checkHost("smtp.other.com"))
+		assertError(t, "not in the allow list", mail.hostPolicy.checkHost("www.example.com"))
+		checkNoError(t, mail.portPolicy.checkPort("smtp.example.com", "25"))
+		checkNoError(t, mail.portPolicy.checkPort("smtp.example.com", "443"))
+		assertError(t, "Port 80 is not allowed", mail.portPolicy.checkPort("smtp.example.com", "80"))
+		assertError(t, "Port 8443 is not allowed", mail.portPolicy.checkPort("smtp.example.com", "8443"))
+		assertError(t, "Port 25 is not allowed", mail.portPolicy.checkPort("www.example.com", "25"))
+	})
+}
+
+func TestTenantProfiles(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.EgressPools = []EgressPoolConfig{{Name: "billing", Addresses: []string{"127.0.0.5"}}}
+			config.Tenants = []TenantConfig{
+				{Name: "billing", EgressPool: "billing"},
+				{Name: "restricted", HostAllowList: []HostPattern{mustParseHostPattern(t, "example.com")}},
+			}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startSourceIPTargetServer(t)}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+	accessLogBuffer := new(bytes.Buffer)
+	accessLog.Out = accessLogBuffer
+	defer func() { accessLog.Out = os.Stdout }()
+
+	getAsTenant := func(tenant string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://localhost:12082/", nil)
+		req.Header.Set(TenantHeader, tenant)
+		resp, err := client.Do(req)
+		checkNoError(t, err)
+		return resp
+	}
+
+	t.Run("Tenant settings apply", func(t *testing.T) {
+		resp := getAsTenant("billing")
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "127.0.0.5", string(body))
+		if !strings.Contains(accessLogBuffer.String(), " 127.0.0.5 billing\n") {
+			t.Errorf("Expected tenant in access log, got %s", accessLogBuffer.String())
+		}
+	})
+
+	t.Run("Tenant destinations", func(t *testing.T) {
+		assertReasonCode(t, getAsTenant("restricted"), http.StatusForbidden, HostnameNotAllowed)
+	})
+
+	t.Run("Tenant not allowed on the listener", func(t *testing.T) {
+		assertReasonCode(t, getAsTenant("missing"), http.StatusForbidden, TenantNotAllowed)
+	})
+}
+
+func TestSocks5TenantIdentity(t *testing.T) {
+	target := startTargetServer(t)
+	defer target.Close()
+	server := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		l.Socks5.Users = map[string]string{"billing-svc": "s3cret", "crm-svc": "s3cret"}
+		config.Tenants = []TenantConfig{{Name: "billing", Identities: []string{"billing-svc"}, AllowedPorts: []uint16{443}}}
+	})
+	defer server.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	targetURL := fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort)
+	_, err := socks5HTTPClient(t, &proxy.Auth{User: "billing-svc", Password: "s3cret"}).Get(targetURL)
+	assertError(t, "connection not allowed by ruleset", err)
+
+	resp, err := socks5HTTPClient(t, &proxy.Auth{User: "crm-svc", Password: "s3cret"}).Get(targetURL)
+	checkNoError(t, err)
+	assertEqual(t, 200, resp.StatusCode)
+}
+
+func TestMitmTenantClientCert(t *testing.T) {
+	fixture := &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.RootCACerts = c.rootCAs
+			config.MitmIssuerCert = c.rootCACert
+			config.ClientCerts = map[string]tls.Certificate{tenantCertAlias("billing"): *c.clientCert}
+			config.Tenants = []TenantConfig{{Name: "billing"}, {Name: "crm"}}
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startTargetHTTPSServerWithClientCertCheck(t, c.serverCert, c.rootCAs)}
+		},
+		transportSetup: func(tr *http.Transport, c *certificateFixtures) {
+			tr.TLSClientConfig = &tls.Config{RootCAs: c.rootCAs}
+		},
+	}
+	client := fixture.setUp(t)
+	defer fixture.tearDown(t)
+	targetURL := fmt.Sprintf("https://localhost:%s/target", httpsTargetServerWithClientCertCheckPort)
+	connectWith := func(header http.Header) (*http.Response, error) {
+		tr := client.Transport.(*http.Transport).Clone()
+		tr.ProxyConnectHeader = header
+		return (&http.Client{Transport: tr}).Get(targetURL)
+	}
+
+	t.Run("Tenant certificate", func(t *testing.T) {
+		resp, err := connectWith(http.Header{TenantHeader: {"billing"}})
+		checkNoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "Hello from target HTTPS with client cert check", string(body))
+	})
+
+	t.Run("No certificate without the tenant", func(t *testing.T) {
+		if _, err := connectWith(http.Header{TenantHeader: {"crm"}}); err == nil {
+			t.Error("Expected the target to reject the connection without a client certificate")
+		}
+	})
+
+	t.Run("Another tenant's certificate", func(t *testing.T) {
+		_, err := connectWith(http.Header{TenantHeader: {"crm"}, "X-Whsentry-Clientcert": {tenantCertAlias("billing")}})
+		assertError(t, "Bad Request", err)
+	})
+}
+
+func TestHTTPTenantIdentity(t *testing.T) {
+	target := startSourceIPTargetServer(t)
+	defer target.Shutdown(context.TODO())
+	config := NewDefaultConfig()
+	config.InsecureSkipCidrDenyList = true
+	config.AllowedPorts = append(config.AllowedPorts, testTargetPorts...)
+	config.EgressPools = []EgressPoolConfig{{Name: "billing", Addresses: []string{"127.0.0.5"}}}
+	config.Tenants = []TenantConfig{{Name: "billing", Identities: []string{"billing-svc"}, EgressPool: "billing"}}
+	config.Listeners = []ListenerConfig{{
+		Address: proxyHttpAddress,
+		Type:    HTTP,
+		Users:   map[string]string{"billing-svc": "s3cret", "crm-svc": "s3cret"},
+	}}
+	setupLogging(config)
+	server := createTestProxyServer(t, config)
+	listener, err := net.Listen("tcp4", proxyHttpAddress)
+	checkNoError(t, err)
+	go server.Serve(listener)
+	defer server.Shutdown(context.TODO())
+
+	getAs := func(userinfo *url.Userinfo) *http.Response {
+		proxyURL := &url.URL{Scheme: "http", Host: proxyHttpAddress, User: userinfo}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get("http://localhost:12082/")
+		checkNoError(t, err)
+		return resp
+	}
+
+	t.Run("Identity picks the tenant", func(t *testing.T) {
+		body, _ := ioutil.ReadAll(getAs(url.UserPassword("billing-svc", "s3cret")).Body)
+		assertEqual(t, "127.0.0.5", string(body))
+	})
+
+	t.Run("Identity without a tenant", func(t *testing.T) {
+		body, _ := ioutil.ReadAll(getAs(url.UserPassword("crm-svc", "s3cret")).Body)
+		assertEqual(t, "127.0.0.1", string(body))
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		resp := getAs(url.UserPassword("billing-svc", "wrong"))
+		assertEqual(t, `Basic realm="webhook-sentry"`, resp.Header.Get("Proxy-Authenticate"))
+		assertReasonCode(t, resp, http.StatusProxyAuthRequired, ProxyAuthRequired)
+	})
+
+	t.Run("No credentials", func(t *testing.T) {
+		assertReasonCode(t, getAs(nil), http.StatusProxyAuthRequired, ProxyAuthRequired)
+	})
+}
@@ -0,0 +1,576 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// W3C trace context headers, in canonical form
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+)
+
+const spanKey key = 4
+
+// Span kinds and status codes as numbered by OTLP
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+)
+
+const (
+	spanStatusUnset = 0
+	spanStatusError = 2
+)
+
+// spanContext is the part of a span that's propagated in the traceparent header
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header. Versions after 00 may add fields at the end, which are
+// ignored, as the spec asks.
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return sc, false
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, false
+	}
+	version, ok := decodeLowerHex(value[0:2])
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(value) != 55) {
+		return sc, false
+	}
+	traceID, ok := decodeLowerHex(value[3:35])
+	if !ok {
+		return sc, false
+	}
+	spanID, ok := decodeLowerHex(value[36:52])
+	if !ok {
+		return sc, false
+	}
+	flags, ok := decodeLowerHex(value[53:55])
+	if !ok {
+		return sc, false
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// decodeLowerHex rejects upper case hex digits, which the traceparent format doesn't allow
+func decodeLowerHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+func (sc spanContext) traceparent() string {
+	var flags byte
+	if sc.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", sc.traceID, sc.spanID, flags)
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// span times one operation of a request. All of its methods do nothing on a nil span, which is what
+// startSpan returns when tracing is off, so callers don't need to check.
+type span struct {
+	spanContext
+	tracer       *tracer
+	parentID     [8]byte
+	name         string
+	kind         spanKind
+	start        time.Time
+	end          time.Time
+	attributes   []spanAttribute
+	errorMessage string
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes = append(s.attributes, spanAttribute{key: key, value: value})
+}
+
+// setError marks the span as failed; a nil err leaves it alone
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.errorMessage = err.Error()
+}
+
+// finish ends the span and queues it for export if it's sampled
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.sampled {
+		s.tracer.queueSpan(s)
+	}
+}
+
+// finishWithError is a shorthand for setError followed by finish
+func (s *span) finishWithError(err error) {
+	s.setError(err)
+	s.finish()
+}
+
+// annotateSpan adds the outcome of a request, as recorded for the access log, to its span. A request the proxy
+// rejected or couldn't complete is marked as failed with its reason code.
+func (e *accessLogEntry) annotateSpan(s *span) {
+	if s == nil {
+		return
+	}
+	if e.tenant != "" {
+		s.setAttribute("whsentry.tenant", e.tenant)
+	}
+	if host, _, err := net.SplitHostPort(e.clientAddr); err == nil {
+		s.setAttribute("http.client_ip", host)
+	}
+	if e.targetIP != "" {
+		s.setAttribute("net.peer.ip", e.targetIP)
+	}
+	s.setAttribute("http.status_code", e.responseCode)
+	s.setAttribute("http.request_content_length", e.requestBytes)
+	s.setAttribute("http.response_content_length", e.responseBytes)
+	if e.reasonCode != "" {
+		s.setAttribute("whsentry.reason_code", e.reasonCode)
+		s.errorMessage = e.reasonCode
+	}
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey).(*span)
+	return s
+}
+
+// startSpan starts a child of the span in ctx. Operations that aren't part of a traced request, like those
+// of SOCKS5 connections, get no span.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, spanKindInternal, parent.spanContext)
+	s.parentID = parent.spanID
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// tracer exports spans in batches in the background. Spans are dropped if the queue is full or the tracer is
+// closed, and the number dropped is logged with the next batch.
+type tracer struct {
+	config   TracingConfig
+	exporter spanExporter
+	// file is the trace file of the file exporter, closed with the tracer
+	file    *os.File
+	queue   chan *span
+	done    chan struct{}
+	dropped uint64
+	// sampleBound is compared against the low 63 bits of a new trace's ID, so the decision is the same
+	// wherever the ID is seen
+	sampleBound uint64
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newTracer returns nil if tracing isn't enabled
+func newTracer(config TracingConfig) (*tracer, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	t := &tracer{
+		config:      config,
+		queue:       make(chan *span, config.QueueSize),
+		done:        make(chan struct{}),
+		sampleBound: uint64(config.SampleRatio * math.MaxInt64),
+	}
+	if config.SampleRatio >= 1 {
+		t.sampleBound = math.MaxInt64
+	}
+	switch config.Exporter {
+	case OTLPExporter:
+		t.exporter = &otlpExporter{
+			endpoint:   config.Endpoint,
+			headers:    config.Headers,
+			client:     &http.Client{Timeout: config.Timeout},
+			backoff:    defaultExportBackoff,
+			maxRetries: defaultExportMaxRetries,
+		}
+	case StdoutExporter:
+		t.exporter = &writerExporter{w: os.Stdout}
+	case FileExporter:
+		f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot open trace file: %s", err)
+		}
+		t.file = f
+		t.exporter = &writerExporter{w: f}
+	}
+	go t.run()
+	return t, nil
+}
+
+// startRequestSpan starts the span of a proxied request, continuing the caller's trace if the request has a
+// valid traceparent header
+func (t *tracer) startRequestSpan(ctx context.Context, r *http.Request, requestUUID uuid.UUID) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	var s *span
+	if remote, ok := parseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+		s = t.newSpan("proxy request", spanKindServer, remote)
+		s.parentID = remote.spanID
+	} else {
+		var traceID [16]byte
+		rand.Read(traceID[:])
+		sampled := binary.BigEndian.Uint64(traceID[8:])&math.MaxInt64 < t.sampleBound
+		s = t.newSpan("proxy request", spanKindServer, spanContext{traceID: traceID, sampled: sampled})
+	}
+	s.setAttribute("http.method", r.Method)
+	s.setAttribute("http.url", requestURL(r))
+	s.setAttribute("whsentry.request_id", requestUUID.String())
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// newSpan starts a span in the same trace as parent, sampled if parent is
+func (t *tracer) newSpan(name string, kind spanKind, parent spanContext) *span {
+	s := &span{
+		spanContext: spanContext{traceID: parent.traceID, sampled: parent.sampled},
+		tracer:      t,
+		name:        name,
+		kind:        kind,
+		start:       time.Now(),
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// propagate sets or removes the trace context headers of an outbound request. Forwarded headers name the
+// request's span as the parent, so the target's spans are nested under the proxy's.
+func (t *tracer) propagate(ctx context.Context, header http.Header) {
+	if t == nil {
+		return
+	}
+	if t.config.Propagation == StripTraceContext {
+		header.Del(TraceparentHeader)
+		header.Del(TracestateHeader)
+		return
+	}
+	if s := spanFromContext(ctx); s != nil {
+		header.Set(TraceparentHeader, s.spanContext.traceparent())
+	}
+}
+
+func (t *tracer) queueSpan(s *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		atomic.AddUint64(&t.dropped, 1)
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Close stops accepting spans, exports the queued ones, and closes the trace file if there is one
+func (t *tracer) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+	<-t.done
+	if t.file != nil {
+		return t.file.Close()
+	}
+	return nil
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.config.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, t.config.BatchSize)
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				if len(batch) > 0 {
+					t.export(batch)
+				}
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < t.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		t.export(batch)
+		batch = make([]*span, 0, t.config.BatchSize)
+	}
+}
+
+func (t *tracer) export(batch []*span) {
+	if dropped := atomic.SwapUint64(&t.dropped, 0); dropped > 0 {
+		log.Warnf("Trace export queue was full, dropped %d spans\n", dropped)
+	}
+	data, err := encodeSpans(t.config.ServiceName, batch)
+	if err != nil {
+		log.Errorf("Failed to encode %d spans: %s\n", len(batch), err)
+	} else if err := t.exporter.export(data); err != nil {
+		log.Warnf("Failed to export %d spans: %s\n", len(batch), err)
+	}
+}
+
+// spanExporter sends a batch of spans encoded as an OTLP ExportTraceServiceRequest in JSON
+type spanExporter interface {
+	export(data []byte) error
+}
+
+// otlpExporter posts spans to a collector with OTLP/HTTP. A batch the collector is too busy for is retried
+// up to maxRetries times, after the Retry-After the collector asked for or an exponential backoff.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	// backoff is the wait before the first retry, doubled for each retry after that
+	backoff    time.Duration
+	maxRetries int
+}
+
+const (
+	defaultExportBackoff    = time.Second
+	defaultExportMaxRetries = 3
+	// maxRetryAfter caps the wait a collector can ask for, so a busy collector can't hold up the queue for long
+	maxRetryAfter = 30 * time.Second
+)
+
+func (e *otlpExporter) export(data []byte) error {
+	backoff := e.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := e.post(data)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return nil
+		}
+		if !retryableExportStatus(resp.StatusCode) || attempt >= e.maxRetries {
+			return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+		}
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			wait = backoff
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (e *otlpExporter) post(data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	return e.client.Do(req)
+}
+
+// retryableExportStatus reports whether OTLP/HTTP says a batch rejected with status should be sent again
+func retryableExportStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+	} else {
+		return 0, false
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
+
+// writerExporter writes each batch as a line of JSON, the same format the OpenTelemetry Collector's file
+// exporter uses, so the output can be replayed into a collector
+type writerExporter struct {
+	w io.Writer
+}
+
+func (e *writerExporter) export(data []byte) error {
+	_, err := e.w.Write(append(data, '\n'))
+	return err
+}
+
+// The OTLP JSON encoding of spans. IDs are hex rather than base64, and 64 bit integers are strings.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              spanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func newOTLPValue(value interface{}) otlpValue {
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+func encodeSpans(serviceName string, spans []*span) ([]byte, error) {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: spanStatusUnset},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attributes {
+			o.Attributes = append(o.Attributes, otlpAttribute{Key: a.key, Value: newOTLPValue(a.value)})
+		}
+		if s.errorMessage != "" {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.errorMessage}
+		}
+		encoded = append(encoded, o)
+	}
+	return json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: newOTLPValue(serviceName)}}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "webhook-sentry"}, Spans: encoded}},
+	}}})
+}
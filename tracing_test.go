@@ -0,0 +1,487 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assertEqual(t, true, ok)
+	assertEqual(t, true, sc.sampled)
+	assertEqual(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.traceparent())
+
+	// Later versions may append fields
+	_, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assertEqual(t, true, ok)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+	} {
+		if _, ok := parseTraceparent(invalid); ok {
+			t.Errorf("Expected traceparent %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	batches := make(chan otlpTraces, 100)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err == nil {
+			batches <- traces
+		}
+	}))
+	defer collector.Close()
+
+	newFixture := func(propagation TracePropagation) *testFixture {
+		return &testFixture{
+			configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+				config.InsecureSkipCidrDenyList = true
+				config.Tracing.Enabled = true
+				config.Tracing.Endpoint = collector.URL + "/v1/traces"
+				config.Tracing.FlushInterval = 10 * time.Millisecond
+				config.Tracing.Propagation = propagation
+			},
+			serversSetup: func(c *certificateFixtures) []*http.Server {
+				return []*http.Server{startTargetServer(t)}
+			},
+		}
+	}
+	getTraceparent := func(client *http.Client, traceparent string) string {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+httpTargetServerPort+"/traceparent", nil)
+		checkNoError(t, err)
+		req.Header.Set(TraceparentHeader, traceparent)
+		resp, err := client.Do(req)
+		checkNoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		checkNoError(t, err)
+		return string(body)
+	}
+
+	t.Run("Forward", func(t *testing.T) {
+		fixture := newFixture(ForwardTraceContext)
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		forwarded, ok := parseTraceparent(getTraceparent(client, incoming))
+		assertEqual(t, true, ok)
+		assertEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(forwarded.traceID[:]))
+		assertEqual(t, true, forwarded.sampled)
+
+		// The request's span ends last, so once it's in, so are the others
+		spans := make(map[string]otlpSpan)
+		timeout := time.After(5 * time.Second)
+		for spans["proxy request"].SpanID == "" {
+			select {
+			case traces := <-batches:
+				for _, s := range traces.ResourceSpans[0].ScopeSpans[0].Spans {
+					spans[s.Name] = s
+				}
+				assertEqual(t, "webhook-sentry", *traces.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+			case <-timeout:
+				t.Fatal("Timed out waiting for the request span")
+			}
+		}
+		root := spans["proxy request"]
+		assertEqual(t, "00f067aa0ba902b7", root.ParentSpanID)
+		assertEqual(t, hex.EncodeToString(forwarded.spanID[:]), root.SpanID)
+		assertEqual(t, spanKindServer, root.Kind)
+		assertEqual(t, spanStatusUnset, root.Status.Code)
+		attributes := make(map[string]otlpValue)
+		for _, a := range root.Attributes {
+			attributes[a.Key] = a.Value
+		}
+		assertEqual(t, "200", *attributes["http.status_code"].IntValue)
+		assertEqual(t, "GET", *attributes["http.method"].StringValue)
+
+		for _, name := range []string{"dns lookup", "connect", "stream response"} {
+			child, ok := spans[name]
+			if !ok {
+				t.Fatalf("Expected a %s span", name)
+			}
+			assertEqual(t, root.TraceID, child.TraceID)
+			assertEqual(t, root.SpanID, child.ParentSpanID)
+			assertEqual(t, spanKindInternal, child.Kind)
+		}
+
+		// An unsampled trace is still continued, just not exported
+		unsampled, ok := parseTraceparent(getTraceparent(client, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+		assertEqual(t, true, ok)
+		assertEqual(t, false, unsampled.sampled)
+	})
+
+	t.Run("Strip", func(t *testing.T) {
+		fixture := newFixture(StripTraceContext)
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		assertEqual(t, "", getTraceparent(client, incoming))
+	})
+}
+
+func TestTraceFileExporter(t *testing.T) {
+	var out bytes.Buffer
+	exporter := &writerExporter{w: &out}
+	tr := &tracer{config: TracingConfig{ServiceName: "sentry"}}
+	s := tr.newSpan("proxy request", spanKindServer, spanContext{sampled: true})
+	s.setAttribute("http.status_code", 502)
+	s.setAttribute("whsentry.truncated", true)
+	s.setError(errors.New("test error"))
+	s.end = s.start.Add(time.Millisecond)
+	data, err := encodeSpans(tr.config.ServiceName, []*span{s})
+	checkNoError(t, err)
+	checkNoError(t, exporter.export(data))
+
+	var traces otlpTraces
+	checkNoError(t, json.Unmarshal(out.Bytes(), &traces))
+	encoded := traces.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assertEqual(t, spanStatusError, encoded.Status.Code)
+	assertEqual(t, "test error", encoded.Status.Message)
+	assertEqual(t, "", encoded.ParentSpanID)
+	assertEqual(t, "502", *encoded.Attributes[0].Value.IntValue)
+	assertEqual(t, true, *encoded.Attributes[1].Value.BoolValue)
+	assertEqual(t, byte('\n'), out.Bytes()[out.Len()-1])
+}
+
+func TestTracerClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	traceFile := filepath.Join(dir, "traces.jsonl")
+
+	// Spans would otherwise wait for a full batch or the flush interval
+	tr, err := newTracer(TracingConfig{Enabled: true, Exporter: FileExporter, File: traceFile, ServiceName: "sentry",
+		SampleRatio: 1, BatchSize: 100, FlushInterval: time.Hour, QueueSize: 10})
+	checkNoError(t, err)
+	for i := 0; i < 3; i++ {
+		tr.newSpan("proxy request", spanKindServer, spanContext{sampled: true}).finish()
+	}
+	checkNoError(t, tr.Close())
+	tr.newSpan("proxy request", spanKindServer, spanContext{sampled: true}).finish()
+	checkNoError(t, tr.Close())
+
+	data, err := ioutil.ReadFile(traceFile)
+	checkNoError(t, err)
+	var traces otlpTraces
+	checkNoError(t, json.Unmarshal(data, &traces))
+	assertEqual(t, 3, len(traces.ResourceSpans[0].ScopeSpans[0].Spans))
+}
+
+// otlpField is the type of a field in the OTLP/JSON encoding: the proto3 JSON mapping, except that trace and
+// span IDs are hex rather than base64
+type otlpField struct {
+	kind     string
+	message  string
+	repeated bool
+	// size is the length in bytes of an ID
+	size int
+}
+
+// otlpSchema is ExportTraceServiceRequest and the messages it uses, as of opentelemetry-proto v1.3.1, named
+// by their lowerCamelCase JSON field names
+var otlpSchema = map[string]map[string]otlpField{
+	"ExportTraceServiceRequest": {
+		"resourceSpans": {kind: "message", message: "ResourceSpans", repeated: true},
+	},
+	"ResourceSpans": {
+		"resource":   {kind: "message", message: "Resource"},
+		"scopeSpans": {kind: "message", message: "ScopeSpans", repeated: true},
+		"schemaUrl":  {kind: "string"},
+	},
+	"Resource": {
+		"attributes":             {kind: "message", message: "KeyValue", repeated: true},
+		"droppedAttributesCount": {kind: "uint32"},
+	},
+	"ScopeSpans": {
+		"scope":     {kind: "message", message: "InstrumentationScope"},
+		"spans":     {kind: "message", message: "Span", repeated: true},
+		"schemaUrl": {kind: "string"},
+	},
+	"InstrumentationScope": {
+		"name":                   {kind: "string"},
+		"version":                {kind: "string"},
+		"attributes":             {kind: "message", message: "KeyValue", repeated: true},
+		"droppedAttributesCount": {kind: "uint32"},
+	},
+	"Span": {
+		"traceId":                {kind: "id", size: 16},
+		"spanId":                 {kind: "id", size: 8},
+		"traceState":             {kind: "string"},
+		"parentSpanId":           {kind: "id", size: 8},
+		"flags":                  {kind: "uint32"},
+		"name":                   {kind: "string"},
+		"kind":                   {kind: "enum", size: 5},
+		"startTimeUnixNano":      {kind: "uint64"},
+		"endTimeUnixNano":        {kind: "uint64"},
+		"attributes":             {kind: "message", message: "KeyValue", repeated: true},
+		"droppedAttributesCount": {kind: "uint32"},
+		"events":                 {kind: "message", message: "Event", repeated: true},
+		"droppedEventsCount":     {kind: "uint32"},
+		"links":                  {kind: "message", message: "Link", repeated: true},
+		"droppedLinksCount":      {kind: "uint32"},
+		"status":                 {kind: "message", message: "Status"},
+	},
+	"Event": {
+		"timeUnixNano":           {kind: "uint64"},
+		"name":                   {kind: "string"},
+		"attributes":             {kind: "message", message: "KeyValue", repeated: true},
+		"droppedAttributesCount": {kind: "uint32"},
+	},
+	"Link": {
+		"traceId":                {kind: "id", size: 16},
+		"spanId":                 {kind: "id", size: 8},
+		"traceState":             {kind: "string"},
+		"attributes":             {kind: "message", message: "KeyValue", repeated: true},
+		"droppedAttributesCount": {kind: "uint32"},
+		"flags":                  {kind: "uint32"},
+	},
+	"Status": {
+		"message": {kind: "string"},
+		"code":    {kind: "enum", size: 2},
+	},
+	"KeyValue": {
+		"key":   {kind: "string"},
+		"value": {kind: "message", message: "AnyValue"},
+	},
+	// AnyValue is a oneof, so exactly one of these is set
+	"AnyValue": {
+		"stringValue": {kind: "string"},
+		"boolValue":   {kind: "bool"},
+		"intValue":    {kind: "int64"},
+		"doubleValue": {kind: "double"},
+		"arrayValue":  {kind: "message", message: "ArrayValue"},
+		"kvlistValue": {kind: "message", message: "KeyValueList"},
+		"bytesValue":  {kind: "bytes"},
+	},
+	"ArrayValue": {
+		"values": {kind: "message", message: "AnyValue", repeated: true},
+	},
+	"KeyValueList": {
+		"values": {kind: "message", message: "KeyValue", repeated: true},
+	},
+}
+
+// checkOTLPMessage checks that value is a valid message of the named type. Unknown fields are errors, as a
+// misspelled field would otherwise be silently ignored by the collector.
+func checkOTLPMessage(t *testing.T, path string, message string, value interface{}) {
+	t.Helper()
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s: expected a %s object, got %v", path, message, value)
+	}
+	if message == "AnyValue" && len(object) != 1 {
+		t.Fatalf("%s: expected exactly one value, got %v", path, object)
+	}
+	for name, fieldValue := range object {
+		field, ok := otlpSchema[message][name]
+		if !ok {
+			t.Fatalf("%s: %s has no field %s", path, message, name)
+		}
+		if !field.repeated {
+			checkOTLPField(t, path+"."+name, field, fieldValue)
+			continue
+		}
+		values, ok := fieldValue.([]interface{})
+		if !ok {
+			t.Fatalf("%s.%s: expected an array, got %v", path, name, fieldValue)
+		}
+		for i, v := range values {
+			checkOTLPField(t, fmt.Sprintf("%s.%s[%d]", path, name, i), field, v)
+		}
+	}
+}
+
+func checkOTLPField(t *testing.T, path string, field otlpField, value interface{}) {
+	t.Helper()
+	var err error
+	switch field.kind {
+	case "message":
+		checkOTLPMessage(t, path, field.message, value)
+		return
+	case "string":
+		if _, ok := value.(string); !ok {
+			err = errors.New("expected a string")
+		}
+	case "bool":
+		if _, ok := value.(bool); !ok {
+			err = errors.New("expected a bool")
+		}
+	case "id":
+		s, ok := value.(string)
+		if !ok {
+			err = errors.New("expected a hex string")
+		} else if id, decodeErr := hex.DecodeString(s); decodeErr != nil || len(id) != field.size {
+			err = fmt.Errorf("expected %d bytes in hex", field.size)
+		} else if bytes.Equal(id, make([]byte, field.size)) {
+			err = errors.New("an all zero ID is invalid")
+		}
+	case "bytes":
+		s, ok := value.(string)
+		if !ok {
+			err = errors.New("expected a base64 string")
+		} else {
+			_, err = base64.StdEncoding.DecodeString(s)
+		}
+	case "uint32", "enum":
+		// Enums are numbers here; the JSON mapping also allows their names, which we don't send
+		n, ok := value.(json.Number)
+		if !ok {
+			err = errors.New("expected a number")
+		} else if u, parseErr := strconv.ParseUint(string(n), 10, 32); parseErr != nil {
+			err = parseErr
+		} else if field.kind == "enum" && u > uint64(field.size) {
+			err = errors.New("not a valid enum value")
+		}
+	case "int64", "uint64":
+		// 64 bit integers are decimal strings, though numbers are accepted too
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case json.Number:
+			s = string(v)
+		default:
+			err = errors.New("expected a decimal string")
+		}
+		if err == nil && field.kind == "int64" {
+			_, err = strconv.ParseInt(s, 10, 64)
+		} else if err == nil {
+			_, err = strconv.ParseUint(s, 10, 64)
+		}
+	case "double":
+		if _, ok := value.(json.Number); !ok {
+			err = errors.New("expected a number")
+		}
+	}
+	if err != nil {
+		t.Fatalf("%s: %s, got %v", path, err, value)
+	}
+}
+
+func TestOTLPSchema(t *testing.T) {
+	tr := &tracer{config: TracingConfig{ServiceName: "sentry"}}
+	parent := tr.newSpan("proxy request", spanKindServer, spanContext{sampled: true})
+	rand.Read(parent.traceID[:])
+	parent.setAttribute("http.method", "GET")
+	parent.setAttribute("http.status_code", 403)
+	parent.setAttribute("whsentry.body_bytes", int64(1<<40))
+	parent.setAttribute("whsentry.truncated", false)
+	parent.setError(errors.New("test error"))
+	parent.end = parent.start.Add(time.Millisecond)
+	child := tr.newSpan("dns lookup", spanKindInternal, parent.spanContext)
+	child.parentID = parent.spanID
+	child.end = child.start.Add(time.Microsecond)
+
+	data, err := encodeSpans(tr.config.ServiceName, []*span{parent, child})
+	checkNoError(t, err)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var request interface{}
+	checkNoError(t, decoder.Decode(&request))
+	checkOTLPMessage(t, "request", "ExportTraceServiceRequest", request)
+
+	resourceSpans := request.(map[string]interface{})["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := resourceSpans["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+	assertEqual(t, "service.name", resource["key"])
+	assertEqual(t, "sentry", resource["value"].(map[string]interface{})["stringValue"])
+	scopeSpans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	assertEqual(t, "webhook-sentry", scopeSpans["scope"].(map[string]interface{})["name"])
+
+	spans := scopeSpans["spans"].([]interface{})
+	encodedParent := spans[0].(map[string]interface{})
+	assertEqual(t, json.Number("2"), encodedParent["kind"])
+	assertEqual(t, strconv.FormatInt(parent.start.UnixNano(), 10), encodedParent["startTimeUnixNano"])
+	assertEqual(t, strconv.FormatInt(parent.end.UnixNano(), 10), encodedParent["endTimeUnixNano"])
+	status := encodedParent["status"].(map[string]interface{})
+	assertEqual(t, json.Number("2"), status["code"])
+	assertEqual(t, "test error", status["message"])
+	encodedChild := spans[1].(map[string]interface{})
+	assertEqual(t, json.Number("1"), encodedChild["kind"])
+	assertEqual(t, encodedParent["traceId"], encodedChild["traceId"])
+	assertEqual(t, encodedParent["spanId"], encodedChild["parentSpanId"])
+	_, hasMessage := encodedChild["status"].(map[string]interface{})["message"]
+	assertEqual(t, false, hasMessage)
+}
+
+// newCollector starts a collector that responds to each export with the next of statuses
+func newCollector(statuses ...int) (*httptest.Server, *int32) {
+	var attempts int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[atomic.AddInt32(&attempts, 1)-1]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	}))
+	return collector, &attempts
+}
+
+func TestOTLPExporterRetry(t *testing.T) {
+	newExporter := func(collector *httptest.Server) *otlpExporter {
+		return &otlpExporter{endpoint: collector.URL, client: &http.Client{}, backoff: time.Millisecond, maxRetries: 2}
+	}
+
+	t.Run("Retries when the collector is busy", func(t *testing.T) {
+		collector, attempts := newCollector(http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK)
+		defer collector.Close()
+		checkNoError(t, newExporter(collector).export([]byte("{}")))
+		assertEqual(t, int32(3), atomic.LoadInt32(attempts))
+	})
+
+	t.Run("Gives up after maxRetries", func(t *testing.T) {
+		collector, attempts := newCollector(http.StatusBadGateway, http.StatusGatewayTimeout, http.StatusServiceUnavailable)
+		defer collector.Close()
+		assertError(t, "collector responded with status 503", newExporter(collector).export([]byte("{}")))
+		assertEqual(t, int32(3), atomic.LoadInt32(attempts))
+	})
+
+	t.Run("Doesn't retry a rejected batch", func(t *testing.T) {
+		collector, attempts := newCollector(http.StatusBadRequest)
+		defer collector.Close()
+		assertError(t, "collector responded with status 400", newExporter(collector).export([]byte("{}")))
+		assertEqual(t, int32(1), atomic.LoadInt32(attempts))
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	wait, ok := parseRetryAfter("2")
+	assertEqual(t, true, ok)
+	assertEqual(t, 2*time.Second, wait)
+	wait, ok = parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	assertEqual(t, true, ok)
+	assertEqual(t, time.Duration(0), wait)
+	wait, ok = parseRetryAfter("3600")
+	assertEqual(t, true, ok)
+	assertEqual(t, maxRetryAfter, wait)
+	_, ok = parseRetryAfter("soon")
+	assertEqual(t, false, ok)
+	_, ok = parseRetryAfter("")
+	assertEqual(t, false, ok)
+}
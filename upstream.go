@@ -0,0 +1,257 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// upstreamProxy tunnels outbound connections to the matching destinations through another proxy, using
+// HTTP CONNECT or SOCKS5. The target is always resolved and checked locally first, and the upstream is asked
+// to connect to the checked IP rather than the hostname, so it can't resolve the name to some other address.
+type upstreamProxy struct {
+	hosts   []HostPattern
+	url     *url.URL
+	rootCAs *x509.CertPool
+}
+
+func newUpstreamProxies(configs []UpstreamProxyConfig, rootCAs *x509.CertPool) ([]*upstreamProxy, error) {
+	var upstreams []*upstreamProxy
+	for _, config := range configs {
+		u, err := parseUpstreamProxyURL(config.URL)
+		if err != nil {
+			return nil, err
+		}
+		upstreamRootCAs := rootCAs
+		if config.CAFile != "" {
+			if upstreamRootCAs, err = loadCAFile(config.CAFile); err != nil {
+				return nil, err
+			}
+		}
+		upstreams = append(upstreams, &upstreamProxy{hosts: config.Hosts, url: u, rootCAs: upstreamRootCAs})
+	}
+	return upstreams, nil
+}
+
+func parseUpstreamProxyURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid upstream proxy URL %s: %s", rawURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("Invalid upstream proxy URL %s: scheme must be one of http, https or socks5", rawURL)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("Invalid upstream proxy URL %s: it must have a host and port", rawURL)
+	}
+	return u, nil
+}
+
+// upstreamFor returns the first upstream proxy whose hosts match the target host, or nil to connect directly.
+// An upstream without any hosts matches every target.
+func (s *safeDialer) upstreamFor(host string) *upstreamProxy {
+	for _, upstream := range s.upstreamProxies {
+		if len(upstream.hosts) == 0 {
+			return upstream
+		}
+		if _, ok := matchAny(upstream.hosts, host); ok {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// dialTarget connects to the first reachable address of a target that has already passed the policy checks,
+// through an upstream proxy if one is configured for it
+func (s *safeDialer) dialTarget(ctx context.Context, host string, ipPorts []string) (conn net.Conn, err error) {
+	host = strings.TrimSuffix(host, ".")
+	dialer, err := s.dialerFor(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer recordPhase(ctx, connectPhase, time.Now())
+	_, connectSpan := startSpan(ctx, "connect")
+	defer func() {
+		if conn != nil {
+			connectSpan.setAttribute("net.peer.addr", conn.RemoteAddr().String())
+		}
+		connectSpan.finishWithError(err)
+	}()
+	upstream := s.upstreamFor(host)
+	if upstream == nil {
+		return s.dialFirstReachable(ctx, dialer, ipPorts)
+	}
+	var lastErr error
+	for _, ipPort := range ipPorts {
+		conn, err := upstream.dial(ctx, dialer, ipPort)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		// If we can't reach the upstream at all, other target addresses won't help
+		if pErr, ok := err.(*proxyError); ok && pErr.errorCode != UpstreamProxyRejected {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (u *upstreamProxy) dial(ctx context.Context, dialer *net.Dialer, ipPort string) (net.Conn, error) {
+	if u.url.Scheme == "socks5" {
+		return u.dialSocks5(ctx, dialer, ipPort)
+	}
+	return u.dialConnect(ctx, dialer, ipPort)
+}
+
+func (u *upstreamProxy) dialConnect(ctx context.Context, dialer *net.Dialer, ipPort string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp4", u.url.Host)
+	if err != nil {
+		return nil, upstreamConnectError(u.url, err)
+	}
+	// The connect timeout covers setting up the tunnel too. Without one, only ctx's deadline applies.
+	deadline := connectDeadline(dialer.Timeout)
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if u.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.url.Hostname(), RootCAs: u.rootCAs})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, upstreamConnectError(u.url, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: ipPort},
+		Host:   ipPort,
+		Header: make(http.Header),
+	}
+	if u.url.User != nil {
+		password, _ := u.url.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.url.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, upstreamConnectError(u.url, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, upstreamConnectError(u.url, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		conn.Close()
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Upstream proxy %s rejected our credentials", u.url.Host), errorCode: UpstreamProxyAuthError}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		conn.Close()
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Upstream proxy %s refused to connect to %s: %s", u.url.Host, ipPort, resp.Status), errorCode: UpstreamProxyRejected}
+	}
+	conn.SetDeadline(time.Time{})
+	return newUpstreamConn(conn, reader, ipPort), nil
+}
+
+func (u *upstreamProxy) dialSocks5(ctx context.Context, dialer *net.Dialer, ipPort string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u.url.User != nil {
+		password, _ := u.url.User.Password()
+		auth = &proxy.Auth{User: u.url.User.Username(), Password: password}
+	}
+	ctx, cancel := withConnectTimeout(ctx, dialer.Timeout)
+	defer cancel()
+	forward := &upstreamDialer{dialer: dialer}
+	socksDialer, err := proxy.SOCKS5("tcp4", u.url.Host, auth, forward)
+	if err != nil {
+		return nil, upstreamConnectError(u.url, err)
+	}
+	conn, err := socksDialer.(proxy.ContextDialer).DialContext(ctx, "tcp4", ipPort)
+	if err == nil {
+		return newUpstreamConn(conn, conn, ipPort), nil
+	}
+	var dialErr *upstreamDialError
+	switch {
+	case errors.As(err, &dialErr):
+		return nil, upstreamConnectError(u.url, dialErr.err)
+	// This is hacky, but the SOCKS errors aren't exported
+	case strings.Contains(err.Error(), "authentication"):
+		return nil, &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Upstream proxy %s rejected our credentials", u.url.Host), errorCode: UpstreamProxyAuthError}
+	}
+	return nil, &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Upstream proxy %s refused to connect to %s: %s", u.url.Host, ipPort, err), errorCode: UpstreamProxyRejected}
+}
+
+// upstreamDialer connects to a SOCKS5 upstream, marking its errors so they can be told apart from errors
+// the upstream reports
+type upstreamDialer struct {
+	dialer *net.Dialer
+}
+
+type upstreamDialError struct {
+	err error
+}
+
+func (e *upstreamDialError) Error() string {
+	return e.err.Error()
+}
+
+func (d *upstreamDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &upstreamDialError{err: err}
+	}
+	return conn, nil
+}
+
+func upstreamConnectError(u *url.URL, err error) error {
+	return &proxyError{statusCode: http.StatusBadGateway, message: fmt.Sprintf("Could not connect to upstream proxy %s: %s", u.Host, err), errorCode: UpstreamProxyConnectError}
+}
+
+// upstreamConn is a tunnel through an upstream proxy. It reports the target as its remote address, so the
+// access log has the IP we asked the upstream to connect to rather than the upstream's.
+type upstreamConn struct {
+	net.Conn
+	reader io.Reader
+	target net.Addr
+}
+
+func newUpstreamConn(conn net.Conn, reader io.Reader, ipPort string) *upstreamConn {
+	target, _ := net.ResolveTCPAddr("tcp4", ipPort)
+	return &upstreamConn{Conn: conn, reader: reader, target: target}
+}
+
+func (c *upstreamConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *upstreamConn) RemoteAddr() net.Addr {
+	return c.target
+}
@@ -0,0 +1,295 @@
+/**
+ * Copyright (c) 2020 Ameya Lokare
+ */
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	upstreamProxyAddress    = "127.0.0.1:11094"
+	tlsUpstreamProxyAddress = "127.0.0.1:11095"
+)
+
+// fakeUpstreamProxy is an HTTP CONNECT proxy that records the targets it was asked to connect to
+type fakeUpstreamProxy struct {
+	server   *http.Server
+	password string
+	mu       sync.Mutex
+	targets  []string
+}
+
+func startFakeUpstreamProxy(t *testing.T, password string) *fakeUpstreamProxy {
+	upstream := &fakeUpstreamProxy{password: password}
+	upstream.server = &http.Server{Addr: upstreamProxyAddress, Handler: upstream}
+	listener, err := net.Listen("tcp4", upstreamProxyAddress)
+	if err != nil {
+		t.Fatalf("Could not start upstream proxy listener: %s\n", err)
+	}
+	go upstream.server.Serve(listener)
+	return upstream
+}
+
+// startFakeTLSUpstreamProxy is a fakeUpstreamProxy that clients connect to over TLS
+func startFakeTLSUpstreamProxy(t *testing.T, password string, cert *tls.Certificate) *fakeUpstreamProxy {
+	upstream := &fakeUpstreamProxy{password: password}
+	upstream.server = &http.Server{Addr: tlsUpstreamProxyAddress, Handler: upstream}
+	listener, err := tls.Listen("tcp4", tlsUpstreamProxyAddress, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	if err != nil {
+		t.Fatalf("Could not start TLS upstream proxy listener: %s\n", err)
+	}
+	go upstream.server.Serve(listener)
+	return upstream
+}
+
+func (u *fakeUpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "Only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("egress:"+u.password))
+	if u.password != "" && r.Header.Get("Proxy-Authorization") != expected {
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	u.mu.Lock()
+	u.targets = append(u.targets, r.Host)
+	u.mu.Unlock()
+	outboundConn, err := net.Dial("tcp4", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer outboundConn.Close()
+	inboundConn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer inboundConn.Close()
+	bufrw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	bufrw.Flush()
+	go io.Copy(outboundConn, bufrw)
+	io.Copy(inboundConn, outboundConn)
+}
+
+func (u *fakeUpstreamProxy) connectTargets() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.targets...)
+}
+
+func upstreamProxyFixture(t *testing.T, upstreams ...UpstreamProxyConfig) *testFixture {
+	return &testFixture{
+		configSetup: func(config *ProxyConfig, c *certificateFixtures) {
+			config.InsecureSkipCidrDenyList = true
+			config.UpstreamProxies = upstreams
+		},
+		serversSetup: func(c *certificateFixtures) []*http.Server {
+			return []*http.Server{startTargetServer(t)}
+		},
+	}
+}
+
+// withZeroConnectTimeout sets the fixture's connect timeout to zero, which means no deadline
+func withZeroConnectTimeout(fixture *testFixture) *testFixture {
+	setup := fixture.configSetup
+	fixture.configSetup = func(config *ProxyConfig, c *certificateFixtures) {
+		setup(config, c)
+		config.ConnectTimeout = 0
+	}
+	return fixture
+}
+
+func getTargetViaProxy(t *testing.T, client *http.Client) *http.Response {
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%s/target", httpTargetServerPort))
+	if err != nil {
+		t.Fatalf("Error in GET request to target server via proxy: %s\n", err)
+	}
+	return resp
+}
+
+func assertReasonCode(t *testing.T, resp *http.Response, statusCode int, reasonCode string) {
+	if resp.StatusCode != statusCode {
+		t.Errorf("Expected status code %d, got %d\n", statusCode, resp.StatusCode)
+	}
+	if errorCode := resp.Header.Get(ReasonCodeHeader); errorCode != reasonCode {
+		t.Errorf("Expected errorCode %s, but found %s", reasonCode, errorCode)
+	}
+}
+
+func TestHTTPConnectUpstreamProxy(t *testing.T) {
+	upstream := startFakeUpstreamProxy(t, "s3cret")
+	defer upstream.server.Close()
+
+	t.Run("Tunnels to the resolved IP", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "http://egress:s3cret@" + upstreamProxyAddress})
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		resp := getTargetViaProxy(t, client)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "Hello from target", string(body))
+		targets := upstream.connectTargets()
+		assertEqual(t, "127.0.0.1:"+httpTargetServerPort, targets[len(targets)-1])
+	})
+
+	t.Run("Zero connect timeout", func(t *testing.T) {
+		fixture := withZeroConnectTimeout(upstreamProxyFixture(t, UpstreamProxyConfig{URL: "http://egress:s3cret@" + upstreamProxyAddress}))
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		resp := getTargetViaProxy(t, client)
+		assertEqual(t, 200, resp.StatusCode)
+	})
+
+	t.Run("Only matching hosts use the upstream", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{Hosts: []HostPattern{mustParseHostPattern(t, "*.example.com")}, URL: "http://egress:wrong@" + upstreamProxyAddress})
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		resp := getTargetViaProxy(t, client)
+		assertEqual(t, 200, resp.StatusCode)
+	})
+
+	t.Run("Bad credentials", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "http://egress:wrong@" + upstreamProxyAddress})
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		assertReasonCode(t, getTargetViaProxy(t, client), http.StatusBadGateway, UpstreamProxyAuthError)
+	})
+
+	t.Run("Upstream unreachable", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "http://127.0.0.1:1"})
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		assertReasonCode(t, getTargetViaProxy(t, client), http.StatusBadGateway, UpstreamProxyConnectError)
+	})
+
+	t.Run("Blocked IPs are never tunnelled", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "http://egress:s3cret@" + upstreamProxyAddress})
+		setup := fixture.configSetup
+		fixture.configSetup = func(config *ProxyConfig, c *certificateFixtures) {
+			setup(config, c)
+			config.InsecureSkipCidrDenyList = false
+		}
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		before := len(upstream.connectTargets())
+		assertReasonCode(t, getTargetViaProxy(t, client), http.StatusForbidden, BlockedIPAddress)
+		assertEqual(t, before, len(upstream.connectTargets()))
+	})
+}
+
+func TestHTTPSUpstreamProxyWithPrivateCA(t *testing.T) {
+	certificates := newCertificateFixtures(t)
+	upstream := startFakeTLSUpstreamProxy(t, "s3cret", certificates.proxyCert)
+	defer upstream.server.Close()
+	dir, err := ioutil.TempDir("", "upstream")
+	checkNoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificates.rootCACert.Certificate[0]})
+	checkNoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	t.Run("Trusts the CA file", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "https://egress:s3cret@" + tlsUpstreamProxyAddress, CAFile: caFile})
+		fixture.certificates = certificates
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		resp := getTargetViaProxy(t, client)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "Hello from target", string(body))
+	})
+
+	t.Run("Untrusted without the CA file", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "https://egress:s3cret@" + tlsUpstreamProxyAddress})
+		fixture.certificates = certificates
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		assertReasonCode(t, getTargetViaProxy(t, client), http.StatusBadGateway, UpstreamProxyConnectError)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		err := validateUpstreamProxies([]UpstreamProxyConfig{{URL: "http://" + upstreamProxyAddress, CAFile: caFile}})
+		assertError(t, "caFile is only used with an https URL", err)
+		err = validateUpstreamProxies([]UpstreamProxyConfig{{URL: "https://" + tlsUpstreamProxyAddress, CAFile: filepath.Join(dir, "missing.pem")}})
+		assertError(t, "Error reading CA file", err)
+		err = validateUpstreamProxies([]UpstreamProxyConfig{{URL: "https://" + tlsUpstreamProxyAddress, CAFile: caFile}})
+		checkNoError(t, err)
+	})
+}
+
+func TestSocks5UpstreamProxy(t *testing.T) {
+	upstream := startSocks5Proxy(t, func(config *ProxyConfig, l *ListenerConfig) {
+		l.Socks5.Users = map[string]string{"egress": "s3cret"}
+	})
+	defer upstream.Close()
+	waitForStartup(t, proxySocks5Address)
+
+	t.Run("Tunnels through SOCKS5", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "socks5://egress:s3cret@" + proxySocks5Address})
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		resp := getTargetViaProxy(t, client)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assertEqual(t, "Hello from target", string(body))
+	})
+
+	t.Run("Zero connect timeout", func(t *testing.T) {
+		fixture := withZeroConnectTimeout(upstreamProxyFixture(t, UpstreamProxyConfig{URL: "socks5://egress:s3cret@" + proxySocks5Address}))
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		resp := getTargetViaProxy(t, client)
+		assertEqual(t, 200, resp.StatusCode)
+	})
+
+	t.Run("Bad credentials", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "socks5://egress:wrong@" + proxySocks5Address})
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		assertReasonCode(t, getTargetViaProxy(t, client), http.StatusBadGateway, UpstreamProxyAuthError)
+	})
+
+	t.Run("Upstream refuses the target", func(t *testing.T) {
+		fixture := upstreamProxyFixture(t, UpstreamProxyConfig{URL: "socks5://egress:s3cret@" + proxySocks5Address})
+		setup := fixture.configSetup
+		fixture.configSetup = func(config *ProxyConfig, c *certificateFixtures) {
+			setup(config, c)
+			// Nothing listens here, so the upstream can't connect
+			config.AllowedPorts = append(config.AllowedPorts, 14401)
+		}
+		client := fixture.setUp(t)
+		defer fixture.tearDown(t)
+
+		resp, err := client.Get("http://localhost:14401/target")
+		checkNoError(t, err)
+		assertReasonCode(t, resp, http.StatusBadGateway, UpstreamProxyRejected)
+	})
+}
+
+func TestUpstreamProxyURLValidation(t *testing.T) {
+	_, err := parseUpstreamProxyURL("ftp://proxy:21")
+	assertError(t, "scheme must be one of http, https or socks5", err)
+	_, err = parseUpstreamProxyURL("http://proxy")
+	assertError(t, "it must have a host and port", err)
+}